@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gertanoh/dns-resolver/internal/api"
+	"github.com/gertanoh/dns-resolver/internal/cluster"
+	"github.com/gertanoh/dns-resolver/internal/server"
+)
+
+// admin carries out the actions taken on the API, and on the other nodes
+// of the cluster when there is one.
+type admin struct {
+	srv        *server.Server
+	blocklists string
+	zones      localZones
+	cluster    *cluster.Node // nil outside cluster mode
+	// token, when set, is required as bearer token by actions, which are
+	// otherwise only taken from loopback clients
+	token []byte
+}
+
+// apply carries out an action on this node only.
+func (a *admin) apply(e cluster.Event) error {
+	switch e.Kind {
+	case cluster.FlushCache:
+		n, err := a.srv.FlushCache(e.Name)
+		if err != nil {
+			return err
+		}
+		log.Printf("Flushed %d cached answers", n)
+	case cluster.ReloadBlocklist:
+		if a.blocklists == "" {
+			return errors.New("no blocklist configured")
+		}
+		list, err := loadBlocklists(a.blocklists)
+		if err != nil {
+			return err
+		}
+		a.srv.SetBlocklist(list)
+		log.Printf("Reloaded blocklist, blocking %d domains", list.Len())
+	case cluster.ReloadZones:
+		if !a.zones.configured() {
+			return errors.New("no local zones configured")
+		}
+		zones, err := a.zones.load()
+		if err != nil {
+			return err
+		}
+		a.srv.SetZones(zones)
+		log.Println("Reloaded local zones")
+	case cluster.PanicMode:
+		if err := a.srv.SetPanicMode(e.Name); err != nil {
+			return err
+		}
+		log.Printf("Panic mode %s", e.Name)
+	default:
+		return fmt.Errorf("unknown action %q", e.Kind)
+	}
+	return nil
+}
+
+// handler returns the API handler of an action, applied here then sent to
+// the other nodes. The name of the action is read from the name parameter.
+func (a *admin) handler(kind string) func(r *http.Request) (any, error) {
+	return func(r *http.Request) (any, error) {
+		if r.Method != http.MethodPost {
+			return nil, &api.StatusError{Status: http.StatusMethodNotAllowed, Err: errors.New("use POST")}
+		}
+		if err := a.authorize(r); err != nil {
+			return nil, err
+		}
+		name := r.URL.Query().Get("name")
+		if err := a.apply(cluster.Event{Kind: kind, Name: name}); err != nil {
+			return nil, err
+		}
+		if a.cluster != nil {
+			if err := a.cluster.Publish(kind, name); err != nil {
+				return nil, &api.StatusError{Status: http.StatusInternalServerError, Err: fmt.Errorf("applied here, not sent to the cluster: %w", err)}
+			}
+		}
+		return map[string]string{"done": kind}, nil
+	}
+}
+
+// authorize checks r may take an action: it carries the token, or comes
+// from the host itself when there is none.
+func (a *admin) authorize(r *http.Request) error {
+	if a.token != nil {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+			return &api.StatusError{Status: http.StatusUnauthorized, Err: errors.New("missing or wrong bearer token, see -api-token-file")}
+		}
+		return nil
+	}
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !addr.Addr().Unmap().IsLoopback() {
+		return &api.StatusError{Status: http.StatusForbidden, Err: errors.New("actions are only taken from loopback without -api-token-file")}
+	}
+	return nil
+}
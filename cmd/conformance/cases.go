@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+func cases() []conformanceCase {
+	return []conformanceCase{
+		{"header/answer echoes ID, opcode and RD", "RFC 1035 4.1.1", headerEcho},
+		{"header/responses sent as queries are ignored", "RFC 1035 4.1.1", ignoreResponses},
+		{"header/unknown opcode is not implemented", "RFC 1035 4.1.1", unknownOpcode},
+		{"format/name compression loop is a format error", "RFC 1035 4.1.4", compressionLoop},
+		{"format/truncated question is a format error", "RFC 1035 4.1.2", truncatedQuestion},
+		{"compression/compressed CNAME chain forwarded intact", "RFC 1035 4.1.4", compressedForward},
+		{"compression/compressed CNAME chain served from cache", "RFC 1035 4.1.4", compressedCache},
+		{"compression/local answers compress owner names", "RFC 1035 4.1.4", compressedLocal},
+		{"truncation/plain DNS answer over 512 bytes sets TC", "RFC 1035 4.2.1", truncatePlain},
+		{"truncation/EDNS payload size is honoured", "RFC 6891 6.2.5", ednsPayload},
+		{"truncation/EDNS payload size under 512 counts as 512", "RFC 6891 6.2.5", ednsSmallPayload},
+		{"truncation/EDNS payload size over 1232 is honoured", "RFC 6891 6.2.5", ednsLargePayload},
+		{"unknown types/opaque rdata forwarded unchanged", "RFC 3597 4", opaqueForward},
+		{"unknown types/opaque rdata served unchanged from cache", "RFC 3597 4", opaqueCache},
+		{"edns/answer to EDNS query carries one OPT record", "RFC 6891 7", ednsAnswer},
+		{"edns/answer to plain query carries no OPT record", "RFC 6891 7", plainAnswer},
+		{"edns/unknown options are ignored", "RFC 6891 6.1.2", unknownOption},
+		{"case/question case preserved from upstream", "RFC 4343 4.1", caseUpstream},
+		{"case/question case preserved from cache", "RFC 4343 4.1", caseCache},
+		{"case/question case preserved by local data", "RFC 4343 4.1", caseLocal},
+	}
+}
+
+func headerEcho(h *harness) error {
+	for _, flags := range []uint16{0, parser.FlagRD} {
+		_, answer, err := h.ask(query{name: "www.example.com", qtype: parser.TypeA, flags: flags})
+		if err != nil {
+			return err
+		}
+		if got := answer.Header.Flags & (parser.FlagRD | parser.OpcodeMask); got != flags {
+			return fmt.Errorf("query flags %#04x, answer echoes %#04x", flags, got)
+		}
+	}
+	return nil
+}
+
+func ignoreResponses(h *harness) error {
+	msg := h.build(query{name: "www.example.com", qtype: parser.TypeA, flags: parser.FlagQR})
+	raw, err := h.exchange(msg)
+	if errors.Is(err, errNoAnswer) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("answered with %d bytes", len(raw))
+}
+
+func unknownOpcode(h *harness) error {
+	// Opcode 2 is the obsolete STATUS
+	flags := uint16(2) << 11
+	_, answer, err := h.ask(query{name: "www.example.com", qtype: parser.TypeA, flags: flags})
+	if err != nil {
+		return err
+	}
+	if rcode(answer) != parser.RcodeNotImp {
+		return fmt.Errorf("rcode %s, want NOTIMP", parser.RcodeString(rcode(answer)))
+	}
+	if answer.Header.Flags&parser.OpcodeMask != flags {
+		return errors.New("opcode is not echoed")
+	}
+	return nil
+}
+
+// expectFormErr checks msg is answered with FORMERR and the query ID.
+func expectFormErr(h *harness, msg []byte) error {
+	raw, err := h.exchange(msg)
+	if err != nil {
+		return err
+	}
+	if len(raw) < 12 || !bytes.Equal(raw[0:2], msg[0:2]) {
+		return errors.New("answer does not have the query ID")
+	}
+	if got := binary.BigEndian.Uint16(raw[2:4]) & parser.RcodeMask; got != parser.RcodeFormErr {
+		return fmt.Errorf("rcode %s, want FORMERR", parser.RcodeString(got))
+	}
+	return nil
+}
+
+func compressionLoop(h *harness) error {
+	msg := h.build(query{name: "www.example.com", qtype: parser.TypeA})
+	// The question name is a pointer to itself
+	msg = append(msg[:12], 0xC0, 12, 0, 1, 0, 1)
+	return expectFormErr(h, msg)
+}
+
+func truncatedQuestion(h *harness) error {
+	msg := h.build(query{name: "www.example.com", qtype: parser.TypeA})
+	return expectFormErr(h, msg[:len(msg)-3])
+}
+
+// checkAlias checks the answer to alias.example.com A: a CNAME to
+// www.example.com and its address.
+func checkAlias(answer parser.Payload) error {
+	if len(answer.Answers) != 2 {
+		return fmt.Errorf("%d answers, want CNAME and A", len(answer.Answers))
+	}
+	cname, a := answer.Answers[0], answer.Answers[1]
+	if cname.RType != parser.TypeCNAME || string(cname.RData) != "www.example.com" {
+		return fmt.Errorf("first answer %s %s, want CNAME www.example.com", parser.TypeString(cname.RType), cname.RData)
+	}
+	if a.RName != "www.example.com" || a.RType != parser.TypeA || !bytes.Equal(a.RData, []byte{192, 0, 2, 1}) {
+		return fmt.Errorf("second answer %s %s, want www.example.com A 192.0.2.1", a.RName, parser.TypeString(a.RType))
+	}
+	return nil
+}
+
+func compressedForward(h *harness) error {
+	raw, answer, err := h.ask(query{name: "alias.example.com", qtype: parser.TypeA, flags: parser.FlagRD})
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(raw, []byte{0xC0, 12}) {
+		return errors.New("answer is not compressed")
+	}
+	return checkAlias(answer)
+}
+
+func compressedCache(h *harness) error {
+	for i := 0; i < 2; i++ {
+		_, answer, err := h.ask(query{name: "alias.example.com", qtype: parser.TypeA, flags: parser.FlagRD})
+		if err != nil {
+			return err
+		}
+		if err := checkAlias(answer); err != nil {
+			return fmt.Errorf("query %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func compressedLocal(h *harness) error {
+	q := query{name: "local.example.net", qtype: parser.TypeA, flags: parser.FlagRD}
+	raw, answer, err := h.ask(q)
+	if err != nil {
+		return err
+	}
+	if len(answer.Answers) != 2 {
+		return fmt.Errorf("%d answers, want 2", len(answer.Answers))
+	}
+	// Header, question then each answer: a pointer to the question name
+	// followed by type, class, ttl, length and 4 bytes of address
+	want := 12 + len(parser.PackName(q.name)) + 4 + 2*(2+10+4)
+	if len(raw) != want {
+		return fmt.Errorf("answer is %d bytes, %d when compressed", len(raw), want)
+	}
+	return nil
+}
+
+func truncatePlain(h *harness) error {
+	// Cached from an EDNS query first, so that the resolver has to
+	// truncate the answer itself
+	if _, _, err := h.ask(query{name: "big.example.com", qtype: parser.TypeA, flags: parser.FlagRD, edns: 4096}); err != nil {
+		return err
+	}
+	raw, answer, err := h.ask(query{name: "big.example.com", qtype: parser.TypeA, flags: parser.FlagRD})
+	if err != nil {
+		return err
+	}
+	if len(raw) > 512 {
+		return fmt.Errorf("answer is %d bytes", len(raw))
+	}
+	if answer.Header.Flags&parser.FlagTC == 0 {
+		return errors.New("TC is not set")
+	}
+	if len(answer.Questions) != 1 {
+		return errors.New("question is not echoed")
+	}
+	return nil
+}
+
+func ednsPayload(h *harness) error {
+	raw, answer, err := h.ask(query{name: "big.example.com", qtype: parser.TypeA, flags: parser.FlagRD, edns: 1232})
+	if err != nil {
+		return err
+	}
+	if answer.Header.Flags&parser.FlagTC != 0 || len(answer.Answers) != bigRecords {
+		return fmt.Errorf("%d bytes answer truncated to %d records", len(raw), len(answer.Answers))
+	}
+	return nil
+}
+
+// ednsLargePayload checks answers the client can take are not truncated,
+// the resolver does not listen on TCP for the client to retry.
+func ednsLargePayload(h *harness) error {
+	raw, answer, err := h.ask(query{name: "huge.example.com", qtype: parser.TypeA, flags: parser.FlagRD, edns: 4096})
+	if err != nil {
+		return err
+	}
+	if answer.Header.Flags&parser.FlagTC != 0 || len(answer.Answers) != hugeRecords {
+		return fmt.Errorf("%d bytes answer truncated to %d records", len(raw), len(answer.Answers))
+	}
+	return nil
+}
+
+func ednsSmallPayload(h *harness) error {
+	raw, answer, err := h.ask(query{name: "big.example.com", qtype: parser.TypeA, flags: parser.FlagRD, edns: 100})
+	if err != nil {
+		return err
+	}
+	if len(raw) > 512 || answer.Header.Flags&parser.FlagTC == 0 {
+		return fmt.Errorf("answer is %d bytes, TC %v", len(raw), answer.Header.Flags&parser.FlagTC != 0)
+	}
+	if _, ok := answer.OPT(); !ok {
+		return errors.New("truncated answer lost its OPT record")
+	}
+	return nil
+}
+
+// checkOpaque checks the answer to opaque.example.com carries its rdata
+// byte for byte.
+func checkOpaque(answer parser.Payload) error {
+	if len(answer.Answers) != 1 {
+		return fmt.Errorf("%d answers, want 1", len(answer.Answers))
+	}
+	rr := answer.Answers[0]
+	if rr.RType != opaqueType || !bytes.Equal(rr.RData, opaqueData) {
+		return fmt.Errorf("answer %s %x, want %s %x", parser.TypeString(rr.RType), rr.RData, parser.TypeString(opaqueType), opaqueData)
+	}
+	return nil
+}
+
+func opaqueForward(h *harness) error {
+	_, answer, err := h.ask(query{name: "opaque.example.com", qtype: opaqueType, flags: parser.FlagRD})
+	if err != nil {
+		return err
+	}
+	return checkOpaque(answer)
+}
+
+func opaqueCache(h *harness) error {
+	for i := 0; i < 2; i++ {
+		_, answer, err := h.ask(query{name: "opaque.example.com", qtype: opaqueType, flags: parser.FlagRD, edns: 1232})
+		if err != nil {
+			return err
+		}
+		if err := checkOpaque(answer); err != nil {
+			return fmt.Errorf("query %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// countOPT returns the number of OPT records of p.
+func countOPT(p parser.Payload) int {
+	n := 0
+	for _, rr := range p.Additionals {
+		if rr.RType == parser.TypeOPT {
+			n++
+		}
+	}
+	return n
+}
+
+func ednsAnswer(h *harness) error {
+	// Forwarded, from cache and from local data
+	for _, name := range []string{"www.example.com", "www.example.com", "local.example.net"} {
+		_, answer, err := h.ask(query{name: name, qtype: parser.TypeA, flags: parser.FlagRD, edns: 1232})
+		if err != nil {
+			return err
+		}
+		if n := countOPT(answer); n != 1 {
+			return fmt.Errorf("answer for %s has %d OPT records", name, n)
+		}
+	}
+	return nil
+}
+
+func plainAnswer(h *harness) error {
+	// Cached from an EDNS query first
+	if _, _, err := h.ask(query{name: "www.example.com", qtype: parser.TypeA, flags: parser.FlagRD, edns: 1232}); err != nil {
+		return err
+	}
+	for _, name := range []string{"www.example.com", "local.example.net"} {
+		_, answer, err := h.ask(query{name: name, qtype: parser.TypeA, flags: parser.FlagRD})
+		if err != nil {
+			return err
+		}
+		if n := countOPT(answer); n != 0 {
+			return fmt.Errorf("answer for %s has %d OPT records", name, n)
+		}
+	}
+	return nil
+}
+
+func unknownOption(h *harness) error {
+	option := parser.Option{Code: 65001, Data: []byte("conformance")}
+	_, answer, err := h.ask(query{name: "www.example.com", qtype: parser.TypeA, flags: parser.FlagRD, edns: 1232, options: []parser.Option{option}})
+	if err != nil {
+		return err
+	}
+	if rcode(answer) != parser.RcodeNoError || len(answer.Answers) != 1 {
+		return fmt.Errorf("rcode %s with %d answers", parser.RcodeString(rcode(answer)), len(answer.Answers))
+	}
+	return nil
+}
+
+// checkCase checks the question of answer is name, with the same case.
+func checkCase(answer parser.Payload, name string) error {
+	if len(answer.Questions) != 1 || answer.Questions[0].QName != name {
+		return fmt.Errorf("question %v, want %s", answer.Questions, name)
+	}
+	return nil
+}
+
+func caseUpstream(h *harness) error {
+	name := "wWw.ExAmPlE.cOm"
+	_, answer, err := h.ask(query{name: name, qtype: parser.TypeAAAA, flags: parser.FlagRD})
+	if err != nil {
+		return err
+	}
+	return checkCase(answer, name)
+}
+
+func caseCache(h *harness) error {
+	for _, name := range []string{"ALIAS.example.com", "alias.EXAMPLE.com"} {
+		_, answer, err := h.ask(query{name: name, qtype: parser.TypeA, flags: parser.FlagRD})
+		if err != nil {
+			return err
+		}
+		if err := checkCase(answer, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func caseLocal(h *harness) error {
+	name := "LoCaL.example.NET"
+	_, answer, err := h.ask(query{name: name, qtype: parser.TypeA, flags: parser.FlagRD})
+	if err != nil {
+		return err
+	}
+	if len(answer.Answers) == 0 || answer.Answers[0].RName != name {
+		return fmt.Errorf("answers %v, want owner %s", answer.Answers, name)
+	}
+	return checkCase(answer, name)
+}
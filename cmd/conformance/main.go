@@ -0,0 +1,205 @@
+// Command conformance runs the resolver against a table of DNS protocol
+// conformance cases and reports which pass:
+//
+//	go run ./cmd/conformance
+//
+// The server runs in process on a loopback port, in front of a scripted
+// upstream and with a small hosts file, and is queried over UDP the way
+// clients do. It exits with a non zero status when a case fails.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/cache"
+	"github.com/gertanoh/dns-resolver/internal/parser"
+	"github.com/gertanoh/dns-resolver/internal/server"
+	"github.com/gertanoh/dns-resolver/internal/zone"
+)
+
+// conformanceCase checks one protocol requirement, rfc points to where it
+// is stated.
+type conformanceCase struct {
+	name string
+	rfc  string
+	run  func(h *harness) error
+}
+
+var (
+	only    = flag.String("run", "", "only run cases whose name starts with this prefix")
+	verbose = flag.Bool("v", false, "show the resolver logs")
+)
+
+// hostsFile is served by the resolver under test
+const hostsFile = `192.0.2.10 Local.Example.net
+2001:db8::10 local.example.net
+192.0.2.11 local.example.net
+`
+
+func main() {
+	flag.Parse()
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	h, err := startHarness()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to start the resolver:", err)
+		os.Exit(1)
+	}
+
+	passed, failed := 0, 0
+	for _, c := range cases() {
+		if !strings.HasPrefix(c.name, *only) {
+			continue
+		}
+		if err := c.run(h); err != nil {
+			fmt.Printf("FAIL %-60s %s: %v\n", c.name, c.rfc, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %-60s %s\n", c.name, c.rfc)
+		passed++
+	}
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// harness is the resolver under test.
+type harness struct {
+	addr   *net.UDPAddr
+	nextID uint16
+}
+
+func startHarness() (*harness, error) {
+	f, err := os.CreateTemp("", "conformance-hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(hostsFile); err != nil {
+		return nil, err
+	}
+	f.Close()
+	hosts, err := zone.LoadHosts(f.Name(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := server.New(server.Config{
+		Upstream:   scriptedUpstream{},
+		DupWindow:  time.Second,
+		MinimalAny: true,
+		Zones:      zone.New(hosts, nil, 300),
+		Cache:      cache.New(1000, 4),
+	})
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	go srv.Serve(conn)
+	return &harness{addr: conn.LocalAddr().(*net.UDPAddr), nextID: 0x1000}, nil
+}
+
+// query is a query sent to the resolver under test.
+type query struct {
+	name  string
+	qtype uint16
+	flags uint16
+	// edns adds an OPT record advertising this payload size, options
+	// holds its options
+	edns    uint16
+	options []parser.Option
+}
+
+// build encodes q with the next query ID.
+func (h *harness) build(q query) []byte {
+	h.nextID++
+	msg := binary.BigEndian.AppendUint16(nil, h.nextID)
+	msg = binary.BigEndian.AppendUint16(msg, q.flags)
+	arcount := uint16(0)
+	if q.edns != 0 {
+		arcount = 1
+	}
+	msg = append(msg, 0, 1, 0, 0, 0, 0, byte(arcount>>8), byte(arcount))
+	msg = append(msg, parser.PackName(q.name)...)
+	msg = binary.BigEndian.AppendUint16(msg, q.qtype)
+	msg = binary.BigEndian.AppendUint16(msg, parser.ClassIN)
+	if q.edns != 0 {
+		var rdata []byte
+		for _, o := range q.options {
+			rdata = binary.BigEndian.AppendUint16(rdata, o.Code)
+			rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(o.Data)))
+			rdata = append(rdata, o.Data...)
+		}
+		msg = append(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, parser.TypeOPT)
+		msg = binary.BigEndian.AppendUint16(msg, q.edns)
+		msg = binary.BigEndian.AppendUint32(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	return msg
+}
+
+// errNoAnswer is returned by exchange when the resolver stays silent
+var errNoAnswer = errors.New("no answer")
+
+// exchange sends msg from a new socket and returns the answer.
+func (h *harness) exchange(msg []byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, h.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, errNoAnswer
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// ask sends q and returns the raw answer along with its decoding, after
+// checking it answers q.
+func (h *harness) ask(q query) ([]byte, parser.Payload, error) {
+	msg := h.build(q)
+	raw, err := h.exchange(msg)
+	if err != nil {
+		return nil, parser.Payload{}, err
+	}
+	answer, err := parser.Parse(raw)
+	if err != nil {
+		return raw, answer, fmt.Errorf("answer does not parse: %w", err)
+	}
+	if answer.Header.ID != binary.BigEndian.Uint16(msg[0:2]) {
+		return raw, answer, fmt.Errorf("answer ID %#x, query ID %#x", answer.Header.ID, binary.BigEndian.Uint16(msg[0:2]))
+	}
+	if answer.Header.Flags&parser.FlagQR == 0 {
+		return raw, answer, errors.New("answer does not have QR set")
+	}
+	return raw, answer, nil
+}
+
+func rcode(p parser.Payload) uint16 {
+	return p.Header.Flags & parser.RcodeMask
+}
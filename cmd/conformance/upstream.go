@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// opaqueType is a type from the private use range, unknown to any resolver
+const opaqueType uint16 = 65280
+
+// opaqueData is the rdata of opaqueType records. It starts like a
+// compression pointer, a resolver decoding it as a name would mangle it.
+var opaqueData = []byte{0xC0, 0x0C, 0x00, 0xFF, 0x01, 0x02}
+
+// bigRecords is the number of A records of big.example.com, too many for a
+// 512 bytes message, and hugeRecords those of huge.example.com, too many
+// for 1232 bytes
+const (
+	bigRecords  = 40
+	hugeRecords = 120
+)
+
+// scriptedUpstream answers queries for the example.com names used by the
+// conformance cases, the way an authoritative server would: question
+// echoed as sent, compressed names, OPT record for EDNS queries.
+type scriptedUpstream struct{}
+
+func (scriptedUpstream) String() string {
+	return "scripted"
+}
+
+func (scriptedUpstream) Exchange(ctx context.Context, query []byte, buf []byte) ([]byte, error) {
+	q, err := parser.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	answer := parser.Payload{
+		Header:    parser.Header{ID: q.Header.ID, Flags: parser.FlagQR | parser.FlagRA | q.Header.Flags&parser.FlagRD},
+		Questions: q.Questions,
+	}
+	question := q.Questions[0]
+	name := question.QName
+	a := func(owner string, ip ...byte) parser.Resource {
+		return parser.Resource{RName: owner, RType: parser.TypeA, RClass: parser.ClassIN, RTtl: 300, RData: ip}
+	}
+
+	switch strings.ToLower(name) {
+	case "www.example.com":
+		if question.QType == parser.TypeA {
+			answer.Answers = append(answer.Answers, a(name, 192, 0, 2, 1))
+		}
+	case "alias.example.com":
+		answer.Answers = append(answer.Answers, parser.Resource{
+			RName: name, RType: parser.TypeCNAME, RClass: parser.ClassIN, RTtl: 300, RData: []byte("www.example.com"),
+		})
+		if question.QType == parser.TypeA {
+			answer.Answers = append(answer.Answers, a("www.example.com", 192, 0, 2, 1))
+		}
+	case "big.example.com":
+		for i := 0; i < bigRecords && question.QType == parser.TypeA; i++ {
+			answer.Answers = append(answer.Answers, a(name, 198, 51, 100, byte(i+1)))
+		}
+	case "huge.example.com":
+		for i := 0; i < hugeRecords && question.QType == parser.TypeA; i++ {
+			answer.Answers = append(answer.Answers, a(name, 198, 51, 100, byte(i+1)))
+		}
+	case "opaque.example.com":
+		if question.QType == opaqueType {
+			answer.Answers = append(answer.Answers, parser.Resource{
+				RName: name, RType: opaqueType, RClass: parser.ClassIN, RTtl: 300, RData: opaqueData,
+			})
+		}
+	default:
+		answer.Header.Flags |= parser.RcodeNXDomain
+		soa := append(parser.PackName("ns.example.com"), parser.PackName("hostmaster.example.com")...)
+		for _, v := range []uint32{1, 3600, 600, 86400, 300} {
+			soa = binary.BigEndian.AppendUint32(soa, v)
+		}
+		answer.Authorities = append(answer.Authorities, parser.Resource{
+			RName: "example.com", RType: parser.TypeSOA, RClass: parser.ClassIN, RTtl: 300, RData: soa,
+		})
+	}
+	if _, ok := q.OPT(); ok {
+		answer.Additionals = append(answer.Additionals, parser.Resource{RType: parser.TypeOPT, RClass: 4096})
+	}
+
+	msg, err := parser.Pack(answer)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf[:0], msg...), nil
+}
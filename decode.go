@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+	"github.com/gertanoh/dns-resolver/internal/pcap"
+)
+
+// opcodeNames are the mnemonics of the opcodes, see
+// https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-5
+var opcodeNames = map[uint16]string{0: "QUERY", 1: "IQUERY", 2: "STATUS", 4: "NOTIFY", 5: "UPDATE"}
+
+// decodeCommand implements the decode subcommand: it prints the DNS
+// messages of a file, or of stdin, in dig's layout and checks that each one
+// survives being encoded again. It returns the exit status, 1 when a
+// message could not be decoded or changed on the way back.
+func decodeCommand(args []string) int {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	format := fs.String("format", "auto", "input format: hex, base64, raw, pcap, or auto to guess it")
+	port := fs.Int("port", 53, "pcap input: only decode datagrams from or to this port, 0 for all")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s decode [flags] [file]\n\nDecodes a DNS message, or the DNS datagrams of a pcap capture, read from file or stdin.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var input []byte
+	var err error
+	switch fs.NArg() {
+	case 0:
+		input, err = io.ReadAll(os.Stdin)
+	case 1:
+		input, err = os.ReadFile(fs.Arg(0))
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *format == "auto" {
+		*format = guessFormat(input)
+	}
+	if *format == "pcap" {
+		return decodeCapture(input, uint16(*port))
+	}
+
+	msg, err := decodeInput(input, *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !decodeMessage(msg) {
+		return 1
+	}
+	return 0
+}
+
+// guessFormat tells apart the input formats: pcap captures by their magic
+// number, then text made only of hex digits, then base64 text.
+func guessFormat(input []byte) string {
+	if len(input) >= 4 {
+		switch string(input[:4]) {
+		case "\xd4\xc3\xb2\xa1", "\xa1\xb2\xc3\xd4", "\x4d\x3c\xb2\xa1", "\xa1\xb2\x3c\x4d", "\x0a\x0d\x0d\x0a":
+			return "pcap"
+		}
+	}
+	text := stripSpace(input)
+	if _, err := hex.DecodeString(strings.TrimPrefix(strings.ReplaceAll(text, ":", ""), "0x")); err == nil && text != "" {
+		return "hex"
+	}
+	if _, err := base64.StdEncoding.DecodeString(text); err == nil && text != "" {
+		return "base64"
+	}
+	return "raw"
+}
+
+// decodeInput returns the message encoded in input. Hex may be split by
+// spaces, newlines or colons, as in Wireshark's "Copy as Hex Stream" or
+// the output of xxd -p.
+func decodeInput(input []byte, format string) ([]byte, error) {
+	switch format {
+	case "raw":
+		return input, nil
+	case "hex":
+		text := strings.TrimPrefix(strings.ReplaceAll(stripSpace(input), ":", ""), "0x")
+		return hex.DecodeString(text)
+	case "base64":
+		// Also accept the unpadded URL alphabet of DNS over HTTPS GET requests
+		text := stripSpace(input)
+		if msg, err := base64.StdEncoding.DecodeString(text); err == nil {
+			return msg, nil
+		}
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(text, "="))
+	}
+	return nil, fmt.Errorf("unknown format %q, expected hex, base64, raw or pcap", format)
+}
+
+func stripSpace(input []byte) string {
+	return string(bytes.Join(bytes.Fields(input), nil))
+}
+
+// decodeCapture decodes the DNS datagrams of a capture. It returns the exit
+// status of the decode subcommand.
+func decodeCapture(input []byte, port uint16) int {
+	datagrams, err := pcap.ReadUDP(bytes.NewReader(input))
+	if err != nil && len(datagrams) == 0 {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	status := 0
+	decoded := 0
+	for _, d := range datagrams {
+		if port != 0 && d.Src.Port() != port && d.Dst.Port() != port {
+			continue
+		}
+		decoded++
+		fmt.Printf(";; Packet %d at %s, %s > %s, %d bytes\n", d.Index, d.Time.UTC().Format("2006-01-02 15:04:05.000000"), d.Src, d.Dst, len(d.Payload))
+		if !decodeMessage(d.Payload) {
+			status = 1
+		}
+		fmt.Println()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Capture cut short: %v\n", err)
+		status = 1
+	}
+	if decoded == 0 {
+		fmt.Fprintf(os.Stderr, "No UDP datagrams on port %d in the capture\n", port)
+		return 1
+	}
+	return status
+}
+
+// decodeMessage prints msg and checks it encodes back to the same message.
+// It reports whether both went fine.
+func decodeMessage(msg []byte) bool {
+	payload, err := parser.Parse(msg)
+	if err != nil {
+		fmt.Printf(";; Invalid message of %d bytes: %v\n", len(msg), err)
+		fmt.Print(hex.Dump(msg))
+		return false
+	}
+	printMessage(payload)
+
+	packed, err := parser.Pack(payload)
+	if err != nil {
+		fmt.Printf("\n;; ROUND TRIP FAILED: cannot encode the message again: %v\n", err)
+		return false
+	}
+	again, err := parser.Parse(packed)
+	switch {
+	case err != nil:
+		fmt.Printf("\n;; ROUND TRIP FAILED: the encoded message does not decode: %v\n", err)
+		return false
+	case !reflect.DeepEqual(payload, again):
+		fmt.Printf("\n;; ROUND TRIP FAILED: the encoded message decodes differently:\n")
+		printMessage(again)
+		return false
+	case bytes.Equal(packed, msg):
+		fmt.Printf("\n;; Round trip: identical, %d bytes\n", len(msg))
+	default:
+		// Name compression is up to the encoder, the same message may have
+		// several encodings
+		fmt.Printf("\n;; Round trip: same message, encoded in %d bytes instead of %d\n", len(packed), len(msg))
+	}
+	return true
+}
+
+// printMessage prints a message the way dig does.
+func printMessage(p parser.Payload) {
+	flags := p.Header.Flags
+	opcode := (flags & parser.OpcodeMask) >> 11
+	opcodeName, ok := opcodeNames[opcode]
+	if !ok {
+		opcodeName = fmt.Sprintf("OPCODE%d", opcode)
+	}
+	fmt.Printf(";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", opcodeName, parser.RcodeString(flags&parser.RcodeMask), p.Header.ID)
+
+	var names []string
+	for _, f := range []struct {
+		bit  uint16
+		name string
+	}{{parser.FlagQR, "qr"}, {parser.FlagAA, "aa"}, {parser.FlagTC, "tc"}, {parser.FlagRD, "rd"}, {parser.FlagRA, "ra"}, {1 << 6, "z"}, {1 << 5, "ad"}, {1 << 4, "cd"}} {
+		if flags&f.bit != 0 {
+			names = append(names, f.name)
+		}
+	}
+	fmt.Printf(";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(names, " "), p.Header.QdCount, p.Header.AnCount, p.Header.NsCount, p.Header.ArCount)
+
+	if opt, ok := p.OPT(); ok {
+		fmt.Printf("\n;; OPT PSEUDOSECTION:\n; EDNS: version: %d, flags:%s; udp: %d\n", uint8(opt.RTtl>>16), ednsFlags(opt.RTtl), opt.RClass)
+		for _, o := range parser.Options(opt) {
+			fmt.Printf("; OPTION %d: %s\n", o.Code, optionString(p, o))
+		}
+	}
+
+	if len(p.Questions) > 0 {
+		fmt.Print("\n;; QUESTION SECTION:\n")
+		for _, q := range p.Questions {
+			fmt.Printf(";%s\n", q)
+		}
+	}
+	printSection("ANSWER", p.Answers)
+	printSection("AUTHORITY", p.Authorities)
+	printSection("ADDITIONAL", p.Additionals)
+}
+
+func printSection(name string, records []parser.Resource) {
+	printed := false
+	for _, rr := range records {
+		if rr.RType == parser.TypeOPT {
+			continue
+		}
+		if !printed {
+			fmt.Printf("\n;; %s SECTION:\n", name)
+			printed = true
+		}
+		fmt.Println(rr)
+	}
+}
+
+// ednsFlags returns the flags of the TTL field of an OPT record, see
+// https://datatracker.ietf.org/doc/html/rfc6891#section-6.1.4
+func ednsFlags(ttl uint32) string {
+	flags := ""
+	if ttl&(1<<15) != 0 {
+		flags += " do"
+	}
+	if rest := ttl & 0x7FFF; rest != 0 {
+		flags += fmt.Sprintf(" MBZ: 0x%04x", rest)
+	}
+	return flags
+}
+
+// optionString decodes the options of p the resolver knows of and dumps
+// the others in hex.
+func optionString(p parser.Payload, o parser.Option) string {
+	switch o.Code {
+	case parser.OptionClientSubnet:
+		if subnet, ok := parser.ClientSubnet(p); ok {
+			return "CLIENT-SUBNET " + subnet.String()
+		}
+	case parser.OptionExtendedError:
+		if len(o.Data) >= 2 {
+			return fmt.Sprintf("EDE %d %q", uint16(o.Data[0])<<8|uint16(o.Data[1]), o.Data[2:])
+		}
+	}
+	if len(o.Data) == 0 {
+		return "(empty)"
+	}
+	return hex.EncodeToString(o.Data)
+}
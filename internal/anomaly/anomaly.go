@@ -0,0 +1,245 @@
+// Package anomaly watches the queries of each client for signs of
+// infected devices: bursts of NXDOMAIN answers, and names with random
+// looking labels such as those made up by domain generation algorithms
+// (DGA) of malware looking for its command and control server.
+package anomaly
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/ring"
+)
+
+// Kinds of events
+const (
+	NXDomainBurst = "nxdomain-burst"
+	DGA           = "dga"
+)
+
+// maxVowelRatio is the largest share of vowels in random looking labels.
+// Random letters and digits have about 14%, words of most languages 35%
+// and more, even those long and varied enough to pass the entropy check.
+const maxVowelRatio = 0.25
+
+// maxSamples is the number of names kept to illustrate an event
+const maxSamples = 5
+
+// Config holds the thresholds, crossed by a client within Window.
+type Config struct {
+	Window time.Duration
+	// NXDomain is the number of NXDOMAIN answers, 0 disables.
+	NXDomain int
+	// DGA is the number of queries for random looking names within
+	// Window, 0 disables. A name looks random when one of its labels has
+	// MinLength characters or more, a Shannon entropy of Entropy bits per
+	// character or more and few vowels. 12 random letters and digits make
+	// for about 3.3 bits.
+	DGA       int
+	MinLength int
+	Entropy   float64
+}
+
+// Event is a threshold crossed by a client.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	ClientName string    `json:"client_name,omitempty"`
+	Kind       string    `json:"kind"`
+	Count      int       `json:"count"`
+	Threshold  int       `json:"threshold"`
+	Window     string    `json:"window"`
+	Samples    []string  `json:"samples"` // some of the names counted
+}
+
+// Detector counts the queries of each client over fixed windows. A client
+// raises at most one event of each kind per window.
+type Detector struct {
+	cfg Config
+	// OnEvent, when set, is called with each event, after it is logged.
+	OnEvent func(Event)
+	// ClientName, when set, names the client of events, e.g. from its
+	// device.
+	ClientName func(netip.Addr) string
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*client
+	events  *ring.Ring[Event]
+
+	done chan struct{} // closed by Close
+}
+
+type client struct {
+	start    time.Time // of the current window
+	nxdomain counter
+	dga      counter
+}
+
+type counter struct {
+	count   int
+	raised  bool
+	samples []string
+}
+
+// add counts name, keeping it as a sample while there are few.
+func (c *counter) add(name []byte) {
+	c.count++
+	if len(c.samples) < maxSamples {
+		c.samples = append(c.samples, string(name))
+	}
+}
+
+// New returns a detector keeping the last size events. It forgets the
+// clients whose window is over until Close.
+func New(cfg Config, size int) (*Detector, error) {
+	if cfg.Window <= 0 {
+		return nil, errors.New("anomaly window must be positive")
+	}
+	d := &Detector{cfg: cfg, clients: map[netip.Addr]*client{}, events: ring.New[Event](size), done: make(chan struct{})}
+	go d.sweep()
+	return d, nil
+}
+
+// Close stops d from forgetting clients, once it observes no more queries.
+func (d *Detector) Close() {
+	close(d.done)
+}
+
+// Observe counts a query for name, lowercase without trailing dot, and
+// whether it was answered NXDOMAIN. Queries counting for nothing do not
+// allocate.
+func (d *Detector) Observe(addr netip.Addr, name []byte, nxdomain bool) {
+	random := d.cfg.DGA > 0 && d.randomLooking(name)
+	if !random && !(nxdomain && d.cfg.NXDomain > 0) {
+		return
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.clients[addr]
+	if c == nil || now.Sub(c.start) >= d.cfg.Window {
+		c = &client{start: now}
+		d.clients[addr] = c
+	}
+	if nxdomain && d.cfg.NXDomain > 0 {
+		c.nxdomain.add(name)
+		d.check(addr, NXDomainBurst, &c.nxdomain, d.cfg.NXDomain, now)
+	}
+	if random {
+		c.dga.add(name)
+		d.check(addr, DGA, &c.dga, d.cfg.DGA, now)
+	}
+}
+
+// check raises an event when c reaches threshold, once per window.
+func (d *Detector) check(addr netip.Addr, kind string, c *counter, threshold int, now time.Time) {
+	if c.raised || c.count < threshold {
+		return
+	}
+	c.raised = true
+	e := Event{
+		Time:      now,
+		Client:    addr.String(),
+		Kind:      kind,
+		Count:     c.count,
+		Threshold: threshold,
+		Window:    d.cfg.Window.String(),
+		Samples:   append([]string(nil), c.samples...),
+	}
+	client := e.Client
+	if d.ClientName != nil {
+		if e.ClientName = d.ClientName(addr); e.ClientName != "" {
+			client += " (" + e.ClientName + ")"
+		}
+	}
+	log.Printf("Anomaly: %s from %s, %d queries within %v, e.g. %v", kind, client, e.Count, d.cfg.Window, e.Samples)
+
+	d.events.Add(e)
+	if d.OnEvent != nil {
+		d.OnEvent(e)
+	}
+}
+
+// Recent returns the recent events, most recent first.
+func (d *Detector) Recent() []Event {
+	return d.events.Recent(0)
+}
+
+// sweep forgets the clients whose window is over, until d is closed.
+func (d *Detector) sweep() {
+	ticker := time.NewTicker(d.cfg.Window)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-d.done:
+			return
+		case now = <-ticker.C:
+		}
+		d.mu.Lock()
+		for addr, c := range d.clients {
+			if now.Sub(c.start) >= d.cfg.Window {
+				delete(d.clients, addr)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// randomLooking reports whether a label of name, the top-level domain
+// aside, is long and random enough to have been generated. Punycode labels
+// of internationalized names look random once encoded and are skipped.
+func (d *Detector) randomLooking(name []byte) bool {
+	if i := bytes.LastIndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	for len(name) > 0 {
+		label := name
+		if i := bytes.IndexByte(name, '.'); i >= 0 {
+			label, name = name[:i], name[i+1:]
+		} else {
+			name = nil
+		}
+		if bytes.HasPrefix(label, []byte("xn--")) {
+			continue
+		}
+		if len(label) >= d.cfg.MinLength && Entropy(label) >= d.cfg.Entropy && vowelRatio(label) <= maxVowelRatio {
+			return true
+		}
+	}
+	return false
+}
+
+// Entropy returns the Shannon entropy of s, in bits per character.
+func Entropy(s []byte) float64 {
+	var counts [256]int
+	for _, c := range s {
+		counts[c]++
+	}
+	entropy := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(s))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+func vowelRatio(label []byte) float64 {
+	vowels := 0
+	for _, c := range label {
+		switch c {
+		case 'a', 'e', 'i', 'o', 'u', 'y':
+			vowels++
+		}
+	}
+	return float64(vowels) / float64(len(label))
+}
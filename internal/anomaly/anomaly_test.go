@@ -0,0 +1,124 @@
+package anomaly
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newDetector(t *testing.T, cfg Config) *Detector {
+	d, err := New(cfg, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	return d
+}
+
+func TestNewWindow(t *testing.T) {
+	for _, window := range []time.Duration{0, -time.Second} {
+		if _, err := New(Config{Window: window, NXDomain: 10}, 10); err == nil {
+			t.Errorf("window %v accepted", window)
+		}
+	}
+}
+
+func TestRandomLooking(t *testing.T) {
+	d := newDetector(t, Config{Window: time.Minute, MinLength: 10, Entropy: 3.2})
+	tests := []struct {
+		name   string
+		random bool
+	}{
+		{"www.example.com", false},
+		{"qxkzvbtrwplmnh.com", true},
+		{"cdn.qxkzvbtrwplmnh.net", true},
+		// münchen-straßenbahn.de and 例え.テスト, encoded
+		{"xn--mnchen-straenbahn-3ob9s.de", false},
+		{"xn--r8jz45g.xn--zckzah", false},
+		{"xn--r8jz45g.qxkzvbtrwplmnh.com", true},
+	}
+	for _, tt := range tests {
+		if got := d.randomLooking([]byte(tt.name)); got != tt.random {
+			t.Errorf("%s: random looking %v, want %v", tt.name, got, tt.random)
+		}
+	}
+}
+
+func TestNXDomainBurst(t *testing.T) {
+	const window = 100 * time.Millisecond
+	d := newDetector(t, Config{Window: window, NXDomain: 3})
+	var events []Event
+	d.OnEvent = func(e Event) { events = append(events, e) }
+	client, other := netip.MustParseAddr("192.168.1.20"), netip.MustParseAddr("192.168.1.21")
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		d.Observe(client, []byte(fmt.Sprintf("missing%d.example.com", i)), true)
+		// Answered names do not count
+		d.Observe(client, []byte("www.example.com"), false)
+	}
+	d.Observe(other, []byte("missing.example.com"), true)
+	if time.Since(start) >= window {
+		t.Skip("too slow to observe the queries within a window")
+	}
+	if len(events) != 1 {
+		t.Fatalf("%d events, want 1 per window", len(events))
+	}
+	e := events[0]
+	if e.Kind != NXDomainBurst || e.Client != client.String() || e.Count != 3 || e.Threshold != 3 || e.Window != window.String() {
+		t.Errorf("event %+v", e)
+	}
+	if want := []string{"missing0.example.com", "missing1.example.com", "missing2.example.com"}; !slices.Equal(e.Samples, want) {
+		t.Errorf("samples %v, want %v", e.Samples, want)
+	}
+
+	// The next window raises again
+	time.Sleep(window)
+	for i := 0; i < 3; i++ {
+		d.Observe(client, []byte("missing.example.com"), true)
+	}
+	if len(events) != 2 {
+		t.Errorf("%d events after the next window, want 2", len(events))
+	}
+	if recent := d.Recent(); len(recent) != 2 || recent[0].Time.Before(recent[1].Time) {
+		t.Errorf("recent events %+v, want the 2 events, most recent first", recent)
+	}
+}
+
+func TestSamplesCapped(t *testing.T) {
+	d := newDetector(t, Config{Window: time.Minute, DGA: 8, MinLength: 10, Entropy: 3.2})
+	client := netip.MustParseAddr("192.168.1.20")
+	var names []string
+	for i := 0; i < 8; i++ {
+		names = append(names, fmt.Sprintf("qxkzvbtrwplmnh%d.com", i))
+		d.Observe(client, []byte(names[i]), false)
+	}
+	events := d.Recent()
+	if len(events) != 1 {
+		t.Fatalf("%d events, want 1", len(events))
+	}
+	if e := events[0]; e.Kind != DGA || e.Count != 8 || !slices.Equal(e.Samples, names[:maxSamples]) {
+		t.Errorf("event %s with %d queries and samples %v, want %d queries and samples %v", e.Kind, e.Count, e.Samples, 8, names[:maxSamples])
+	}
+}
+
+func TestSweep(t *testing.T) {
+	const window = 20 * time.Millisecond
+	d := newDetector(t, Config{Window: window, NXDomain: 100})
+	d.Observe(netip.MustParseAddr("192.168.1.20"), []byte("missing.example.com"), true)
+	deadline := time.Now().Add(time.Second)
+	for {
+		d.mu.Lock()
+		clients := len(d.clients)
+		d.mu.Unlock()
+		if clients == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients still counted long after their window", clients)
+		}
+		time.Sleep(window)
+	}
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Server exposes the resolver state as JSON over HTTP.
+type Server struct {
+	mux *http.ServeMux
+}
+
+func New() *Server {
+	return &Server{mux: http.NewServeMux()}
+}
+
+// StatusError is an error answered with a specific HTTP status.
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+// HandleJSON registers fn on path, its result is sent encoded as JSON.
+// Errors are answered with 400 Bad Request unless they are a StatusError.
+func (s *Server) HandleJSON(path string, fn func(r *http.Request) (any, error)) {
+	s.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		v, err := fn(r)
+		if err != nil {
+			status := http.StatusBadRequest
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) {
+				status = statusErr.Status
+			}
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+	})
+}
+
+// Handle registers a handler answering in another format than JSON.
+func (s *Server) Handle(path string, h http.Handler) {
+	s.mux.Handle(path, h)
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s.mux)
+}
+
+// Serve answers requests on l, such as a listener handed over on upgrade.
+func (s *Server) Serve(l net.Listener) error {
+	return http.Serve(l, s.mux)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
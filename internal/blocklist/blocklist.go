@@ -0,0 +1,174 @@
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"hash/maphash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// List is a set of blocked domains, blocking each domain and all its
+// subdomains. It is built for lists of millions of domains: entries are
+// kept as sorted 64 bit hashes behind a bloom filter, about 11 bytes per
+// domain, and a lookup hashes each suffix of the name, so it costs
+// O(labels) bloom checks and a binary search only for likely hits. With 64
+// bit hashes, a name wrongly matching a million entries list is about a
+// one in 10^13 event.
+type List struct {
+	seed    maphash.Seed
+	bloom   bloom
+	hashes  []uint64 // sorted
+	sources []uint16 // sources[i] is the index in names of the list hashes[i] comes from
+	names   []string
+}
+
+// Match is the rule that blocked a name.
+type Match struct {
+	Source string // name of the list holding the rule
+	Rule   string // blocked domain the name is equal to or a subdomain of
+}
+
+// Builder collects domains before freezing them into a List.
+type Builder struct {
+	seed    maphash.Seed
+	entries []entry
+	names   []string
+}
+
+type entry struct {
+	hash   uint64
+	source uint16
+}
+
+func NewBuilder() *Builder {
+	return &Builder{seed: maphash.MakeSeed()}
+}
+
+// Add blocks domain, and its subdomains, on behalf of the list named source.
+func (b *Builder) Add(source string, domain string) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return
+	}
+	index := -1
+	for i, name := range b.names {
+		if name == source {
+			index = i
+		}
+	}
+	if index < 0 {
+		b.names = append(b.names, source)
+		index = len(b.names) - 1
+	}
+	b.entries = append(b.entries, entry{hash: maphash.String(b.seed, domain), source: uint16(index)})
+}
+
+// AddFile reads a list in one of the common formats: one domain per line,
+// hosts file lines (0.0.0.0 ads.example.com) or adblock style ||domain^
+// rules. Comments start with # or !. The list is named after the file.
+func (b *Builder) AddFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.AddReader(filepath.Base(path), f)
+}
+
+// hostsEntries are the names hosts file based lists map to the local host,
+// not to be blocked.
+var hostsEntries = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// AddReader reads a list from r, see AddFile. Adblock exceptions (@@) and
+// rules with options ($), which do not block a domain as a whole, are
+// skipped, as are the local host entries of hosts files.
+func (b *Builder) AddReader(source string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 2:
+			// hosts file format, the address is ignored
+			for _, domain := range fields[1:] {
+				if !hostsEntries[strings.ToLower(domain)] {
+					b.Add(source, domain)
+				}
+			}
+		case len(fields) == 1:
+			rule := fields[0]
+			if strings.HasPrefix(rule, "@@") || strings.ContainsAny(rule, "$/") {
+				continue
+			}
+			domain := strings.TrimPrefix(rule, "||")
+			domain = strings.TrimSuffix(domain, "^")
+			if !hostsEntries[strings.ToLower(domain)] {
+				b.Add(source, domain)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Build returns the list. When a domain appears in several lists, the list
+// added first is credited.
+func (b *Builder) Build() *List {
+	sort.SliceStable(b.entries, func(i, j int) bool { return b.entries[i].hash < b.entries[j].hash })
+
+	l := &List{seed: b.seed, bloom: newBloom(len(b.entries)), names: b.names}
+	l.hashes = make([]uint64, 0, len(b.entries))
+	l.sources = make([]uint16, 0, len(b.entries))
+	for i, e := range b.entries {
+		if i > 0 && e.hash == b.entries[i-1].hash {
+			continue
+		}
+		l.hashes = append(l.hashes, e.hash)
+		l.sources = append(l.sources, e.source)
+		l.bloom.add(e.hash)
+	}
+	b.entries = nil
+	return l
+}
+
+// Len returns the number of blocked domains.
+func (l *List) Len() int {
+	return len(l.hashes)
+}
+
+// Lookup reports whether name or one of its parent domains is blocked.
+// name is lowercase and has no trailing dot, as returned by
+// parser.QuestionView.AppendName. Lookups that do not match do not allocate.
+func (l *List) Lookup(name []byte) (Match, bool) {
+	for suffix := name; len(suffix) > 0; {
+		h := maphash.Bytes(l.seed, suffix)
+		if l.bloom.mayContain(h) {
+			i := sort.Search(len(l.hashes), func(i int) bool { return l.hashes[i] >= h })
+			if i < len(l.hashes) && l.hashes[i] == h {
+				return Match{Source: l.names[l.sources[i]], Rule: string(suffix)}, true
+			}
+		}
+		_, suffix, _ = bytes.Cut(suffix, []byte("."))
+	}
+	return Match{}, false
+}
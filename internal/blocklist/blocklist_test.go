@@ -0,0 +1,112 @@
+package blocklist
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAddReader(t *testing.T) {
+	list := `# comment
+! adblock comment
+0.0.0.0 ads.example.com tracker.example.com
+127.0.0.1 localhost localhost.localdomain broadcasthost
+::1 ip6-localhost ip6-loopback
+0.0.0.0 0.0.0.0
+||adblock.example.org^
+||options.example.org^$third-party
+@@||allowed.example.org^
+/ads[0-9]+\.example\.net/
+plain.example.net # trailing comment
+`
+	b := NewBuilder()
+	if err := b.AddReader("test", strings.NewReader(list)); err != nil {
+		t.Fatal(err)
+	}
+	l := b.Build()
+
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		{"ads.example.com", true},
+		{"sub.tracker.example.com", true},
+		{"adblock.example.org", true},
+		{"plain.example.net", true},
+		{"localhost", false},
+		{"localhost.localdomain", false},
+		{"broadcasthost", false},
+		{"ip6-localhost", false},
+		{"0.0.0.0", false},
+		{"options.example.org", false},
+		{"allowed.example.org", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		match, ok := l.Lookup([]byte(tt.name))
+		if ok != tt.blocked {
+			t.Errorf("Lookup(%q) = %v, %v, want blocked %v", tt.name, match, ok, tt.blocked)
+		}
+	}
+	if l.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", l.Len())
+	}
+}
+
+// benchEntries is the number of domains in the benchmarked blocklist
+const benchEntries = 1000000
+
+var (
+	benchOnce sync.Once
+	benchList *List
+	benchMB   float64 // memory taken by benchList
+)
+
+// benchmarkList returns a list of benchEntries domains shaped like real
+// blocklist entries, built once for all benchmarks.
+func benchmarkList() *List {
+	benchOnce.Do(func() {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		builder := NewBuilder()
+		for i := 0; i < benchEntries; i++ {
+			builder.Add("bench", fmt.Sprintf("ads%d.tracker%d.example%d.com", i, i%1000, i%50))
+		}
+		benchList = builder.Build()
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		benchMB = float64(after.HeapAlloc-before.HeapAlloc) / (1 << 20)
+	})
+	return benchList
+}
+
+func BenchmarkLookupMiss(b *testing.B) {
+	list := benchmarkList()
+	name := []byte("www.some.long.name.not-blocked.example.org")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := list.Lookup(name); ok {
+			b.Fatal("unexpected match")
+		}
+	}
+	b.ReportMetric(benchMB, "list-MB")
+}
+
+func BenchmarkLookupHitSubdomain(b *testing.B) {
+	list := benchmarkList()
+	name := []byte("cdn.ads42.tracker42.example42.com")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := list.Lookup(name); !ok {
+			b.Fatal("expected a match")
+		}
+	}
+	b.ReportMetric(benchMB, "list-MB")
+}
@@ -0,0 +1,46 @@
+package blocklist
+
+// bloom is a bloom filter fronting the hash lookup, most queried names are
+// not blocked and get rejected after checking a few bits.
+type bloom struct {
+	bits []uint64
+	k    uint64
+}
+
+// bitsPerEntry and k give a false positive rate of about 1%
+const (
+	bitsPerEntry = 10
+	bloomHashes  = 7
+)
+
+func newBloom(entries int) bloom {
+	words := (entries*bitsPerEntry + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return bloom{bits: make([]uint64, words), k: bloomHashes}
+}
+
+// position derives the i-th of the k bit positions from a single 64 bit hash using
+// double hashing, see Kirsch and Mitzenmacher.
+func (b bloom) position(h uint64, i uint64) uint64 {
+	h1, h2 := h&0xFFFFFFFF, h>>32
+	return (h1 + i*h2) % uint64(len(b.bits)*64)
+}
+
+func (b bloom) add(h uint64) {
+	for i := uint64(0); i < b.k; i++ {
+		p := b.position(h, i)
+		b.bits[p/64] |= 1 << (p % 64)
+	}
+}
+
+func (b bloom) mayContain(h uint64) bool {
+	for i := uint64(0); i < b.k; i++ {
+		p := b.position(h, i)
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
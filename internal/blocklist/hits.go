@@ -0,0 +1,52 @@
+package blocklist
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/ring"
+)
+
+// Hit is a query answered from the blocklist.
+type Hit struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	// ClientName is the name of the client device, when known
+	ClientName string `json:"client_name,omitempty"`
+	Name       string `json:"name"`
+	Source     string `json:"source"`
+	Rule       string `json:"rule"`
+}
+
+// Hits keeps the most recent hits, to tell which lists and rules block
+// what clients actually query.
+type Hits struct {
+	// OnHit, when set, is called with each hit, e.g. to count hits per rule.
+	OnHit func(Hit)
+	// ClientName, when set, names the client of hits, e.g. from its device.
+	ClientName func(netip.Addr) string
+
+	hits *ring.Ring[Hit]
+}
+
+// NewHits returns a Hits keeping the size most recent hits.
+func NewHits(size int) *Hits {
+	return &Hits{hits: ring.New[Hit](size)}
+}
+
+// Record adds the hit of m on the query of name by client.
+func (h *Hits) Record(client netip.Addr, name []byte, m Match) {
+	hit := Hit{Time: time.Now(), Client: client.Unmap().String(), Name: string(name), Source: m.Source, Rule: m.Rule}
+	if h.ClientName != nil {
+		hit.ClientName = h.ClientName(client)
+	}
+	h.hits.Add(hit)
+	if h.OnHit != nil {
+		h.OnHit(hit)
+	}
+}
+
+// Recent returns the recent hits, most recent first.
+func (h *Hits) Recent() []Hit {
+	return h.hits.Recent(0)
+}
@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"hash/maphash"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/clock"
+)
+
+// Entry is a cached answer in wire format, valid for TTL seconds after it
+// was stored. TTLOffsets locate the TTL fields of its records so they can be
+// aged in place when the answer is served. Ages are measured on the
+// monotonic clock: stepping the system time neither expires entries early
+// nor keeps them past their TTL.
+type Entry struct {
+	Msg        []byte
+	TTLOffsets []int
+	Stored     clock.Time
+	TTL        uint32
+}
+
+func (e Entry) expired(now clock.Time) bool {
+	return now.Sub(e.Stored) >= time.Duration(e.TTL)*time.Second
+}
+
+// Cache is split in shards, each guarded by its own lock and holding the
+// names hashing to it, so that concurrent queries for different names
+// rarely wait on each other.
+//
+// Keys are opaque byte strings, such as parser.QuestionView.AppendKey
+// returns. Lookups do not allocate.
+type Cache struct {
+	seed     maphash.Seed
+	shards   []shard
+	perShard int
+}
+
+type shard struct {
+	mu      sync.RWMutex
+	entries map[string]Entry
+}
+
+// New returns a cache holding up to size entries spread over n shards.
+func New(size int, n int) *Cache {
+	if n < 1 {
+		n = 1
+	}
+	c := &Cache{seed: maphash.MakeSeed(), shards: make([]shard, n), perShard: (size + n - 1) / n}
+	for i := range c.shards {
+		c.shards[i].entries = map[string]Entry{}
+	}
+	return c
+}
+
+func (c *Cache) shard(key []byte) *shard {
+	return &c.shards[maphash.Bytes(c.seed, key)%uint64(len(c.shards))]
+}
+
+// Get returns the entry of key unless it expired.
+func (c *Cache) Get(key []byte, now clock.Time) (Entry, bool) {
+	s := c.shard(key)
+	s.mu.RLock()
+	e, ok := s.entries[string(key)]
+	s.mu.RUnlock()
+
+	if !ok || e.expired(now) {
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// GetStale returns the entry of key until its age reaches stretch times its
+// TTL, reporting whether it expired, for answers to be served a little past
+// their TTL. A stretch of 1 makes it Get, one of 0 or less returns entries
+// however old.
+func (c *Cache) GetStale(key []byte, now clock.Time, stretch float64) (e Entry, stale bool, ok bool) {
+	s := c.shard(key)
+	s.mu.RLock()
+	e, ok = s.entries[string(key)]
+	s.mu.RUnlock()
+
+	if !ok {
+		return Entry{}, false, false
+	}
+	if !e.expired(now) {
+		return e, false, true
+	}
+	if stretch > 0 && now.Sub(e.Stored) >= time.Duration(float64(e.TTL)*stretch*float64(time.Second)) {
+		return Entry{}, false, false
+	}
+	return e, true, true
+}
+
+// Set stores e for key. When the shard is full, an expired entry is evicted
+// if one is found among a few sampled ones, an arbitrary one otherwise.
+func (c *Cache) Set(key []byte, e Entry) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[string(key)]; !ok && len(s.entries) >= c.perShard {
+		s.evict(e.Stored)
+	}
+	s.entries[string(key)] = e
+}
+
+// evictSamples is the number of entries looked at to find an expired one
+const evictSamples = 8
+
+func (s *shard) evict(now clock.Time) {
+	var victim string
+	sampled := 0
+	// map iteration order is random, which makes for random sampling
+	for key, e := range s.entries {
+		if sampled == 0 || e.expired(now) {
+			victim = key
+		}
+		sampled++
+		if e.expired(now) || sampled == evictSamples {
+			break
+		}
+	}
+	delete(s.entries, victim)
+}
+
+// Len returns the number of entries, expired ones included.
+func (c *Cache) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		n += len(s.entries)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Flush removes the entries of domain and its subdomains, given as a wire
+// format name as in keys, or all entries when domain is empty. It returns
+// the number of entries removed.
+func (c *Cache) Flush(domain []byte) int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for key := range s.entries {
+			if len(domain) == 0 || underDomain(key, domain) {
+				delete(s.entries, key)
+				n++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// underDomain reports whether the wire name a key starts with is domain or
+// one of its subdomains. Both are lowercase.
+func underDomain(key string, domain []byte) bool {
+	for offset := 0; offset < len(key); offset += int(key[offset]) + 1 {
+		if strings.HasPrefix(key[offset:], string(domain)) {
+			return true
+		}
+		if key[offset] == 0 {
+			return false
+		}
+	}
+	return false
+}
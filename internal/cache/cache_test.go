@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/clock"
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// key returns the cache key of a query for name and qtype.
+func key(t testing.TB, name string, qtype uint16) []byte {
+	msg, err := parser.Pack(parser.Payload{
+		Header:    parser.Header{ID: 0xbeef, Flags: parser.FlagRD},
+		Questions: []parser.Question{{QName: name, QType: qtype, QClass: parser.ClassIN}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	view, err := parser.ViewQuestion(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return view.AppendKey(nil)
+}
+
+func TestFlush(t *testing.T) {
+	names := []string{"example.com", "www.example.com", "a.b.Example.com", "badexample.com", "example.com.au", "example.org", "com"}
+	tests := []struct {
+		domain  string
+		removed []string
+	}{
+		{"", names},
+		{"example.com", []string{"example.com", "www.example.com", "a.b.Example.com"}},
+		{"www.example.com", []string{"www.example.com"}},
+		{"b.example.com", []string{"a.b.Example.com"}},
+		{"com", []string{"example.com", "www.example.com", "a.b.Example.com", "badexample.com", "com"}},
+		{"example", nil},
+		{"ample.com", nil},
+		{"missing.example.com", nil},
+	}
+	for _, tt := range tests {
+		c := New(100, 4)
+		now := clock.Now()
+		for _, name := range names {
+			c.Set(key(t, name, parser.TypeA), Entry{Stored: now, TTL: 300})
+			c.Set(key(t, name, parser.TypeAAAA), Entry{Stored: now, TTL: 300})
+		}
+		var domain []byte
+		if tt.domain != "" {
+			domain = parser.PackName(tt.domain)
+		}
+		if n := c.Flush(domain); n != 2*len(tt.removed) {
+			t.Errorf("%q: %d entries removed, want %d", tt.domain, n, 2*len(tt.removed))
+		}
+		for _, name := range names {
+			removed := slices.Contains(tt.removed, name)
+			if _, ok := c.Get(key(t, name, parser.TypeAAAA), now); ok == removed {
+				t.Errorf("%q: %s still cached %v, want %v", tt.domain, name, ok, !removed)
+			}
+		}
+	}
+}
+
+func TestGetStale(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration
+		stretch float64
+		ok      bool
+		stale   bool
+	}{
+		{"fresh", 99 * time.Second, 1.5, true, false},
+		{"expired", 100 * time.Second, 1.5, true, true},
+		{"expired within stretch", 149 * time.Second, 1.5, true, true},
+		{"expired past stretch", 150 * time.Second, 1.5, false, false},
+		{"expired without stretch", 100 * time.Second, 1, false, false},
+		{"fresh without stretch", 99 * time.Second, 1, true, false},
+		{"any age", 1000 * time.Hour, 0, true, true},
+		{"any age, fresh", time.Second, 0, true, false},
+	}
+	k := key(t, "www.example.com", parser.TypeA)
+	for _, tt := range tests {
+		c := New(100, 1)
+		stored := clock.Now()
+		c.Set(k, Entry{Msg: []byte("answer"), Stored: stored, TTL: 100})
+		e, stale, ok := c.GetStale(k, stored.Add(tt.age), tt.stretch)
+		if ok != tt.ok || stale != tt.stale {
+			t.Errorf("%s: ok %v, stale %v, want %v, %v", tt.name, ok, stale, tt.ok, tt.stale)
+		}
+		if ok && string(e.Msg) != "answer" {
+			t.Errorf("%s: entry %q", tt.name, e.Msg)
+		}
+		if _, fresh := c.Get(k, stored.Add(tt.age)); fresh != (tt.ok && !tt.stale) {
+			t.Errorf("%s: Get found %v", tt.name, fresh)
+		}
+	}
+	if _, _, ok := New(100, 1).GetStale(k, clock.Now(), 0); ok {
+		t.Error("missing entry found")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	const size = 4
+	c := New(size, 1)
+	now := clock.Now()
+	var keys [][]byte
+	for i := 0; i < size; i++ {
+		keys = append(keys, key(t, fmt.Sprintf("host%d.example.com", i), parser.TypeA))
+		ttl := uint32(300)
+		if i == 2 {
+			ttl = 10
+		}
+		c.Set(keys[i], Entry{Stored: now, TTL: ttl})
+	}
+
+	// Replacing an entry evicts nothing
+	c.Set(keys[0], Entry{Stored: now, TTL: 300})
+	if c.Len() != size {
+		t.Fatalf("%d entries after replacing one, want %d", c.Len(), size)
+	}
+
+	// A new entry at capacity evicts the expired one
+	later := now.Add(time.Minute)
+	extra := key(t, "extra.example.com", parser.TypeA)
+	c.Set(extra, Entry{Stored: later, TTL: 300})
+	if c.Len() != size {
+		t.Errorf("%d entries, want %d", c.Len(), size)
+	}
+	if _, _, ok := c.GetStale(keys[2], later, 0); ok {
+		t.Error("expired entry kept over live ones")
+	}
+	for _, k := range append([][]byte{extra}, keys[0], keys[1], keys[3]) {
+		if _, ok := c.Get(k, later); !ok {
+			t.Errorf("live entry %q evicted", k)
+		}
+	}
+
+	// With none expired, an arbitrary one goes
+	c.Set(key(t, "extra2.example.com", parser.TypeA), Entry{Stored: later, TTL: 300})
+	if c.Len() != size {
+		t.Errorf("%d entries, want %d", c.Len(), size)
+	}
+}
+
+// benchNames is the number of distinct names queried in benchmarks
+const benchNames = 10000
+
+func filledCache(b *testing.B, shards int) (*Cache, [][]byte) {
+	c := New(2*benchNames, shards)
+	keys := make([][]byte, benchNames)
+	for i := range keys {
+		keys[i] = key(b, fmt.Sprintf("host%d.example.com", i), parser.TypeA)
+		c.Set(keys[i], Entry{Stored: clock.Now(), TTL: 3600})
+	}
+	return c, keys
+}
+
+// BenchmarkGetParallel measures lookups from all cores at once, one lock
+// against sharded locks, for 1 core up to all of them. With a single lock
+// the time per lookup stops improving as cores are added, sharded it keeps
+// scaling.
+func BenchmarkGetParallel(b *testing.B) {
+	for procs := 1; procs <= runtime.NumCPU(); procs *= 2 {
+		for _, shards := range []int{1, 32} {
+			procs, shards := procs, shards
+			b.Run(fmt.Sprintf("shards=%d/cpu=%d", shards, procs), func(b *testing.B) {
+				c, keys := filledCache(b, shards)
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+
+				var next atomic.Uint64
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := next.Add(7919)
+					for pb.Next() {
+						// a write now and then, as answers come back from upstream
+						key := keys[i%benchNames]
+						if i%100 == 0 {
+							c.Set(key, Entry{Stored: clock.Now(), TTL: 3600})
+						} else if _, ok := c.Get(key, clock.Now()); !ok {
+							b.Error("expected a cached entry")
+							return
+						}
+						i++
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Package clock reads the time elapsed since the process started from a
+// monotonic clock. Unlike wall clock time, it is not stepped by NTP or by
+// hand, so durations measured with it, such as how long an answer has been
+// cached, are always right.
+package clock
+
+import "time"
+
+// Time is a reading of the clock. It only makes sense compared to another
+// reading of the same process.
+type Time time.Duration
+
+// Now returns the current reading of the clock.
+func Now() Time {
+	return Time(now())
+}
+
+// Sub returns the time elapsed from u to t.
+func (t Time) Sub(u Time) time.Duration {
+	return time.Duration(t - u)
+}
+
+// Add returns the reading d after t.
+func (t Time) Add(d time.Duration) Time {
+	return t + Time(d)
+}
+
+// start anchors readings of Go's monotonic clock where no better clock is
+// available
+var start = time.Now()
+
+func monotonic() time.Duration {
+	return time.Since(start)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package clock
+
+import "time"
+
+func now() time.Duration {
+	return monotonic()
+}
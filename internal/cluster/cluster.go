@@ -0,0 +1,206 @@
+// Package cluster keeps several resolver instances in step: admin actions
+// taken on one node, such as flushing the cache or reloading the
+// blocklist, are gossiped to its peers, which apply them too.
+//
+// Events travel in UDP datagrams authenticated with an HMAC-SHA256 of a
+// key shared by the nodes. A node relays each event it has not seen yet to
+// its own peers, so events reach nodes that only know some of the others.
+// Events older than maxAge are refused, which bounds how long event IDs
+// must be remembered to refuse replays.
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Kinds of events
+const (
+	FlushCache      = "flush-cache"      // Name is the domain flushed, empty for all
+	ReloadBlocklist = "reload-blocklist" // each node reloads its own files
+	ReloadZones     = "reload-zones"
+	PanicMode       = "panic-mode" // Name is the mode switched to
+)
+
+// maxAge is how old an event can be when received, clock skew included.
+const maxAge = time.Minute
+
+// maxDatagram is the size of the largest event datagram
+const maxDatagram = 1400
+
+// Event is an admin action to apply on every node.
+type Event struct {
+	ID   string    `json:"id"`
+	Node string    `json:"node"` // where the action was taken
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	Name string    `json:"name,omitempty"`
+}
+
+func (e Event) String() string {
+	if e.Name == "" {
+		return e.Kind
+	}
+	return e.Kind + " " + e.Name
+}
+
+// Node gossips events with its peers.
+type Node struct {
+	name  string
+	conn  *net.UDPConn
+	peers []*net.UDPAddr
+	key   []byte
+	apply func(Event) error
+
+	mu   sync.Mutex
+	seen map[string]time.Time // event IDs, until they are too old to be accepted
+}
+
+// New returns a node named name, receiving on conn events from peers
+// authenticated with key. apply is called with every new event received.
+// The node owns conn, which may have been handed over by a previous
+// binary, and closes it on Close.
+func New(name string, conn *net.UDPConn, peers []string, key []byte, apply func(Event) error) (*Node, error) {
+	if len(key) < 16 {
+		return nil, errors.New("cluster key is shorter than 16 bytes")
+	}
+	n := &Node{name: name, conn: conn, key: key, apply: apply, seen: map[string]time.Time{}}
+	for _, peer := range peers {
+		udpAddr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %w", peer, err)
+		}
+		n.peers = append(n.peers, udpAddr)
+	}
+	return n, nil
+}
+
+// Publish sends a new event, for an action already applied on this node,
+// to the peers.
+func (n *Node) Publish(kind string, name string) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	e := Event{ID: hex.EncodeToString(id), Node: n.name, Time: time.Now(), Kind: kind, Name: name}
+	n.remember(e)
+	msg, err := n.seal(e)
+	if err != nil {
+		return err
+	}
+	log.Printf("Cluster: sending %s to %d peers", e, len(n.peers))
+	n.send(msg, nil)
+	return nil
+}
+
+// Run receives events from peers, applies and relays them.
+func (n *Node) Run() error {
+	buf := make([]byte, maxDatagram)
+	for {
+		size, from, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("Cluster: %v", err)
+			continue
+		}
+		msg := buf[:size]
+		e, err := n.open(msg)
+		if err != nil {
+			log.Printf("Cluster: refused datagram from %s: %v", from, err)
+			continue
+		}
+		if !n.remember(e) {
+			continue
+		}
+		log.Printf("Cluster: %s from node %s", e, e.Node)
+		if err := n.apply(e); err != nil {
+			log.Printf("Cluster: failed to apply %s from node %s: %v", e.Kind, e.Node, err)
+		}
+		n.send(msg, from)
+	}
+}
+
+func (n *Node) Close() error {
+	return n.conn.Close()
+}
+
+// send sends msg to the peers but except.
+func (n *Node) send(msg []byte, except *net.UDPAddr) {
+	for _, peer := range n.peers {
+		if except != nil && peer.IP.Equal(except.IP) && peer.Port == except.Port {
+			continue
+		}
+		if _, err := n.conn.WriteToUDP(msg, peer); err != nil {
+			log.Printf("Cluster: failed to send to %s: %v", peer, err)
+		}
+	}
+}
+
+// remember records the ID of e and reports whether it is new. IDs too old
+// to be accepted again are forgotten meanwhile.
+func (n *Node) remember(e Event) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	for id, expires := range n.seen {
+		if now.After(expires) {
+			delete(n.seen, id)
+		}
+	}
+	if _, ok := n.seen[e.ID]; ok {
+		return false
+	}
+	n.seen[e.ID] = e.Time.Add(2 * maxAge)
+	return true
+}
+
+// seal encodes e preceded by its MAC.
+func (n *Node) seal(e Event) ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	if sha256.Size+len(data) > maxDatagram {
+		return nil, errors.New("event too large")
+	}
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write(data)
+	return append(mac.Sum(nil), data...), nil
+}
+
+// open authenticates and decodes a datagram sealed by a peer.
+func (n *Node) open(msg []byte) (Event, error) {
+	if len(msg) < sha256.Size {
+		return Event{}, errors.New("datagram too short")
+	}
+	data := msg[sha256.Size:]
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), msg[:sha256.Size]) {
+		return Event{}, errors.New("invalid MAC, is the key the same on all nodes?")
+	}
+
+	var e Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Event{}, err
+	}
+	if age := time.Since(e.Time); age > maxAge || age < -maxAge {
+		return Event{}, fmt.Errorf("event %s is %v old, are clocks in sync?", e.ID, age.Round(time.Second))
+	}
+	if e.ID == "" {
+		return Event{}, errors.New("event without ID")
+	}
+	return e, nil
+}
@@ -0,0 +1,179 @@
+// Package device tells which device a client address belongs to, from the
+// neighbor tables of the host and DHCP leases, so that logs and policies
+// follow a device whatever address it was leased.
+package device
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"os/exec"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Device is a client known by its hardware address or name.
+type Device struct {
+	Addr     netip.Addr `json:"addr"`
+	MAC      string     `json:"mac,omitempty"`
+	Hostname string     `json:"hostname,omitempty"`
+}
+
+// Config tells where devices are read from.
+type Config struct {
+	// Neighbors reads the ARP table, /proc/net/arp, and the NDP table, ip
+	// -6 neigh, when ip is installed, for the hardware address of clients
+	// on the local links.
+	Neighbors bool
+	// Leases are dnsmasq lease files, giving the hardware address and
+	// hostname of DHCP clients.
+	Leases []string
+	// Names is a file of address or hardware address and name lines, #
+	// starts a comment, naming devices over their DHCP hostname.
+	Names string
+}
+
+// Directory maps client addresses to devices. Lookups do not allocate.
+type Directory struct {
+	cfg     Config
+	ndp     bool // whether the NDP table can be read, with ip
+	devices atomic.Pointer[map[netip.Addr]Device]
+
+	mu    sync.Mutex                       // held while refreshing
+	read  map[string]map[netip.Addr]Device // devices last read from each source
+	names *names                           // last read from cfg.Names
+}
+
+// New returns a directory of the devices of the sources of cfg. Without
+// the ip command, the IPv6 neighbors are left out.
+func New(cfg Config) *Directory {
+	d := &Directory{cfg: cfg, read: map[string]map[netip.Addr]Device{}}
+	if cfg.Neighbors {
+		if _, err := exec.LookPath("ip"); err != nil {
+			log.Printf("Reading IPv4 neighbors only, IPv6 ones need the ip command: %v", err)
+		} else {
+			d.ndp = true
+		}
+	}
+	d.devices.Store(&map[netip.Addr]Device{})
+	return d
+}
+
+// Lookup returns the device of addr, when it has a hardware address or a
+// name.
+func (d *Directory) Lookup(addr netip.Addr) (Device, bool) {
+	dev, ok := (*d.devices.Load())[addr.Unmap()]
+	return dev, ok
+}
+
+// Name returns the hostname of the device of addr, "" when unknown.
+func (d *Directory) Name(addr netip.Addr) string {
+	dev, _ := d.Lookup(addr)
+	return dev.Hostname
+}
+
+// All returns the known devices, by address.
+func (d *Directory) All() []Device {
+	devices := *d.devices.Load()
+	all := make([]Device, 0, len(devices))
+	for _, dev := range devices {
+		all = append(all, dev)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Addr.Less(all[j].Addr) })
+	return all
+}
+
+// Refresh reads the sources again. The sources that fail to be read keep
+// the devices they were last read with, their errors are returned.
+func (d *Directory) Refresh(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var sources []string
+	var errs []error
+	read := func(source string, readSource func(devices map[netip.Addr]Device) error) {
+		sources = append(sources, source)
+		devices := map[netip.Addr]Device{}
+		if err := readSource(devices); err != nil {
+			errs = append(errs, err)
+			return
+		}
+		d.read[source] = devices
+	}
+	if d.cfg.Neighbors {
+		read("arp", func(devices map[netip.Addr]Device) error {
+			return readARP("/proc/net/arp", devices)
+		})
+		if d.ndp {
+			read("ndp", func(devices map[netip.Addr]Device) error {
+				return readNeighbors(ctx, devices)
+			})
+		}
+	}
+	for _, path := range d.cfg.Leases {
+		read(path, func(devices map[netip.Addr]Device) error {
+			return readLeases(path, devices)
+		})
+	}
+
+	// Later sources complete what earlier ones told
+	devices := map[netip.Addr]Device{}
+	for _, source := range sources {
+		for addr, dev := range d.read[source] {
+			add(devices, addr, dev.MAC, dev.Hostname)
+		}
+	}
+	if d.cfg.Names != "" {
+		if names, err := readNames(d.cfg.Names); err != nil {
+			errs = append(errs, err)
+		} else {
+			d.names = names
+		}
+		d.names.apply(devices)
+	}
+	d.devices.Store(&devices)
+	return errors.Join(errs...)
+}
+
+// Run refreshes the devices every interval until ctx is done.
+func (d *Directory) Run(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if err := d.Refresh(ctx); err != nil {
+			log.Printf("Failed to read client devices: %v", err)
+		}
+	}
+}
+
+// add records what is known of the device at addr, keeping what other
+// sources told.
+func add(devices map[netip.Addr]Device, addr netip.Addr, mac string, hostname string) {
+	addr = addr.Unmap()
+	dev := devices[addr]
+	dev.Addr = addr
+	if mac != "" {
+		dev.MAC = mac
+	}
+	if hostname != "" {
+		dev.Hostname = hostname
+	}
+	devices[addr] = dev
+}
+
+// canonicalMAC returns s as lowercase colon separated hexadecimal, or ""
+// when it is not a hardware address.
+func canonicalMAC(s string) string {
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) == 0 {
+		return ""
+	}
+	return mac.String()
+}
@@ -0,0 +1,164 @@
+package device
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func dev(addr, mac, hostname string) Device {
+	return Device{Addr: netip.MustParseAddr(addr), MAC: mac, Hostname: hostname}
+}
+
+// byAddr indexes devices by address.
+func byAddr(devices ...Device) map[netip.Addr]Device {
+	m := map[netip.Addr]Device{}
+	for _, d := range devices {
+		m[d.Addr] = d
+	}
+	return m
+}
+
+func TestReadARP(t *testing.T) {
+	devices := map[netip.Addr]Device{}
+	if err := readARP("testdata/arp", devices); err != nil {
+		t.Fatal(err)
+	}
+	want := byAddr(
+		dev("192.168.1.20", "aa:bb:cc:dd:ee:ff", ""),
+		dev("192.168.1.1", "11:22:33:44:55:66", ""),
+	)
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("devices %v, want %v", devices, want)
+	}
+	if err := readARP("testdata/missing", devices); err == nil {
+		t.Error("missing file read")
+	}
+}
+
+func TestParseNeighbors(t *testing.T) {
+	out, err := os.ReadFile("testdata/neigh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := map[netip.Addr]Device{}
+	if err := parseNeighbors(out, devices); err != nil {
+		t.Fatal(err)
+	}
+	want := byAddr(
+		dev("fe80::1c2b:3dff:fe4e:5f60", "1e:2b:3d:4e:5f:60", ""),
+		dev("2001:db8::20", "aa:bb:cc:dd:ee:ff", ""),
+	)
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("devices %v, want %v", devices, want)
+	}
+}
+
+func TestReadLeases(t *testing.T) {
+	devices := map[netip.Addr]Device{}
+	if err := readLeases("testdata/leases", devices); err != nil {
+		t.Fatal(err)
+	}
+	want := byAddr(
+		dev("192.168.1.20", "aa:bb:cc:dd:ee:ff", "kids-tablet"),
+		dev("192.168.1.30", "22:33:44:55:66:77", ""),
+		dev("2001:db8::30", "", "phone"),
+	)
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("devices %v, want %v", devices, want)
+	}
+}
+
+func TestReadNames(t *testing.T) {
+	names, err := readNames("testdata/names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := map[netip.Addr]Device{}
+	if err := readLeases("testdata/leases", devices); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseNeighbors([]byte("2001:db8::20 dev eth0 lladdr aa:bb:cc:dd:ee:ff REACHABLE"), devices); err != nil {
+		t.Fatal(err)
+	}
+	names.apply(devices)
+	want := byAddr(
+		dev("192.168.1.20", "aa:bb:cc:dd:ee:ff", "kids-tablet-2"),
+		dev("2001:db8::20", "aa:bb:cc:dd:ee:ff", "kids-tablet-2"),
+		dev("192.168.1.30", "22:33:44:55:66:77", ""),
+		dev("2001:db8::30", "", "phone"),
+		dev("192.168.1.2", "", "nas"),
+		dev("192.168.1.3", "", "printer"),
+	)
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("devices %v, want %v", devices, want)
+	}
+}
+
+func TestReadNamesErrors(t *testing.T) {
+	for _, content := range []string{"192.168.1.2", "192.168.1.2 nas extra", "nas 192.168.1.2"} {
+		path := filepath.Join(t.TempDir(), "names")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readNames(path); err == nil {
+			t.Errorf("%q read", content)
+		}
+	}
+}
+
+func TestRefreshKeepsFailedSources(t *testing.T) {
+	dir := t.TempDir()
+	copyFile := func(from, to string) {
+		data, err := os.ReadFile(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(to, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leases, otherLeases, names := filepath.Join(dir, "leases"), filepath.Join(dir, "other"), filepath.Join(dir, "names")
+	copyFile("testdata/leases", leases)
+	copyFile("testdata/names", names)
+	if err := os.WriteFile(otherLeases, []byte("0 66:77:88:99:aa:bb 192.168.1.40 laptop *\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := New(Config{Leases: []string{leases, otherLeases}, Names: names})
+	if err := d.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"192.168.1.20": "kids-tablet-2", "192.168.1.2": "nas", "192.168.1.40": "laptop"}
+	check := func(when string) {
+		for addr, name := range want {
+			if got := d.Name(netip.MustParseAddr(addr)); got != name {
+				t.Errorf("%s: %s named %q, want %q", when, addr, got, name)
+			}
+		}
+	}
+	check("first refresh")
+
+	// The first lease file and the names go missing, the other lease file
+	// still reads
+	if err := os.Remove(leases); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(names, []byte("not a names file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(otherLeases, []byte("0 66:77:88:99:aa:bb 192.168.1.41 laptop *\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Refresh(context.Background()); err == nil {
+		t.Error("refresh with failed sources succeeded")
+	}
+	delete(want, "192.168.1.40")
+	want["192.168.1.41"] = "laptop"
+	check("failed refresh")
+	if dev, ok := d.Lookup(netip.MustParseAddr("192.168.1.40")); ok {
+		t.Errorf("device %v of a source read again still known", dev)
+	}
+}
@@ -0,0 +1,179 @@
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readARP reads the IPv4 neighbors of /proc/net/arp:
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.1.20     0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+func readARP(path string, devices map[netip.Addr]Device) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[2] == "0x0" {
+			// incomplete entry
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		mac := canonicalMAC(fields[3])
+		if err != nil || mac == "" || mac == "00:00:00:00:00:00" {
+			continue
+		}
+		add(devices, addr, mac, "")
+	}
+	return nil
+}
+
+// readNeighbors reads the IPv6 neighbors of ip -6 neigh:
+//
+//	fe80::1c2b:3dff:fe4e:5f60 dev eth0 lladdr 1e:2b:3d:4e:5f:60 STALE
+func readNeighbors(ctx context.Context, devices map[netip.Addr]Device) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ip", "-6", "neigh", "show").Output()
+	if err != nil {
+		return fmt.Errorf("ip -6 neigh: %w", err)
+	}
+	return parseNeighbors(out, devices)
+}
+
+// parseNeighbors reads the output of ip -6 neigh, see readNeighbors.
+func parseNeighbors(out []byte, devices map[netip.Addr]Device) error {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		for i := 1; i < len(fields)-1; i++ {
+			if fields[i] == "lladdr" {
+				if mac := canonicalMAC(fields[i+1]); mac != "" {
+					add(devices, addr, mac, "")
+				}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// readLeases reads the current leases of a dnsmasq lease file: expiry
+// time, hardware address, or IAID for DHCPv6, address, hostname or *, and
+// client ID.
+//
+//	1700000000 aa:bb:cc:dd:ee:ff 192.168.1.20 kids-tablet 01:aa:bb:cc:dd:ee:ff
+func readLeases(path string, devices map[netip.Addr]Device) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now().Unix()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			// duid line of DHCPv6 servers
+			continue
+		}
+		if expiry != 0 && expiry < now {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		hostname := fields[3]
+		if hostname == "*" {
+			hostname = ""
+		}
+		add(devices, addr, canonicalMAC(fields[1]), hostname)
+	}
+	return scanner.Err()
+}
+
+// names are the names given to devices by address or hardware address.
+type names struct {
+	byAddr map[netip.Addr]string
+	byMAC  map[string]string
+}
+
+// readNames reads the names of devices, given by address or hardware
+// address:
+//
+//	aa:bb:cc:dd:ee:ff kids-tablet
+//	192.168.1.2       nas
+func readNames(path string) (*names, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	n := &names{byAddr: map[netip.Addr]string{}, byMAC: map[string]string{}}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected an address or hardware address followed by a name", path, line)
+		}
+		if mac := canonicalMAC(fields[0]); mac != "" {
+			n.byMAC[mac] = fields[1]
+		} else if addr, err := netip.ParseAddr(fields[0]); err == nil {
+			n.byAddr[addr.Unmap()] = fields[1]
+		} else {
+			return nil, fmt.Errorf("%s:%d: %q is neither an address nor a hardware address", path, line, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// apply names devices, over the names other sources gave. Names given by
+// hardware address apply to every address of the device. A nil n names
+// none.
+func (n *names) apply(devices map[netip.Addr]Device) {
+	if n == nil {
+		return
+	}
+	for addr, name := range n.byAddr {
+		add(devices, addr, "", name)
+	}
+	for addr, dev := range devices {
+		if name, ok := n.byMAC[dev.MAC]; ok {
+			dev.Hostname = name
+			devices[addr] = dev
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package handoff upgrades the resolver binary without dropping queries: the
+// running process starts the new binary with its sockets, waits for it to
+// report ready, then drains and exits while the new one keeps answering on
+// the same sockets.
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/systemd"
+)
+
+// envFiles names the files passed to the new binary, colon separated in the
+// order of their descriptors, like LISTEN_FDNAMES does for socket activation.
+const envFiles = "DNS_RESOLVER_HANDOFF"
+
+// readyName is the pipe the new binary reports it is ready on
+const readyName = "ready"
+
+// firstFD is the descriptor of the first of exec.Cmd.ExtraFiles
+const firstFD = 3
+
+// ready is the pipe to the previous binary, see Ready
+var ready *os.File
+
+// Inherited returns, by name, the sockets handed over by the previous binary
+// on upgrade, or else passed by systemd socket activation. It returns nil
+// when the process has to open its own.
+func Inherited() map[string]*os.File {
+	list := os.Getenv(envFiles)
+	if list == "" {
+		files := map[string]*os.File{}
+		for _, f := range systemd.ListenFiles() {
+			if _, ok := files[f.Name()]; !ok {
+				files[f.Name()] = f
+			}
+		}
+		if len(files) == 0 {
+			return nil
+		}
+		return files
+	}
+	os.Unsetenv(envFiles)
+
+	files := map[string]*os.File{}
+	for i, name := range strings.Split(list, ":") {
+		fd := firstFD + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), name)
+		if name == readyName {
+			ready = f
+			continue
+		}
+		files[name] = f
+	}
+	return files
+}
+
+// Ready tells the previous binary, if this process replaces one, that it
+// answers queries so the previous one can drain. It reports whether there
+// was a previous binary.
+func Ready() bool {
+	if ready == nil {
+		return false
+	}
+	ready.Write([]byte{1})
+	ready.Close()
+	ready = nil
+	return true
+}
+
+// Upgrade starts the binary this process was started from, which may have
+// been replaced since, with the same arguments and files, and env added to
+// its environment for state its arguments do not tell. It returns once the
+// new process is ready, or an error if it exits or timeout elapses first,
+// in which case it is stopped and this process keeps serving.
+func Upgrade(files map[string]*os.File, env []string, timeout time.Duration) (*os.Process, error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	names := make([]string, 0, len(files)+1)
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cmd := exec.Command(path, os.Args[1:]...)
+	for _, name := range names {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, files[name])
+	}
+	names = append(names, readyName)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	cmd.Env = append(append(os.Environ(), env...), envFiles+"="+strings.Join(names, ":"))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+	// Only the new process may hold the write end, so its exit ends the read
+	w.Close()
+	// Passing the files put them in blocking mode, which they share with the
+	// sockets they are copies of: reads of this process would no longer
+	// honour deadlines
+	for _, f := range files {
+		syscall.SetNonblock(int(f.Fd()), true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			cmd.Process.Kill()
+		}
+		cmd.Wait()
+		return nil, fmt.Errorf("new binary %s did not become ready: %w", path, err)
+	}
+	return cmd.Process, nil
+}
@@ -0,0 +1,108 @@
+package handoff
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envReport is where the new binary started by the tests reports the
+// sockets it inherited
+const envReport = "HANDOFF_TEST_REPORT"
+
+// TestMain plays the new binary when started by Upgrade: it writes the
+// name and address of each inherited socket to the report file, then
+// reports ready.
+func TestMain(m *testing.M) {
+	report := os.Getenv(envReport)
+	if report == "" {
+		os.Exit(m.Run())
+	}
+	var lines []string
+	for name, f := range Inherited() {
+		addr := "not a socket"
+		if l, err := net.FileListener(f); err == nil {
+			addr = "tcp " + l.Addr().String()
+		} else if c, err := net.FilePacketConn(f); err == nil {
+			addr = "udp " + c.LocalAddr().String()
+		}
+		lines = append(lines, name+" "+addr)
+	}
+	sort.Strings(lines)
+	if err := os.WriteFile(report, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		os.Exit(1)
+	}
+	if !Ready() {
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func TestUpgradeHandsOverFiles(t *testing.T) {
+	files := map[string]*os.File{}
+	var want []string
+	for _, name := range []string{"dns", "cluster", "other"} {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		f, err := conn.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files[name] = f
+		want = append(want, fmt.Sprintf("%s udp %s", name, conn.LocalAddr()))
+	}
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files["api"] = f
+	want = append(want, fmt.Sprintf("api tcp %s", l.Addr()))
+	sort.Strings(want)
+
+	report := filepath.Join(t.TempDir(), "report")
+	proc, err := Upgrade(files, []string{envReport + "=" + report}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proc.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != strings.Join(want, "\n") {
+		t.Errorf("new binary inherited:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestUpgradeNotReady(t *testing.T) {
+	// Without a report file to write, the new binary exits before ready
+	if _, err := Upgrade(nil, []string{envReport + "=" + filepath.Join(t.TempDir(), "missing", "report")}, 10*time.Second); err == nil {
+		t.Error("upgrade to a binary exiting before ready succeeded")
+	}
+}
+
+func TestInheritedNothing(t *testing.T) {
+	if files := Inherited(); files != nil {
+		t.Errorf("inherited %v without a previous binary", files)
+	}
+	if Ready() {
+		t.Error("ready reported without a previous binary")
+	}
+}
@@ -0,0 +1,211 @@
+// Package ipset exports the addresses names resolve to into firewall sets,
+// so that rules such as "only allow traffic to *.example.com" can follow
+// what those names resolve to.
+package ipset
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// Rule exports the addresses of names matching Pattern: IPv4 ones to the
+// set Set4 and IPv6 ones to Set6, when not empty. A pattern such as
+// example.com matches the name and its subdomains, *.example.com only its
+// subdomains.
+type Rule struct {
+	Pattern string
+	Set4    string
+	Set6    string
+}
+
+// ParseRules parses comma separated rules written pattern=set4[/set6],
+// e.g. "*.example.com=allowed4/allowed6,example.org=org4".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, r := range strings.Split(s, ",") {
+		if r == "" {
+			continue
+		}
+		pattern, sets, ok := strings.Cut(r, "=")
+		if !ok || pattern == "" || sets == "" {
+			return nil, fmt.Errorf("invalid ipset rule %q, expected pattern=set4[/set6]", r)
+		}
+		set4, set6, _ := strings.Cut(sets, "/")
+		rules = append(rules, Rule{Pattern: strings.ToLower(strings.TrimSuffix(pattern, ".")), Set4: set4, Set6: set6})
+	}
+	return rules, nil
+}
+
+// Element is an address to add to a set for Timeout.
+type Element struct {
+	Set     string
+	Addr    netip.Addr
+	Timeout time.Duration
+	// Name is the name that resolved to Addr
+	Name string
+}
+
+// Sink adds elements to sets, such as nftables sets.
+type Sink interface {
+	Add(elements []Element) error
+}
+
+// minTimeout is how long an address stays in a set at least, whatever
+// the TTL: clients keep using addresses a little past it.
+const minTimeout = time.Minute
+
+// queueSize is the number of elements waiting for the sink before new
+// ones are dropped
+const queueSize = 1024
+
+// Exporter matches answered names against rules and hands the addresses
+// of matching ones to a sink, away from the query path.
+type Exporter struct {
+	domains   map[string][]*Rule // rules matching a domain and its subdomains
+	wildcards map[string][]*Rule // rules matching the subdomains of a domain
+	sink      Sink
+	queue     chan Element
+
+	mu      sync.Mutex
+	expires map[setAddr]time.Time // when exported elements time out
+}
+
+type setAddr struct {
+	set  string
+	addr netip.Addr
+}
+
+// New returns an exporter of the addresses matching rules to sink.
+func New(rules []Rule, sink Sink) *Exporter {
+	e := &Exporter{
+		domains:   map[string][]*Rule{},
+		wildcards: map[string][]*Rule{},
+		sink:      sink,
+		queue:     make(chan Element, queueSize),
+		expires:   map[setAddr]time.Time{},
+	}
+	rules = slices.Clone(rules)
+	for i := range rules {
+		r := &rules[i]
+		if domain, ok := strings.CutPrefix(r.Pattern, "*."); ok {
+			e.wildcards[domain] = append(e.wildcards[domain], r)
+		} else {
+			e.domains[r.Pattern] = append(e.domains[r.Pattern], r)
+		}
+	}
+	go e.run()
+	return e
+}
+
+// rules appends the rules matching name, lowercase without trailing dot,
+// to dst.
+func (e *Exporter) rules(name []byte, dst []*Rule) []*Rule {
+	dst = append(dst, e.domains[string(name)]...)
+	for suffix := name; ; {
+		_, parent, ok := bytes.Cut(suffix, []byte("."))
+		if !ok {
+			return dst
+		}
+		dst = append(dst, e.domains[string(parent)]...)
+		dst = append(dst, e.wildcards[string(parent)]...)
+		suffix = parent
+	}
+}
+
+// Export queues the addresses of the A and AAAA records of response, the
+// answer to a query for name, for the sets of the rules name matches. It
+// does not keep response, and does not allocate for names matching no rule.
+func (e *Exporter) Export(name []byte, response []byte) {
+	rules := e.rules(name, nil)
+	if len(rules) == 0 {
+		return
+	}
+	now := time.Now()
+	parser.WalkRecords(response, func(rr parser.RecordView) {
+		if rr.Section != parser.SectionAnswer {
+			return
+		}
+		addr, ok := netip.AddrFromSlice(rr.RData)
+		if !ok || addr.IsUnspecified() || (rr.Type != parser.TypeA && rr.Type != parser.TypeAAAA) {
+			return
+		}
+		timeout := max(time.Duration(rr.TTL)*time.Second, minTimeout)
+		for _, r := range rules {
+			set := r.Set4
+			if rr.Type == parser.TypeAAAA {
+				set = r.Set6
+			}
+			key := setAddr{set, addr}
+			if set == "" || !e.due(key, now, timeout) {
+				continue
+			}
+			select {
+			case e.queue <- Element{Set: set, Addr: addr, Timeout: timeout, Name: string(name)}:
+			default:
+				log.Printf("IP set export queue full, dropping %s for set %s", addr, set)
+				// Let the next answers try again
+				e.forget(key)
+			}
+		}
+	})
+}
+
+// due reports whether key has to be exported to last timeout from now,
+// that is unless an export still running by then was already made.
+func (e *Exporter) due(key setAddr, now time.Time, timeout time.Duration) bool {
+	expires := now.Add(timeout)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Refresh once half of the element lifetime is gone
+	if last, ok := e.expires[key]; ok && last.Sub(now) > timeout/2 {
+		return false
+	}
+	e.expires[key] = expires
+	if len(e.expires) > 4*queueSize {
+		for k, t := range e.expires {
+			if t.Before(now) {
+				delete(e.expires, k)
+			}
+		}
+	}
+	return true
+}
+
+// forget makes key due again, its export having been dropped or failed.
+func (e *Exporter) forget(key setAddr) {
+	e.mu.Lock()
+	delete(e.expires, key)
+	e.mu.Unlock()
+}
+
+// run hands queued elements to the sink, in batches of those queued
+// while the previous batch was being added.
+func (e *Exporter) run() {
+	for first := range e.queue {
+		batch := []Element{first}
+	drain:
+		for len(batch) < queueSize {
+			select {
+			case el := <-e.queue:
+				batch = append(batch, el)
+			default:
+				break drain
+			}
+		}
+		if err := e.sink.Add(batch); err != nil {
+			log.Printf("Failed to export %d addresses to IP sets: %v", len(batch), err)
+			// Let the next answers try again
+			for _, el := range batch {
+				e.forget(setAddr{el.Set, el.Addr})
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package ipset
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// answer returns a response for name with A or AAAA records of addrs,
+// with a TTL of ttl.
+func answer(t *testing.T, name string, ttl uint32, addrs ...netip.Addr) []byte {
+	payload := parser.Payload{
+		Header:    parser.Header{Flags: parser.FlagQR},
+		Questions: []parser.Question{{QName: name, QType: parser.TypeA, QClass: parser.ClassIN}},
+	}
+	for _, addr := range addrs {
+		rtype := parser.TypeA
+		if addr.Is6() {
+			rtype = parser.TypeAAAA
+		}
+		payload.Answers = append(payload.Answers, parser.Resource{
+			RName: name, RType: rtype, RClass: parser.ClassIN, RTtl: ttl, RData: addr.AsSlice(),
+		})
+	}
+	msg, err := parser.Pack(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// blockingSink adds elements to added once released.
+type blockingSink struct {
+	release chan struct{}
+	added   chan Element
+}
+
+func newBlockingSink() *blockingSink {
+	return &blockingSink{release: make(chan struct{}), added: make(chan Element, 2*queueSize)}
+}
+
+func (s *blockingSink) Add(elements []Element) error {
+	<-s.release
+	for _, el := range elements {
+		s.added <- el
+	}
+	return nil
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("*.Example.com.=allowed4/allowed6,,example.org=org4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{{"*.example.com", "allowed4", "allowed6"}, {"example.org", "org4", ""}}
+	if !slices.Equal(rules, want) {
+		t.Errorf("rules %v, want %v", rules, want)
+	}
+	for _, s := range []string{"example.com", "=set", "example.com="} {
+		if _, err := ParseRules(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
+
+func TestRulesMatching(t *testing.T) {
+	rules, err := ParseRules("example.com=domain,*.example.com=wildcard,a.example.com=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(rules, newBlockingSink())
+	tests := []struct {
+		name string
+		sets []string
+	}{
+		{"example.com", []string{"domain"}},
+		{"www.example.com", []string{"domain", "wildcard"}},
+		{"a.example.com", []string{"a", "domain", "wildcard"}},
+		{"b.a.example.com", []string{"a", "domain", "wildcard"}},
+		{"example.org", nil},
+		{"badexample.com", nil},
+		{"com", nil},
+	}
+	for _, tt := range tests {
+		var sets []string
+		for _, r := range e.rules([]byte(tt.name), nil) {
+			sets = append(sets, r.Set4)
+		}
+		slices.Sort(sets)
+		if !slices.Equal(sets, tt.sets) {
+			t.Errorf("%s: sets %v, want %v", tt.name, sets, tt.sets)
+		}
+	}
+}
+
+func TestDue(t *testing.T) {
+	e := New(nil, newBlockingSink())
+	key := setAddr{"set", netip.MustParseAddr("192.0.2.1")}
+	now := time.Now()
+	tests := []struct {
+		name    string
+		at      time.Duration
+		timeout time.Duration
+		due     bool
+	}{
+		{"first export", 0, time.Minute, true},
+		{"exported", time.Second, time.Minute, false},
+		{"less than half the lifetime gone", 29 * time.Second, time.Minute, false},
+		{"more than half the lifetime gone", 31 * time.Second, time.Minute, true},
+		{"refreshed", 32 * time.Second, time.Minute, false},
+		{"expired", 10 * time.Minute, time.Minute, true},
+	}
+	for _, tt := range tests {
+		if due := e.due(key, now.Add(tt.at), tt.timeout); due != tt.due {
+			t.Errorf("%s: due %v, want %v", tt.name, due, tt.due)
+		}
+	}
+	e.forget(key)
+	if !e.due(key, now.Add(10*time.Minute), time.Minute) {
+		t.Error("forgotten element not due")
+	}
+}
+
+func TestExportQueueFull(t *testing.T) {
+	sink := newBlockingSink()
+	e := New([]Rule{{Pattern: "example.com", Set4: "set4", Set6: "set6"}}, sink)
+
+	// The sink holds the first element while the others fill the queue
+	first := netip.MustParseAddr("192.0.2.1")
+	e.Export([]byte("example.com"), answer(t, "example.com", 300, first))
+	for len(e.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	var addrs []netip.Addr
+	for i := 0; i < queueSize; i++ {
+		addrs = append(addrs, netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}))
+	}
+	e.Export([]byte("example.com"), answer(t, "example.com", 300, addrs...))
+	if len(e.queue) != queueSize {
+		t.Fatalf("%d elements queued, want %d", len(e.queue), queueSize)
+	}
+	dropped := netip.MustParseAddr("2001:db8::1")
+	e.Export([]byte("www.example.com"), answer(t, "www.example.com", 300, dropped))
+
+	// The dropped element is exported with the next answer
+	close(sink.release)
+	for i := 0; i < queueSize+1; i++ {
+		<-sink.added
+	}
+	e.Export([]byte("www.example.com"), answer(t, "www.example.com", 300, dropped))
+	select {
+	case el := <-sink.added:
+		want := Element{Set: "set6", Addr: dropped, Timeout: 300 * time.Second, Name: "www.example.com"}
+		if el != want {
+			t.Errorf("exported %+v, want %+v", el, want)
+		}
+	case <-time.After(time.Second):
+		t.Error("element dropped on a full queue never exported")
+	}
+}
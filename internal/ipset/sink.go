@@ -0,0 +1,90 @@
+package ipset
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ParseSink returns the sink described by s: "nft:family table" adds
+// elements to the sets of an nftables table, "unixgram:path" sends them as
+// JSON datagrams to a unix socket.
+func ParseSink(s string) (Sink, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	switch kind {
+	case "nft":
+		family, table, ok := strings.Cut(arg, " ")
+		if !ok || family == "" || table == "" {
+			return nil, fmt.Errorf("invalid nft sink %q, expected nft:family table", s)
+		}
+		return &NFT{Family: family, Table: table}, nil
+	case "unixgram":
+		if arg == "" {
+			return nil, fmt.Errorf("invalid unixgram sink %q, expected unixgram:path", s)
+		}
+		return &Socket{Path: arg}, nil
+	}
+	return nil, fmt.Errorf("unknown IP set sink %q, expected nft:family table or unixgram:path", s)
+}
+
+// NFT adds elements to sets of an nftables table with the nft command.
+// Sets must be created with the timeout flag, e.g.
+//
+//	nft add set inet filter allowed4 '{ type ipv4_addr; flags timeout; }'
+type NFT struct {
+	Family string
+	Table  string
+}
+
+func (n *NFT) Add(elements []Element) error {
+	var script bytes.Buffer
+	for _, el := range elements {
+		fmt.Fprintf(&script, "add element %s %s %s { %s timeout %ds }\n",
+			n.Family, n.Table, el.Set, el.Addr, int64(el.Timeout/time.Second))
+	}
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = &script
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// Socket sends each element as a JSON datagram to a unix socket, e.g.
+//
+//	{"set":"allowed4","addr":"192.0.2.1","timeout":300,"name":"www.example.com"}
+type Socket struct {
+	Path string
+}
+
+type socketElement struct {
+	Set     string `json:"set"`
+	Addr    string `json:"addr"`
+	Timeout int64  `json:"timeout"`
+	Name    string `json:"name"`
+}
+
+func (s *Socket) Add(elements []Element) error {
+	conn, err := net.Dial("unixgram", s.Path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, el := range elements {
+		msg, err := json.Marshal(socketElement{
+			Set: el.Set, Addr: el.Addr.String(), Timeout: int64(el.Timeout / time.Second), Name: el.Name,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
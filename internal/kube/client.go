@@ -0,0 +1,229 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// In-cluster credentials of the pod service account, see
+// https://kubernetes.io/docs/tasks/run-application/access-api-from-pod/
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	inClusterToken    = serviceAccountDir + "token"
+	inClusterCA       = serviceAccountDir + "ca.crt"
+)
+
+// Client reads objects from the Kubernetes API with plain HTTP requests.
+type Client struct {
+	server string
+	http   *http.Client
+	// token, or tokenFile read on each request since service account
+	// tokens are rotated
+	token     string
+	tokenFile string
+}
+
+// InCluster returns a client using the service account of the pod the
+// resolver runs in.
+func InCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT is not set")
+	}
+	ca, err := os.ReadFile(inClusterCA)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(ca, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		server:    "https://" + net.JoinHostPort(host, port),
+		http:      newHTTPClient(tlsConfig),
+		tokenFile: inClusterToken,
+	}, nil
+}
+
+// kubeconfig holds the parts of a kubeconfig file the client uses.
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Clusters []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData string `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData string `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         string `json:"client-key-data"`
+			// Exec is only checked for, running plugins is not supported
+			Exec json.RawMessage `json:"exec"`
+		} `json:"user"`
+	} `json:"users"`
+}
+
+// FromKubeconfig returns a client for the current context of the kubeconfig
+// file at path, in YAML as kubectl writes it, or in JSON. Users
+// authenticating through an exec credential plugin are refused.
+func FromKubeconfig(path string) (*Client, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	var cfg kubeconfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var clusterName, userName string
+	for _, c := range cfg.Contexts {
+		if c.Name == cfg.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("%s: context %q not found", path, cfg.CurrentContext)
+	}
+
+	client := &Client{}
+	var tlsConfig *tls.Config
+	for _, c := range cfg.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		ca, err := fileOrData(c.Cluster.CertificateAuthority, c.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: cluster %s: %w", path, clusterName, err)
+		}
+		client.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		tlsConfig, err = newTLSConfig(ca, c.Cluster.InsecureSkipTLSVerify)
+		if err != nil {
+			return nil, fmt.Errorf("%s: cluster %s: %w", path, clusterName, err)
+		}
+	}
+	if client.server == "" {
+		return nil, fmt.Errorf("%s: cluster %q not found", path, clusterName)
+	}
+
+	for _, u := range cfg.Users {
+		if u.Name != userName {
+			continue
+		}
+		if len(u.User.Exec) > 0 && string(u.User.Exec) != "null" {
+			return nil, fmt.Errorf("%s: user %s: exec credential plugins are not supported", path, userName)
+		}
+		client.token, client.tokenFile = u.User.Token, u.User.TokenFile
+		cert, err := fileOrData(u.User.ClientCertificate, u.User.ClientCertificateData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %s: %w", path, userName, err)
+		}
+		key, err := fileOrData(u.User.ClientKey, u.User.ClientKeyData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %s: %w", path, userName, err)
+		}
+		if cert != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: user %s: %w", path, userName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+	client.http = newHTTPClient(tlsConfig)
+	return client, nil
+}
+
+// fileOrData returns the content of file, or else the base64 decoded data.
+func fileOrData(file string, data string) ([]byte, error) {
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	if data == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+func newTLSConfig(ca []byte, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificate found in certificate authority")
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func newHTTPClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}
+}
+
+// get decodes into v the JSON object at path of the API, such as
+// /api/v1/services.
+func (c *Client) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	token := c.token
+	if c.tokenFile != "" {
+		data, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,125 @@
+package kube
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// kubeconfigYAML is a kubeconfig as written by kubectl, with the sequences
+// it indents as much as their key.
+const kubeconfigYAML = `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: ""
+    insecure-skip-tls-verify: true
+    server: https://127.0.0.1:6443/
+  name: kind-dev
+contexts:
+- context:
+    cluster: kind-dev
+    user: kind-dev
+  name: kind-dev # the only one
+current-context: "kind-dev"
+kind: Config
+preferences: {}
+users:
+- name: kind-dev
+  user:
+    token: abc:def
+`
+
+// execUserYAML replaces the user of kubeconfigYAML with one authenticating
+// through an exec credential plugin.
+const execUserYAML = `  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      args:
+      - get-token
+      - --cluster-name
+      - 'dev''s'
+      command: aws
+      env: null
+`
+
+// execKubeconfigYAML returns kubeconfigYAML with the user of execUserYAML.
+func execKubeconfigYAML() string {
+	return strings.Replace(kubeconfigYAML, "  user:\n    token: abc:def\n", execUserYAML, 1)
+}
+
+func TestYAMLToJSON(t *testing.T) {
+	head := `{"apiVersion":"v1","clusters":[{"cluster":{"certificate-authority-data":"","insecure-skip-tls-verify":true,"server":"https://127.0.0.1:6443/"},"name":"kind-dev"}],` +
+		`"contexts":[{"context":{"cluster":"kind-dev","user":"kind-dev"},"name":"kind-dev"}],"current-context":"kind-dev","kind":"Config","preferences":{},`
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"token", kubeconfigYAML, head + `"users":[{"name":"kind-dev","user":{"token":"abc:def"}}]}`},
+		{
+			"exec",
+			execKubeconfigYAML(),
+			head + `"users":[{"name":"kind-dev","user":{"exec":{"apiVersion":"client.authentication.k8s.io/v1beta1","args":["get-token","--cluster-name","dev's"],"command":"aws","env":null}}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		data, err := yamlToJSON([]byte(tt.yaml))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: got  %s\nwant %s", tt.name, data, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"key: |\n  text\n", "a: 1\n  b: 2\n", "just text\n", "a: [1, 2]\n", "a: \"open\n"} {
+		if _, err := yamlToJSON([]byte(bad)); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestFromKubeconfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath, jsonPath := filepath.Join(dir, "config"), filepath.Join(dir, "config.json")
+	data, err := yamlToJSON([]byte(kubeconfigYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(yamlPath, []byte(kubeconfigYAML), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(jsonPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fromYAML, err := FromKubeconfig(yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := FromKubeconfig(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromYAML.server != "https://127.0.0.1:6443" || fromYAML.token != "abc:def" {
+		t.Errorf("server %q and token %q", fromYAML.server, fromYAML.token)
+	}
+	fromYAML.http, fromJSON.http = nil, nil
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Errorf("YAML gives %+v, JSON %+v", fromYAML, fromJSON)
+	}
+}
+
+func TestFromKubeconfigExec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(execKubeconfigYAML()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := FromKubeconfig(path)
+	if err == nil || !strings.Contains(err.Error(), "exec credential plugins are not supported") {
+		t.Errorf("error %v, want exec credential plugins not supported", err)
+	}
+}
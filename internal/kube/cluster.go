@@ -0,0 +1,263 @@
+// Package kube serves the service discovery names of a Kubernetes cluster,
+// such as my-svc.my-namespace.svc.cluster.local, from the Services and
+// Endpoints of its API, following
+// https://github.com/kubernetes/dns/blob/master/docs/specification.md
+package kube
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+	"github.com/gertanoh/dns-resolver/internal/zone"
+)
+
+const typeSRV uint16 = 33
+
+// Cluster answers queries for the names under Domain from the last copy
+// of the cluster Services and Endpoints, refreshed by Sync.
+type Cluster struct {
+	client *Client
+	domain string // e.g. cluster.local
+	suffix []byte // "." + domain
+	ttl    uint32
+
+	snapshot atomic.Pointer[snapshot]
+}
+
+// snapshot holds the records of each name under the domain. Names without
+// records are the empty non-terminals leading to names with records.
+type snapshot struct {
+	names  map[string][]record
+	serial uint32
+}
+
+type record struct {
+	rtype uint16
+	rdata []byte
+}
+
+// New returns a cluster serving names under domain with records of the
+// given TTL. It answers nothing until the first Sync.
+func New(client *Client, domain string, ttl uint32) *Cluster {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	return &Cluster{client: client, domain: domain, suffix: []byte("." + domain), ttl: ttl}
+}
+
+// Objects of the API, reduced to the fields used here
+type serviceList struct {
+	Items []struct {
+		Metadata metadata `json:"metadata"`
+		Spec     struct {
+			Type         string   `json:"type"`
+			ClusterIP    string   `json:"clusterIP"`
+			ClusterIPs   []string `json:"clusterIPs"`
+			ExternalName string   `json:"externalName"`
+			Ports        []port   `json:"ports"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+type endpointsList struct {
+	Items []struct {
+		Metadata metadata `json:"metadata"`
+		Subsets  []struct {
+			Addresses []struct {
+				IP       string `json:"ip"`
+				Hostname string `json:"hostname"`
+			} `json:"addresses"`
+			Ports []port `json:"ports"`
+		} `json:"subsets"`
+	} `json:"items"`
+}
+
+type metadata struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type port struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+// Sync reads the Services and Endpoints of the cluster and makes them the
+// ones answered from.
+func (c *Cluster) Sync(ctx context.Context) error {
+	var services serviceList
+	if err := c.client.get(ctx, "/api/v1/services", &services); err != nil {
+		return err
+	}
+	var endpoints endpointsList
+	if err := c.client.get(ctx, "/api/v1/endpoints", &endpoints); err != nil {
+		return err
+	}
+
+	snap := &snapshot{names: map[string][]record{}, serial: uint32(time.Now().Unix())}
+	headless := map[string]bool{}
+	for _, svc := range services.Items {
+		name := strings.ToLower(svc.Metadata.Name + "." + svc.Metadata.Namespace + ".svc." + c.domain)
+		switch {
+		case svc.Spec.Type == "ExternalName":
+			snap.add(name, parser.TypeCNAME, []byte(strings.TrimSuffix(svc.Spec.ExternalName, ".")))
+			continue
+		case svc.Spec.ClusterIP == "None":
+			// Answered with the addresses of its endpoints
+			headless[svc.Metadata.Namespace+"/"+svc.Metadata.Name] = true
+			snap.add(name, 0, nil)
+			continue
+		}
+		ips := svc.Spec.ClusterIPs
+		if len(ips) == 0 {
+			ips = []string{svc.Spec.ClusterIP}
+		}
+		for _, ip := range ips {
+			snap.addAddress(name, ip)
+		}
+		for _, p := range svc.Spec.Ports {
+			snap.addSRV(name, p, name)
+		}
+	}
+
+	for _, ep := range endpoints.Items {
+		if !headless[ep.Metadata.Namespace+"/"+ep.Metadata.Name] {
+			continue
+		}
+		name := strings.ToLower(ep.Metadata.Name + "." + ep.Metadata.Namespace + ".svc." + c.domain)
+		for _, subset := range ep.Subsets {
+			for _, addr := range subset.Addresses {
+				snap.addAddress(name, addr.IP)
+				target := name
+				if addr.Hostname != "" {
+					target = strings.ToLower(addr.Hostname) + "." + name
+					snap.addAddress(target, addr.IP)
+				}
+				for _, p := range subset.Ports {
+					snap.addSRV(name, p, target)
+				}
+			}
+		}
+	}
+
+	c.snapshot.Store(snap)
+	return nil
+}
+
+// Run syncs every interval until ctx is done, logging failures. The last
+// successful sync keeps being answered from meanwhile.
+func (c *Cluster) Run(ctx context.Context, interval time.Duration) {
+	for {
+		if err := c.Sync(ctx); err != nil {
+			log.Printf("Failed to sync cluster %s: %v", c.domain, err)
+		} else {
+			log.Printf("Synced cluster %s, %d names", c.domain, len(c.snapshot.Load().names))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// add adds a record to name, or only the name when rtype is 0, along with
+// the empty non-terminals above it.
+func (s *snapshot) add(name string, rtype uint16, rdata []byte) {
+	if rtype != 0 {
+		s.names[name] = append(s.names[name], record{rtype, rdata})
+	} else if _, ok := s.names[name]; !ok {
+		s.names[name] = nil
+	}
+	for _, parent, ok := strings.Cut(name, "."); ok; _, parent, ok = strings.Cut(parent, ".") {
+		if _, exists := s.names[parent]; !exists {
+			s.names[parent] = nil
+		}
+	}
+}
+
+func (s *snapshot) addAddress(name string, ip string) {
+	addr := net.ParseIP(ip)
+	switch {
+	case addr == nil:
+	case addr.To4() != nil:
+		s.add(name, parser.TypeA, addr.To4())
+	default:
+		s.add(name, parser.TypeAAAA, addr.To16())
+	}
+}
+
+// addSRV adds the SRV record of a named port of service name, pointing
+// to target, see
+// https://github.com/kubernetes/dns/blob/master/docs/specification.md#232---srv-records
+func (s *snapshot) addSRV(name string, p port, target string) {
+	if p.Name == "" {
+		return
+	}
+	protocol := p.Protocol
+	if protocol == "" {
+		protocol = "TCP"
+	}
+	owner := strings.ToLower("_" + p.Name + "._" + protocol + "." + name)
+	rdata := binary.BigEndian.AppendUint16(nil, 0)    // priority
+	rdata = binary.BigEndian.AppendUint16(rdata, 100) // weight
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(p.Port))
+	s.add(owner, typeSRV, append(rdata, parser.PackName(target)...))
+}
+
+// Covers reports whether name, lowercase without trailing dot, is under
+// the cluster domain. It does not allocate.
+func (c *Cluster) Covers(name []byte) bool {
+	return bytes.HasSuffix(name, c.suffix) || string(name) == c.domain
+}
+
+// Lookup answers q from the last sync. Before the first one it answers
+// SERVFAIL: forwarding the query would leak cluster names upstream, and
+// have the NXDOMAIN answered cached by clients.
+func (c *Cluster) Lookup(q parser.Question) (zone.Answer, bool) {
+	snap := c.snapshot.Load()
+	if snap == nil {
+		return zone.Answer{Zone: c.domain, Rcode: parser.RcodeServFail}, true
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.QName, "."))
+	answer := zone.Answer{Zone: c.domain}
+
+	records, ok := snap.names[name]
+	if !ok && name != c.domain {
+		answer.Rcode = parser.RcodeNXDomain
+		answer.Authorities = []parser.Resource{c.soa(snap)}
+		return answer, true
+	}
+	for _, r := range records {
+		if r.rtype == q.QType || q.QType == parser.TypeANY || (r.rtype == parser.TypeCNAME && q.QType != parser.TypeCNAME) {
+			answer.Answers = append(answer.Answers, c.record(q.QName, r.rtype, r.rdata))
+		}
+	}
+	if name == c.domain && q.QType == parser.TypeSOA {
+		answer.Answers = append(answer.Answers, c.soa(snap))
+	}
+	if len(answer.Answers) == 0 {
+		answer.Authorities = []parser.Resource{c.soa(snap)}
+	}
+	return answer, true
+}
+
+func (c *Cluster) record(name string, rtype uint16, rdata []byte) parser.Resource {
+	return parser.Resource{RName: name, RType: rtype, RClass: parser.ClassIN, RTtl: c.ttl, RData: rdata}
+}
+
+// soa returns the SOA record of the cluster domain, its minimum field is
+// used as negative TTL.
+func (c *Cluster) soa(snap *snapshot) parser.Resource {
+	rdata := append(parser.PackName("ns.dns."+c.domain), parser.PackName("hostmaster."+c.domain)...)
+	for _, v := range []uint32{snap.serial, 7200, 1800, 86400, c.ttl} {
+		rdata = binary.BigEndian.AppendUint32(rdata, v)
+	}
+	return c.record(c.domain, parser.TypeSOA, rdata)
+}
@@ -0,0 +1,20 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+func TestLookupBeforeSync(t *testing.T) {
+	c := New(&Client{}, "cluster.local.", 5)
+	answer, ok := c.Lookup(parser.Question{QName: "my-svc.default.svc.cluster.local.", QType: parser.TypeA, QClass: parser.ClassIN})
+	if !ok || answer.Rcode != parser.RcodeServFail {
+		t.Errorf("answered %v with rcode %d before the first sync, want SERVFAIL", ok, answer.Rcode)
+	}
+
+	c.snapshot.Store(&snapshot{names: map[string][]record{}})
+	if answer, _ = c.Lookup(parser.Question{QName: "my-svc.default.svc.cluster.local.", QType: parser.TypeA, QClass: parser.ClassIN}); answer.Rcode != parser.RcodeNXDomain {
+		t.Errorf("rcode %d after a sync without the service, want NXDOMAIN", answer.Rcode)
+	}
+}
@@ -0,0 +1,212 @@
+package kube
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlToJSON converts data, a YAML document, to JSON. It handles the
+// subset of YAML kubeconfig files are written in: block mappings and
+// sequences, plain and quoted scalars, and empty flow collections. Block
+// scalars, anchors and flow collections with content are rejected.
+func yamlToJSON(data []byte) ([]byte, error) {
+	p := &yamlParser{}
+	for i, text := range strings.Split(string(data), "\n") {
+		text = strings.TrimRight(text, " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed[0] == '#' || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs cannot indent YAML", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{number: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(p.lines) == 0 {
+		return []byte("null"), nil
+	}
+	v, err := p.node(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.next < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return json.Marshal(v)
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	next  int
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	line := p.lines[min(p.next, len(p.lines)-1)]
+	return fmt.Errorf("line %d: %s", line.number, fmt.Sprintf(format, args...))
+}
+
+// more reports whether the next line is indented by indent.
+func (p *yamlParser) more(indent int) bool {
+	return p.next < len(p.lines) && p.lines[p.next].indent == indent
+}
+
+func isItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// node parses the mapping or sequence starting at the next line.
+func (p *yamlParser) node(indent int) (any, error) {
+	if isItem(p.lines[p.next].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	m := map[string]any{}
+	for p.more(indent) && !isItem(p.lines[p.next].text) {
+		text := p.lines[p.next].text
+		key, value, ok := strings.Cut(text, ": ")
+		if !ok {
+			if key, ok = strings.CutSuffix(text, ":"); !ok {
+				return nil, p.errorf("%q is not a key and value", text)
+			}
+		}
+		key, err := p.scalarString(key)
+		if err != nil {
+			return nil, err
+		}
+		p.next++
+
+		value = strings.TrimSpace(value)
+		switch {
+		case value != "":
+			m[key], err = p.scalar(value)
+		case p.next < len(p.lines) && p.lines[p.next].indent > indent:
+			m[key], err = p.node(p.lines[p.next].indent)
+		case p.more(indent) && isItem(p.lines[p.next].text):
+			// Sequences may be indented as much as their key
+			m[key], err = p.sequence(indent)
+		default:
+			m[key] = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (p *yamlParser) sequence(indent int) ([]any, error) {
+	s := []any{}
+	for p.more(indent) && isItem(p.lines[p.next].text) {
+		line := &p.lines[p.next]
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		var v any
+		var err error
+		switch {
+		case rest == "":
+			p.next++
+			if p.next < len(p.lines) && p.lines[p.next].indent > indent {
+				v, err = p.node(p.lines[p.next].indent)
+			}
+		case strings.Contains(rest, ": ") || strings.HasSuffix(rest, ":") || isItem(rest):
+			// The item is a collection starting on the same line, made the
+			// next line as if it started on a line of its own
+			line.indent += len(line.text) - len(rest)
+			line.text = rest
+			v, err = p.node(line.indent)
+		default:
+			p.next++
+			v, err = p.scalar(rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, v)
+	}
+	return s, nil
+}
+
+// scalar returns the value of a plain or quoted scalar, or empty flow
+// collection.
+func (p *yamlParser) scalar(text string) (any, error) {
+	switch text[0] {
+	case '"', '\'':
+		return p.scalarString(text)
+	case '|', '>', '&', '*', '!':
+		return nil, p.errorf("unsupported YAML %q", text)
+	}
+	if i := strings.Index(text, " #"); i >= 0 {
+		text = strings.TrimSpace(text[:i])
+	}
+	switch text {
+	case "{}":
+		return map[string]any{}, nil
+	case "[]":
+		return []any{}, nil
+	case "null", "~":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if text[0] == '{' || text[0] == '[' {
+		return nil, p.errorf("unsupported YAML flow collection %q", text)
+	}
+	return text, nil
+}
+
+// scalarString returns the value of a key or string scalar, unquoted.
+func (p *yamlParser) scalarString(text string) (string, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		end := closingQuote(text)
+		if end < 0 {
+			return "", p.errorf("unterminated string %s", text)
+		}
+		s, err := strconv.Unquote(text[:end+1])
+		if err != nil {
+			return "", p.errorf("invalid string %s", text)
+		}
+		return s, nil
+	case strings.HasPrefix(text, "'"):
+		var b bytes.Buffer
+		for i := 1; i < len(text); i++ {
+			if text[i] != '\'' {
+				b.WriteByte(text[i])
+			} else if i+1 < len(text) && text[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+			} else {
+				return b.String(), nil
+			}
+		}
+		return "", p.errorf("unterminated string %s", text)
+	}
+	return text, nil
+}
+
+// closingQuote returns the index of the quote closing the double quoted
+// string text starts with, or -1.
+func closingQuote(text string) int {
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
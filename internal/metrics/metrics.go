@@ -0,0 +1,350 @@
+// Package metrics keeps latency histograms and counters and exposes them in
+// the OpenMetrics text format, see
+// https://github.com/OpenObservability/OpenMetrics/blob/main/specification/OpenMetrics.md
+//
+// Histogram buckets carry an exemplar, the trace ID of the last query
+// observed in them, so a spike in a slow bucket leads to actual queries in
+// the slow-query log. Observing does not allocate.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets of DNS
+// latency histograms, from cache hits to timed out upstreams.
+var LatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Registry holds metric families in the order they are registered.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+type family interface {
+	write(w io.Writer) error
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// HistogramVec registers a family of histograms told apart by the value of
+// a single label.
+func (r *Registry) HistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	v := &HistogramVec{name: name, help: help, label: label, buckets: buckets, histograms: map[string]*Histogram{}}
+	r.register(v)
+	return v
+}
+
+// Histogram registers a histogram without labels.
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	v := r.HistogramVec(name, help, "", buckets)
+	return v.With("")
+}
+
+// Counter registers a counter, name is given without the _total suffix.
+func (r *Registry) Counter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	r.register(c)
+	return c
+}
+
+// CounterVec registers a family of counters told apart by the values of
+// labels, names are given without the _total suffix.
+func (r *Registry) CounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{name: name, help: help, labels: labels, counters: map[string]*Counter{}}
+	r.register(v)
+	return v
+}
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// ContentType is the media type of what Write writes.
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// ServeHTTP answers scrapes of the metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	if err := r.Write(w); err != nil {
+		log.Printf("Failed to write metrics: %v", err)
+	}
+}
+
+// Write writes all the metrics in the OpenMetrics text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "# EOF\n")
+	return err
+}
+
+// Counter is a monotonically increasing count.
+type Counter struct {
+	name, help string
+	value      atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# TYPE %s counter\n# HELP %s %s\n%s_total %d\n", c.name, c.name, c.help, c.name, c.value.Load())
+	return err
+}
+
+// CounterVec is a family of counters with labels.
+type CounterVec struct {
+	name, help string
+	labels     []string
+	// limit, when above 0, caps the number of counters, the overflow one
+	// counting for label values beyond it
+	limit    int
+	overflow string
+
+	mu       sync.RWMutex
+	counters map[string]*Counter // by formatted labels
+}
+
+// Limit caps the family to n counters, for label values of unbounded
+// cardinality. Once the other n-1 exist, new label values are counted by
+// the counter of the overflow values.
+func (v *CounterVec) Limit(n int, overflow ...string) *CounterVec {
+	v.limit, v.overflow = n, v.format(overflow)
+	return v
+}
+
+// format returns the labels of a counter with values.
+func (v *CounterVec) format(values []string) string {
+	var b strings.Builder
+	for i, label := range v.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(label + "=" + quote(value))
+	}
+	return b.String()
+}
+
+// With returns the counter of the label values, given in the order of the
+// labels, created on first use.
+func (v *CounterVec) With(values ...string) *Counter {
+	labels := v.format(values)
+
+	v.mu.RLock()
+	c := v.counters[labels]
+	v.mu.RUnlock()
+	if c != nil {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c = v.counters[labels]; c != nil {
+		return c
+	}
+	if v.limit > 0 && len(v.counters) >= v.limit-1 && labels != v.overflow {
+		if c = v.counters[v.overflow]; c != nil {
+			return c
+		}
+		labels = v.overflow
+	}
+	c = &Counter{}
+	v.counters[labels] = c
+	return c
+}
+
+func (v *CounterVec) write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "# TYPE %s counter\n# HELP %s %s\n", v.name, v.name, v.help); err != nil {
+		return err
+	}
+
+	v.mu.RLock()
+	labels := make([]string, 0, len(v.counters))
+	for l := range v.counters {
+		labels = append(labels, l)
+	}
+	v.mu.RUnlock()
+	sort.Strings(labels)
+
+	for _, l := range labels {
+		v.mu.RLock()
+		c := v.counters[l]
+		v.mu.RUnlock()
+		if _, err := fmt.Fprintf(w, "%s_total{%s} %d\n", v.name, l, c.value.Load()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelEscaper escapes label values, OpenMetrics only has escapes for
+// backslashes, double quotes and line feeds.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quote returns value as a quoted label value.
+func quote(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// HistogramVec is a family of histograms with one label.
+type HistogramVec struct {
+	name, help, label string
+	buckets           []float64
+
+	mu         sync.RWMutex
+	histograms map[string]*Histogram
+}
+
+// With returns the histogram of a label value, created on first use.
+func (v *HistogramVec) With(value string) *Histogram {
+	v.mu.RLock()
+	h := v.histograms[value]
+	v.mu.RUnlock()
+	if h != nil {
+		return h
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h = v.histograms[value]; h == nil {
+		h = &Histogram{
+			bounds:    v.buckets,
+			counts:    make([]atomic.Uint64, len(v.buckets)+1),
+			exemplars: make([]exemplar, len(v.buckets)+1),
+		}
+		v.histograms[value] = h
+	}
+	return h
+}
+
+func (v *HistogramVec) write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n# HELP %s %s\n", v.name, v.name, v.help); err != nil {
+		return err
+	}
+
+	v.mu.RLock()
+	values := make([]string, 0, len(v.histograms))
+	for value := range v.histograms {
+		values = append(values, value)
+	}
+	v.mu.RUnlock()
+	sort.Strings(values)
+
+	for _, value := range values {
+		labels := ""
+		if v.label != "" {
+			labels = v.label + "=" + quote(value) + ","
+		}
+		if err := v.With(value).write(w, v.name, labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts durations in buckets.
+type Histogram struct {
+	bounds []float64 // in seconds, the last bucket is +Inf
+	counts []atomic.Uint64
+	sum    atomic.Int64 // in nanoseconds
+
+	mu        sync.Mutex
+	exemplars []exemplar
+}
+
+// exemplar is the last observation of a bucket that came with a trace ID.
+type exemplar struct {
+	trace uint64
+	value time.Duration
+	time  time.Time
+}
+
+// Observe counts d, observed while handling the query of the given trace
+// ID, or 0 when there is none.
+func (h *Histogram) Observe(d time.Duration, trace uint64) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(h.bounds) && seconds > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+
+	if trace != 0 {
+		h.mu.Lock()
+		h.exemplars[i] = exemplar{trace: trace, value: d, time: time.Now()}
+		h.mu.Unlock()
+	}
+}
+
+// write writes the buckets, with cumulative counts, the sum and the count
+// of h. labels is empty or ends with a comma.
+func (h *Histogram) write(w io.Writer, name string, labels string) error {
+	h.mu.Lock()
+	exemplars := append([]exemplar(nil), h.exemplars...)
+	h.mu.Unlock()
+
+	var total uint64
+	for i := range h.counts {
+		total += h.counts[i].Load()
+		le := math.Inf(1)
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+		line := fmt.Sprintf("%s_bucket{%sle=\"%s\"} %d", name, labels, formatFloat(le), total)
+		if e := exemplars[i]; e.trace != 0 {
+			line += fmt.Sprintf(" # {trace_id=\"%016x\"} %s %s", e.trace, formatFloat(e.value.Seconds()), strconv.FormatFloat(float64(e.time.UnixMilli())/1000, 'f', 3, 64))
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+
+	labels = trimComma(labels)
+	sum := time.Duration(h.sum.Load()).Seconds()
+	_, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", name, labels, formatFloat(sum), name, labels, total)
+	return err
+}
+
+// trimComma turns the labels of a bucket line into those of the sum and
+// count lines.
+func trimComma(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels[:len(labels)-1] + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
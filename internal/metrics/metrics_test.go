@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCounterVecLabels(t *testing.T) {
+	r := NewRegistry()
+	v := r.CounterVec("hits", "Hits.", "source", "rule")
+	v.With(`C:\lists\ads.txt`, "||ads.example^").Inc()
+	v.With("hosts", "bad\nname \"quoted\" é").Inc()
+
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`hits_total{source="C:\\lists\\ads.txt",rule="||ads.example^"} 1`,
+		`hits_total{source="hosts",rule="bad\nname \"quoted\" é"} 1`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("%s missing from\n%s", want, b.String())
+		}
+	}
+}
+
+func TestCounterVecLimit(t *testing.T) {
+	r := NewRegistry()
+	v := r.CounterVec("hits", "Hits.", "rule").Limit(3, "other")
+	for _, rule := range []string{"a", "b", "c", "d", "a", "other"} {
+		v.With(rule).Inc()
+	}
+
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "# TYPE hits counter\n# HELP hits Hits.\n" +
+		"hits_total{rule=\"a\"} 2\nhits_total{rule=\"b\"} 1\nhits_total{rule=\"other\"} 3\n# EOF\n"
+	if b.String() != want {
+		t.Errorf("got\n%swant\n%s", b.String(), want)
+	}
+}
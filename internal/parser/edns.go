@@ -0,0 +1,124 @@
+package parser
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// EDNS option codes, see https://datatracker.ietf.org/doc/html/rfc6891
+const (
+	OptionClientSubnet  uint16 = 8
+	OptionExtendedError uint16 = 15
+)
+
+type Option struct {
+	Code uint16
+	Data []byte
+}
+
+// OPT returns the OPT pseudo record of the message, if it has one.
+func (p Payload) OPT() (Resource, bool) {
+	for _, rr := range p.Additionals {
+		if rr.RType == TypeOPT {
+			return rr, true
+		}
+	}
+	return Resource{}, false
+}
+
+// Options decodes the options carried in the rdata of an OPT record.
+// A truncated trailing option is ignored.
+func Options(opt Resource) []Option {
+	var options []Option
+	data := opt.RData
+	for len(data) >= 4 {
+		code := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+length {
+			break
+		}
+		options = append(options, Option{Code: code, Data: data[4 : 4+length]})
+		data = data[4+length:]
+	}
+	return options
+}
+
+// SetOption adds o to the OPT record of the message, creating the record
+// if the message has none. An existing option with the same code is replaced.
+func (p *Payload) SetOption(o Option) {
+	index := -1
+	for i, rr := range p.Additionals {
+		if rr.RType == TypeOPT {
+			index = i
+		}
+	}
+	if index < 0 {
+		p.Additionals = append(p.Additionals, Resource{RType: TypeOPT, RClass: 1232})
+		index = len(p.Additionals) - 1
+	}
+
+	var rdata []byte
+	for _, existing := range Options(p.Additionals[index]) {
+		if existing.Code != o.Code {
+			rdata = appendOption(rdata, existing)
+		}
+	}
+	p.Additionals[index].RData = appendOption(rdata, o)
+}
+
+func appendOption(rdata []byte, o Option) []byte {
+	rdata = binary.BigEndian.AppendUint16(rdata, o.Code)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(o.Data)))
+	return append(rdata, o.Data...)
+}
+
+// AppendOPT appends an OPT record without options advertising size as
+// payload size. The caller accounts for it in the header.
+func AppendOPT(dst []byte, size uint16) []byte {
+	dst = append(dst, 0) // root name
+	dst = binary.BigEndian.AppendUint16(dst, TypeOPT)
+	dst = binary.BigEndian.AppendUint16(dst, size)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	return binary.BigEndian.AppendUint16(dst, 0)
+}
+
+// ExtendedError returns an Extended DNS Error option, see
+// https://datatracker.ietf.org/doc/html/rfc8914
+func ExtendedError(infoCode uint16, extraText string) Option {
+	data := binary.BigEndian.AppendUint16(nil, infoCode)
+	return Option{Code: OptionExtendedError, Data: append(data, extraText...)}
+}
+
+// ClientSubnet returns the EDNS Client Subnet carried by the message, see
+// https://datatracker.ietf.org/doc/html/rfc7871#section-6
+func ClientSubnet(p Payload) (*net.IPNet, bool) {
+	opt, ok := p.OPT()
+	if !ok {
+		return nil, false
+	}
+	for _, o := range Options(opt) {
+		if o.Code != OptionClientSubnet || len(o.Data) < 4 {
+			continue
+		}
+		family := binary.BigEndian.Uint16(o.Data[0:2])
+		prefix := int(o.Data[2])
+		address := o.Data[4:]
+
+		var ip net.IP
+		switch family {
+		case 1:
+			ip = make(net.IP, net.IPv4len)
+		case 2:
+			ip = make(net.IP, net.IPv6len)
+		default:
+			return nil, false
+		}
+		if prefix > len(ip)*8 || len(address) > len(ip) {
+			return nil, false
+		}
+		copy(ip, address)
+		mask := net.CIDRMask(prefix, len(ip)*8)
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,69 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+)
+
+var typeNames = map[uint16]string{
+	TypeA:     "A",
+	TypeNS:    "NS",
+	typeMD:    "MD",
+	typeMF:    "MF",
+	TypeCNAME: "CNAME",
+	TypeSOA:   "SOA",
+	typeMB:    "MB",
+	typeMG:    "MG",
+	typeMR:    "MR",
+	TypePTR:   "PTR",
+	TypeHINFO: "HINFO",
+	typeMINFO: "MINFO",
+	TypeMX:    "MX",
+	TypeTXT:   "TXT",
+	TypeAAAA:  "AAAA",
+	TypeOPT:   "OPT",
+	TypeRRSIG: "RRSIG",
+	TypeANY:   "ANY",
+}
+
+var rcodeNames = map[uint16]string{
+	RcodeNoError:  "NOERROR",
+	RcodeFormErr:  "FORMERR",
+	RcodeServFail: "SERVFAIL",
+	RcodeNXDomain: "NXDOMAIN",
+	RcodeNotImp:   "NOTIMP",
+	RcodeRefused:  "REFUSED",
+}
+
+// TypeString returns the mnemonic of a record type, or the generic TYPEnnn
+// form for types without one.
+func TypeString(t uint16) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// ParseType returns the record type named by a mnemonic or the generic
+// TYPEnnn form, regardless of case.
+func ParseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for t, name := range typeNames {
+		if name == s {
+			return t, true
+		}
+	}
+	if digits, ok := strings.CutPrefix(s, "TYPE"); ok {
+		t, err := strconv.ParseUint(digits, 10, 16)
+		return uint16(t), err == nil
+	}
+	return 0, false
+}
+
+// RcodeString returns the mnemonic of a response code.
+func RcodeString(rcode uint16) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(int(rcode))
+}
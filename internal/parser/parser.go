@@ -38,6 +38,60 @@ type Payload struct {
 	Additionals []Resource
 }
 
+// Record types handled by the resolver, see
+// https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-4
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeHINFO uint16 = 13
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeOPT   uint16 = 41
+	TypeRRSIG uint16 = 46
+	TypeANY   uint16 = 255
+
+	ClassIN uint16 = 1
+)
+
+// Obsolete types of RFC 1035 whose rdata names may be compressed, decoded
+// only to be passed on, see
+// https://datatracker.ietf.org/doc/html/rfc3597#section-4
+const (
+	typeMD    uint16 = 3
+	typeMF    uint16 = 4
+	typeMB    uint16 = 7
+	typeMG    uint16 = 8
+	typeMR    uint16 = 9
+	typeMINFO uint16 = 14
+)
+
+// Header flags and response codes, see
+// https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.1
+const (
+	FlagQR uint16 = 1 << 15 // message is a response
+	FlagAA uint16 = 1 << 10 // authoritative answer
+	FlagTC uint16 = 1 << 9  // message was truncated
+	FlagRD uint16 = 1 << 8  // recursion desired
+	FlagRA uint16 = 1 << 7  // recursion available
+	// DNSSEC bits, see https://datatracker.ietf.org/doc/html/rfc4035#section-3.2
+	FlagAD uint16 = 1 << 5 // authentic data
+	FlagCD uint16 = 1 << 4 // checking disabled
+
+	OpcodeMask uint16 = 0xF << 11
+
+	RcodeMask     uint16 = 0xF
+	RcodeNoError  uint16 = 0
+	RcodeFormErr  uint16 = 1
+	RcodeServFail uint16 = 2
+	RcodeNXDomain uint16 = 3
+	RcodeNotImp   uint16 = 4
+	RcodeRefused  uint16 = 5
+)
+
 // Using network byte order, which is big endian, see
 // https://datatracker.ietf.org/doc/html/rfc1035#section-2.3.2
 
@@ -52,11 +106,20 @@ func parseHeader(buffer []byte) Header {
 	}
 }
 
-func parseResource(buffer []byte, offset int) (Resource, int) {
+var errTruncated = errors.New("message is truncated")
+
+func parseResource(buffer []byte, offset int) (Resource, int, error) {
 	// Parse RNAME
-	rname, n := parseDomainName(buffer, offset)
+	rname, n, err := parseDomainName(buffer, offset)
+	if err != nil {
+		return Resource{}, offset, err
+	}
 	offset += n
 
+	if len(buffer) < offset+10 {
+		return Resource{}, offset, errTruncated
+	}
+
 	// Parse RTYPE
 	rtype := binary.BigEndian.Uint16(buffer[offset : offset+2])
 	offset += 2
@@ -74,27 +137,102 @@ func parseResource(buffer []byte, offset int) (Resource, int) {
 	rdlen := binary.BigEndian.Uint16(buffer[offset : offset+2])
 	offset += 2
 
-	var rddata []byte
+	if len(buffer) < offset+int(rdlen) {
+		return Resource{}, offset, errTruncated
+	}
 
-	// NS record
-	if rtype == 2 && rclass == 1 {
-		rdataBuffer := buffer[offset : offset+int(rdlen)]
-		domainName, _ := parseDomainName(rdataBuffer, 0)
-		rddata = []byte(domainName)
-	} else {
-		rddata = buffer[offset : offset+int(rdlen)]
+	rddata, err := parseRData(buffer, offset, rtype, rdlen)
+	if err != nil {
+		return Resource{}, offset, err
 	}
 	offset += int(rdlen)
 
-	return Resource{RName: rname, RType: rtype, RClass: rclass, RTtl: rttl, RDlength: rdlen, RData: rddata}, offset
+	return Resource{RName: rname, RType: rtype, RClass: rclass, RTtl: rttl, RDlength: rdlen, RData: rddata}, offset, nil
+}
+
+// parseRData extracts the rdata at offset. Names inside rdata may be
+// compressed against the whole message, so they are expanded here: NS, CNAME
+// and PTR records hold the domain name itself, MX, SOA and the obsolete
+// types of RFC 1035 keep their wire format with uncompressed names. Other
+// types, known or not, are copied as is: their rdata is never compressed,
+// see https://datatracker.ietf.org/doc/html/rfc3597#section-4
+func parseRData(buffer []byte, offset int, rtype uint16, rdlen uint16) ([]byte, error) {
+	end := offset + int(rdlen)
+
+	switch rtype {
+	case TypeNS, TypeCNAME, TypePTR:
+		domainName, _, err := parseDomainName(buffer[:end], offset)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(domainName), nil
+	case TypeMX:
+		if rdlen < 3 {
+			return nil, errTruncated
+		}
+		exchange, _, err := parseDomainName(buffer[:end], offset+2)
+		if err != nil {
+			return nil, err
+		}
+		rddata := append([]byte{}, buffer[offset:offset+2]...)
+		return append(rddata, PackName(exchange)...), nil
+	case typeMD, typeMF, typeMB, typeMG, typeMR:
+		name, n, err := parseDomainName(buffer[:end], offset)
+		if err != nil {
+			return nil, err
+		}
+		if n != int(rdlen) {
+			return nil, errTruncated
+		}
+		return PackName(name), nil
+	case typeMINFO:
+		rmailbx, n, err := parseDomainName(buffer[:end], offset)
+		if err != nil {
+			return nil, err
+		}
+		emailbx, m, err := parseDomainName(buffer[:end], offset+n)
+		if err != nil {
+			return nil, err
+		}
+		if n+m != int(rdlen) {
+			return nil, errTruncated
+		}
+		return append(PackName(rmailbx), PackName(emailbx)...), nil
+	case TypeSOA:
+		mname, n, err := parseDomainName(buffer[:end], offset)
+		if err != nil {
+			return nil, err
+		}
+		rname, m, err := parseDomainName(buffer[:end], offset+n)
+		if err != nil {
+			return nil, err
+		}
+		// serial, refresh, retry, expire and minimum
+		if end-(offset+n+m) != 20 {
+			return nil, errTruncated
+		}
+		rddata := append(PackName(mname), PackName(rname)...)
+		return append(rddata, buffer[offset+n+m:end]...), nil
+	}
+
+	rddata := make([]byte, rdlen)
+	copy(rddata, buffer[offset:end])
+	return rddata, nil
 }
 
 // parseQuestion parses the question section of a DNS message
-func parseQuestion(buffer []byte, offset int) (Question, int) {
+func parseQuestion(buffer []byte, offset int) (Question, int, error) {
 	// Parse QNAME
-	qname, n := parseDomainName(buffer, offset)
+	qname, n, err := parseDomainName(buffer, offset)
+	if err != nil {
+		return Question{}, offset, err
+	}
 	offset += n
 
+	if len(buffer) < offset+4 {
+		return Question{}, offset, errTruncated
+	}
+
 	// Parse QTYPE
 	qtype := binary.BigEndian.Uint16(buffer[offset : offset+2])
 	offset += 2
@@ -103,89 +241,132 @@ func parseQuestion(buffer []byte, offset int) (Question, int) {
 	qclass := binary.BigEndian.Uint16(buffer[offset : offset+2])
 	offset += 2
 
-	return Question{QName: qname, QType: qtype, QClass: qclass}, offset
+	return Question{QName: qname, QType: qtype, QClass: qclass}, offset, nil
 }
 
 // https://cabulous.medium.com/dns-message-how-to-read-query-and-response-message-cfebcb4fe817
 // It handles normal labels and compressed labels.
-func parseDomainName(buffer []byte, offset int) (qname string, n int) {
+func parseDomainName(buffer []byte, offset int) (qname string, n int, err error) {
 	labels := ""
 	startOff := offset
 
 	for {
-			len := int(buffer[startOff])
-		// length 192 denotes a pointer to a previous seen domain name, use next octet to get length of domain inside buffer pointer to previous seen messages
+		if startOff >= len(buffer) {
+			return "", 0, errTruncated
+		}
+		length := int(buffer[startOff])
+		// a length with the two high bits set (192) denotes a pointer to a previous seen domain name,
+		// the remaining 14 bits give the offset of that name inside the buffer
 
-		if len == 192 {
-			label, _ := parseDomainName(buffer, int(buffer[startOff+1]))
+		if length&0xC0 == 0xC0 {
+			if startOff+2 > len(buffer) {
+				return "", 0, errTruncated
+			}
+			pointer := int(binary.BigEndian.Uint16(buffer[startOff:startOff+2]) & 0x3FFF)
+			// pointers only go backwards, anything else could loop forever
+			if pointer >= startOff {
+				return "", 0, errors.New("domain name pointer does not point backwards")
+			}
+			label, _, err := parseDomainName(buffer, pointer)
+			if err != nil {
+				return "", 0, err
+			}
+			if labels != "" && label != "" {
+				labels += "."
+			}
 			labels += label
 			// jump over pointer and offset
 			startOff += 2
 			break
-		} else {
-			label := string(buffer[startOff+1 : startOff+1+len])
-			startOff += len + 1
-			if buffer[len] == 0 {
-				labels += label
-				startOff++
-				break
-			} else {
-				labels += label + "."
-			}
 		}
+		startOff++
+		// zero length label is the root and terminates the name
+		if length == 0 {
+			break
+		}
+		if startOff+length > len(buffer) {
+			return "", 0, errTruncated
+		}
+		if labels != "" {
+			labels += "."
+		}
+		labels += string(buffer[startOff : startOff+length])
+		startOff += length
 	}
 	qname = labels
 	n = startOff - offset
 	return
 }
 
-func Read(buffer []byte, n int) (Payload, error) {
-
+// Parse decodes a whole DNS message.
+func Parse(buffer []byte) (Payload, error) {
 	var payload Payload
 
-	// Print each byte in hexadecimal and decimal format
-	for i, b := range buffer[:n] {
-		fmt.Printf("Byte %d: %02x (Hex) | %d (Dec)\n", i, b, b)
-	}
-
 	if len(buffer) < 12 {
 		err := errors.New("message Header does not meet the minimun required length")
 		return payload, err
 	}
 
 	payload.Header = parseHeader(buffer[:12])
-	fmt.Printf("Header: %+v\n", payload.Header)
 
 	index := 12
 	var i uint16
-	for i = 0; i < uint16(payload.Header.QdCount); i++ {
-		q, newIndex := parseQuestion(buffer, index)
+	for i = 0; i < payload.Header.QdCount; i++ {
+		q, newIndex, err := parseQuestion(buffer, index)
+		if err != nil {
+			return payload, fmt.Errorf("question %d: %w", i, err)
+		}
 		index = newIndex
 		payload.Questions = append(payload.Questions, q)
 	}
 
-	for i = 0; i < uint16(payload.Header.AnCount); i++ {
-		answer, newIndex := parseResource(buffer, index)
-		index = newIndex
-		payload.Answers = append(payload.Answers, answer)
+	sections := []struct {
+		name  string
+		count uint16
+		rrs   *[]Resource
+	}{
+		{"answer", payload.Header.AnCount, &payload.Answers},
+		{"authority", payload.Header.NsCount, &payload.Authorities},
+		{"additional", payload.Header.ArCount, &payload.Additionals},
 	}
+	for _, section := range sections {
+		for i = 0; i < section.count; i++ {
+			rr, newIndex, err := parseResource(buffer, index)
+			if err != nil {
+				return payload, fmt.Errorf("%s %d: %w", section.name, i, err)
+			}
+			index = newIndex
+			*section.rrs = append(*section.rrs, rr)
+		}
+	}
+	return payload, nil
+}
 
-	for i = 0; i < uint16(payload.Header.NsCount); i++ {
-		authority, newIndex := parseResource(buffer, index)
-		index = newIndex
-		payload.Authorities = append(payload.Authorities, authority)
+// Read parses the first n bytes of buffer, printing the message along the way.
+func Read(buffer []byte, n int) (Payload, error) {
+
+	// Print each byte in hexadecimal and decimal format
+	for i, b := range buffer[:n] {
+		fmt.Printf("Byte %d: %02x (Hex) | %d (Dec)\n", i, b, b)
 	}
 
-	for i = 0; i < uint16(payload.Header.ArCount); i++ {
-		additional, newIndex := parseResource(buffer, index)
-		index = newIndex
-		payload.Additionals = append(payload.Additionals, additional)
+	payload, err := Parse(buffer[:n])
+	if err != nil {
+		return payload, err
+	}
+
+	fmt.Printf("Header: %+v\n", payload.Header)
+	for _, q := range payload.Questions {
+		fmt.Printf("Question: %s\n", q)
+	}
+	for _, rr := range payload.Answers {
+		fmt.Printf("Answer: %s\n", rr)
 	}
-	for _, b := range payload.Questions {
-		fmt.Printf("Questions :%+v\n", b)
+	for _, rr := range payload.Authorities {
+		fmt.Printf("Authority: %s\n", rr)
 	}
-	for _, b := range payload.Answers {
-		fmt.Printf("Answers :%+v\n", b)
+	for _, rr := range payload.Additionals {
+		fmt.Printf("Additional: %s\n", rr)
 	}
 	return payload, nil
 }
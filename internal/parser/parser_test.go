@@ -0,0 +1,113 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// answer returns a response for example.com with a single answer of type
+// rtype, its owner compressed against the question as Pack writes it.
+func answer(rtype uint16, rdata []byte) []byte {
+	msg := []byte{0xbe, 0xef, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0}
+	msg = append(msg, PackName("example.com")...)
+	msg = binary.BigEndian.AppendUint16(msg, rtype)
+	msg = binary.BigEndian.AppendUint16(msg, ClassIN)
+	msg = append(msg, 0xc0, 12)
+	msg = binary.BigEndian.AppendUint16(msg, rtype)
+	msg = binary.BigEndian.AppendUint16(msg, ClassIN)
+	msg = binary.BigEndian.AppendUint32(msg, 300)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	return append(msg, rdata...)
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		rtype uint16
+		rdata []byte
+		text  string
+	}{
+		{"unknown type", 65534, []byte{0x0a, 0x0b, 0x0c}, `example.com. 300 IN TYPE65534 \# 3 0a0b0c`},
+		{"unknown type without rdata", 65534, nil, `example.com. 300 IN TYPE65534 \# 0`},
+		{"A of the wrong length", TypeA, []byte{192, 0, 2}, `example.com. 300 IN A \# 3 c00002`},
+		{"MB", typeMB, PackName("mail.example.com"), "example.com. 300 IN MB mail.example.com."},
+		{
+			"MINFO",
+			typeMINFO,
+			append(PackName("admin.example.com"), PackName("errors.example.com")...),
+			"example.com. 300 IN MINFO admin.example.com. errors.example.com.",
+		},
+		{"MINFO with root names", typeMINFO, []byte{0, 0}, "example.com. 300 IN MINFO . ."},
+	}
+	for _, tt := range tests {
+		msg := answer(tt.rtype, tt.rdata)
+		p, err := Parse(msg)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(p.Answers) != 1 {
+			t.Errorf("%s: %d answers", tt.name, len(p.Answers))
+			continue
+		}
+		if s := p.Answers[0].String(); s != tt.text {
+			t.Errorf("%s: %q, want %q", tt.name, s, tt.text)
+		}
+		packed, err := Pack(p)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(packed, msg) {
+			t.Errorf("%s: packed to %x, want %x", tt.name, packed, msg)
+		}
+	}
+}
+
+func TestParseCompressedMailNames(t *testing.T) {
+	// Names in MB and MINFO rdata may point back into the message,
+	// Parse expands them so the rdata stands on its own
+	tests := []struct {
+		name  string
+		rtype uint16
+		rdata []byte
+		want  []byte
+	}{
+		{"MB", typeMB, []byte{4, 'm', 'a', 'i', 'l', 0xc0, 12}, PackName("mail.example.com")},
+		{
+			"MINFO",
+			typeMINFO,
+			[]byte{5, 'a', 'd', 'm', 'i', 'n', 0xc0, 12, 0xc0, 12},
+			append(PackName("admin.example.com"), PackName("example.com")...),
+		},
+	}
+	for _, tt := range tests {
+		p, err := Parse(answer(tt.rtype, tt.rdata))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := p.Answers[0].RData; !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: rdata %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseMailNamesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rtype uint16
+		rdata []byte
+	}{
+		{"MB with trailing bytes", typeMB, append(PackName("mail.example.com"), 1)},
+		{"MB past rdata", typeMB, []byte{4, 'm', 'a', 'i'}},
+		{"MINFO with one name", typeMINFO, PackName("admin.example.com")},
+		{"MINFO with trailing bytes", typeMINFO, []byte{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(answer(tt.rtype, tt.rdata)); err == nil {
+			t.Errorf("%s: parsed", tt.name)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package parser
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var classNames = map[uint16]string{
+	ClassIN: "IN",
+	3:       "CH",
+	4:       "HS",
+}
+
+// ClassString returns the mnemonic of a class, or the generic CLASSnnn
+// form for classes without one.
+func ClassString(c uint16) string {
+	if name, ok := classNames[c]; ok {
+		return name
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+// String returns the question in presentation format.
+func (q Question) String() string {
+	return fqdn(q.QName) + " " + ClassString(q.QClass) + " " + TypeString(q.QType)
+}
+
+// String returns the record in the presentation format of zone files, see
+// https://datatracker.ietf.org/doc/html/rfc1035#section-5.1
+// Records of types without a known format, or whose rdata does not fit it,
+// use the generic format for unknown records, e.g.
+//
+//	example.com. 300 IN TYPE65534 \# 3 0a0b0c
+//
+// see https://datatracker.ietf.org/doc/html/rfc3597#section-5
+func (r Resource) String() string {
+	return fmt.Sprintf("%s %d %s %s %s", fqdn(r.RName), r.RTtl, ClassString(r.RClass), TypeString(r.RType), r.RDataString())
+}
+
+// RDataString returns the rdata part of String.
+func (r Resource) RDataString() string {
+	if rdata, ok := r.rdataString(); ok {
+		return rdata
+	}
+	return GenericRData(r.RData)
+}
+
+// GenericRData returns rdata in the generic format of RFC 3597.
+func GenericRData(rdata []byte) string {
+	if len(rdata) == 0 {
+		return `\# 0`
+	}
+	return `\# ` + strconv.Itoa(len(rdata)) + " " + hex.EncodeToString(rdata)
+}
+
+// rdataString returns the rdata in the format of the record type, as
+// decoded by Parse. It reports false for types without a known format and
+// for malformed rdata.
+func (r Resource) rdataString() (string, bool) {
+	if r.RClass != ClassIN && r.RType != TypeCNAME && r.RType != TypePTR && r.RType != TypeNS {
+		// Only IN has well known rdata formats, except for plain names
+		return "", false
+	}
+	switch r.RType {
+	case TypeA:
+		if len(r.RData) == net.IPv4len {
+			return net.IP(r.RData).String(), true
+		}
+	case TypeAAAA:
+		if len(r.RData) == net.IPv6len {
+			return net.IP(r.RData).String(), true
+		}
+	case TypeNS, TypeCNAME, TypePTR:
+		return fqdn(string(r.RData)), true
+	case typeMD, typeMF, typeMB, typeMG, typeMR:
+		return wireNames(r.RData, 1, 0)
+	case typeMINFO:
+		return wireNames(r.RData, 2, 0)
+	case TypeMX:
+		if len(r.RData) < 3 {
+			return "", false
+		}
+		exchange, ok := wireNames(r.RData[2:], 1, 0)
+		return strconv.Itoa(int(binary.BigEndian.Uint16(r.RData))) + " " + exchange, ok
+	case TypeSOA:
+		return wireNames(r.RData, 2, 5)
+	case TypeTXT, TypeHINFO:
+		var strs []string
+		for rdata := r.RData; len(rdata) > 0; {
+			n := int(rdata[0])
+			if len(rdata) < 1+n {
+				return "", false
+			}
+			strs = append(strs, quote(rdata[1:1+n]))
+			rdata = rdata[1+n:]
+		}
+		if len(strs) == 0 || (r.RType == TypeHINFO && len(strs) != 2) {
+			return "", false
+		}
+		return strings.Join(strs, " "), true
+	}
+	return "", false
+}
+
+// wireNames formats rdata made of names uncompressed names followed by
+// numbers 32 bit integers, and reports whether it is exactly that.
+func wireNames(rdata []byte, names int, numbers int) (string, bool) {
+	fields := make([]string, 0, names+numbers)
+	offset := 0
+	for i := 0; i < names; i++ {
+		if offset < len(rdata) && rdata[offset]&0xC0 != 0 {
+			return "", false
+		}
+		name, n, err := parseDomainName(rdata, offset)
+		if err != nil {
+			return "", false
+		}
+		fields = append(fields, fqdn(name))
+		offset += n
+	}
+	if len(rdata)-offset != 4*numbers {
+		return "", false
+	}
+	for i := 0; i < numbers; i++ {
+		fields = append(fields, strconv.FormatUint(uint64(binary.BigEndian.Uint32(rdata[offset:])), 10))
+		offset += 4
+	}
+	return strings.Join(fields, " "), true
+}
+
+// quote returns s as a quoted character string, escaping quotes,
+// backslashes and non printable bytes.
+func quote(s []byte) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// fqdn returns name with its trailing dot.
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,149 @@
+package parser
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// QuestionView reads a query with a single question straight from its
+// buffer, without allocating. It is enough to route most queries, the full
+// Parse is only needed to look at anything else.
+type QuestionView struct {
+	Msg    []byte
+	ID     uint16
+	Flags  uint16
+	QType  uint16
+	QClass uint16
+	// End is the offset right after the question section.
+	End int
+	// HasOPT and HasClientSubnet tell whether the query uses EDNS and
+	// carries a Client Subnet option. UDPSize is the payload size the
+	// client advertises in its OPT record, DO whether it asks for DNSSEC
+	// records.
+	HasOPT          bool
+	HasClientSubnet bool
+	UDPSize         uint16
+	DO              bool
+
+	nameEnd int
+}
+
+// optFlagDO is the DNSSEC OK bit of the OPT record flags, see
+// https://datatracker.ietf.org/doc/html/rfc3225#section-3
+const optFlagDO = 1 << 15
+
+var errNotSimpleQuery = errors.New("message is not a query with a single question")
+
+// ViewQuestion checks msg is a query with one uncompressed question, and at
+// most an OPT record in its additional section, and returns a view over it.
+func ViewQuestion(msg []byte) (QuestionView, error) {
+	if len(msg) < 12 {
+		return QuestionView{}, errTruncated
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) != 1 || binary.BigEndian.Uint16(msg[6:8]) != 0 ||
+		binary.BigEndian.Uint16(msg[8:10]) != 0 || binary.BigEndian.Uint16(msg[10:12]) > 1 {
+		return QuestionView{}, errNotSimpleQuery
+	}
+
+	v := QuestionView{Msg: msg, ID: binary.BigEndian.Uint16(msg[0:2]), Flags: binary.BigEndian.Uint16(msg[2:4])}
+	offset := 12
+	for {
+		if offset >= len(msg) {
+			return QuestionView{}, errTruncated
+		}
+		length := int(msg[offset])
+		if length&0xC0 != 0 {
+			return QuestionView{}, errNotSimpleQuery
+		}
+		offset += length + 1
+		if length == 0 {
+			break
+		}
+	}
+	v.nameEnd = offset
+	if len(msg) < offset+4 || offset-12 > 255 {
+		return QuestionView{}, errTruncated
+	}
+	v.QType = binary.BigEndian.Uint16(msg[offset : offset+2])
+	v.QClass = binary.BigEndian.Uint16(msg[offset+2 : offset+4])
+	v.End = offset + 4
+
+	if binary.BigEndian.Uint16(msg[10:12]) == 1 {
+		// The OPT record: root name, type, class, ttl and rdlength
+		offset = v.End
+		if len(msg) < offset+11 || msg[offset] != 0 || binary.BigEndian.Uint16(msg[offset+1:offset+3]) != TypeOPT {
+			return QuestionView{}, errNotSimpleQuery
+		}
+		rdlen := int(binary.BigEndian.Uint16(msg[offset+9 : offset+11]))
+		rdata := msg[offset+11:]
+		if len(rdata) < rdlen {
+			return QuestionView{}, errTruncated
+		}
+		v.HasOPT = true
+		v.UDPSize = binary.BigEndian.Uint16(msg[offset+3 : offset+5])
+		// The TTL holds the extended rcode, the version and the flags
+		v.DO = binary.BigEndian.Uint16(msg[offset+7:offset+9])&optFlagDO != 0
+		for rdata = rdata[:rdlen]; len(rdata) >= 4; {
+			code := binary.BigEndian.Uint16(rdata[0:2])
+			length := int(binary.BigEndian.Uint16(rdata[2:4]))
+			if code == OptionClientSubnet {
+				v.HasClientSubnet = true
+			}
+			if len(rdata) < 4+length {
+				break
+			}
+			rdata = rdata[4+length:]
+		}
+	}
+	return v, nil
+}
+
+// WireName returns the question name in wire format, as sent by the client.
+func (v QuestionView) WireName() []byte {
+	return v.Msg[12:v.nameEnd]
+}
+
+// AppendName appends the lowercased question name, in dotted form without
+// trailing dot, to dst.
+func (v QuestionView) AppendName(dst []byte) []byte {
+	name := v.WireName()
+	for len(name) > 1 {
+		length := int(name[0])
+		if len(dst) > 0 && dst[len(dst)-1] != '.' {
+			dst = append(dst, '.')
+		}
+		for _, c := range name[1 : 1+length] {
+			dst = append(dst, lower(c))
+		}
+		name = name[1+length:]
+	}
+	return dst
+}
+
+// AppendKey appends a key identifying the question regardless of case: the
+// lowercased wire name followed by type and class, and the DO and CD bits,
+// since answers with or without DNSSEC records, validated or not, differ.
+func (v QuestionView) AppendKey(dst []byte) []byte {
+	for _, c := range v.WireName() {
+		dst = append(dst, lower(c))
+	}
+	dst = binary.BigEndian.AppendUint16(dst, v.QType)
+	dst = binary.BigEndian.AppendUint16(dst, v.QClass)
+	var bits byte
+	if v.DO {
+		bits |= 1
+	}
+	if v.Flags&FlagCD != 0 {
+		bits |= 2
+	}
+	return append(dst, bits)
+}
+
+// lower lowercases an ASCII letter. Label length octets are below 64 so
+// they are never mistaken for uppercase letters.
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
@@ -0,0 +1,50 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAppendKeyDNSSECBits(t *testing.T) {
+	query := func(name string, flags uint16, edns bool, do bool) []byte {
+		p := Payload{
+			Header:    Header{ID: 1, Flags: FlagRD | flags},
+			Questions: []Question{{QName: name, QType: TypeA, QClass: ClassIN}},
+		}
+		if edns {
+			var ttl uint32
+			if do {
+				ttl = optFlagDO
+			}
+			p.Additionals = []Resource{{RType: TypeOPT, RClass: 1232, RTtl: ttl}}
+		}
+		msg, err := Pack(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	key := func(msg []byte) []byte {
+		v, err := ViewQuestion(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.AppendKey(nil)
+	}
+
+	plain := key(query("example.com", 0, false, false))
+	if !bytes.Equal(plain, key(query("EXAMPLE.com", 0, true, false))) {
+		t.Error("keys differ by case or by EDNS without DO")
+	}
+	do := key(query("example.com", 0, true, true))
+	cd := key(query("example.com", FlagCD, false, false))
+	doCD := key(query("example.com", FlagCD, true, true))
+	for _, k := range [][]byte{do, cd, doCD} {
+		if bytes.Equal(plain, k) {
+			t.Errorf("key %x is the same as without DO and CD", k)
+		}
+	}
+	if bytes.Equal(do, cd) || bytes.Equal(do, doCD) || bytes.Equal(cd, doCD) {
+		t.Error("DO and CD keys collide")
+	}
+}
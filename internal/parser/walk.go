@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"encoding/binary"
+)
+
+// Sections of a message
+const (
+	SectionAnswer = iota + 1
+	SectionAuthority
+	SectionAdditional
+)
+
+// RecordView locates a resource record inside a message without decoding
+// its names.
+type RecordView struct {
+	Section int
+	// Start is the offset of the owner name and TTLOffset the one of the
+	// TTL field, so it can be updated in place.
+	Start     int
+	TTLOffset int
+	Type      uint16
+	Class     uint16
+	TTL       uint32
+	RData     []byte
+}
+
+// WalkRecords calls fn with every resource record of msg, in order. It
+// returns an error if the message is malformed.
+func WalkRecords(msg []byte, fn func(rr RecordView)) error {
+	if len(msg) < 12 {
+		return errTruncated
+	}
+	offset := 12
+	var err error
+	for i := binary.BigEndian.Uint16(msg[4:6]); i > 0; i-- {
+		if offset, err = skipName(msg, offset); err != nil {
+			return err
+		}
+		offset += 4
+	}
+
+	counts := [3]uint16{
+		binary.BigEndian.Uint16(msg[6:8]),
+		binary.BigEndian.Uint16(msg[8:10]),
+		binary.BigEndian.Uint16(msg[10:12]),
+	}
+	for section, count := range counts {
+		for ; count > 0; count-- {
+			rr := RecordView{Section: section + 1, Start: offset}
+			if offset, err = skipName(msg, offset); err != nil {
+				return err
+			}
+			if len(msg) < offset+10 {
+				return errTruncated
+			}
+			rr.Type = binary.BigEndian.Uint16(msg[offset : offset+2])
+			rr.Class = binary.BigEndian.Uint16(msg[offset+2 : offset+4])
+			rr.TTLOffset = offset + 4
+			rr.TTL = binary.BigEndian.Uint32(msg[offset+4 : offset+8])
+			rdlen := int(binary.BigEndian.Uint16(msg[offset+8 : offset+10]))
+			offset += 10
+			if len(msg) < offset+rdlen {
+				return errTruncated
+			}
+			rr.RData = msg[offset : offset+rdlen]
+			offset += rdlen
+			fn(rr)
+		}
+	}
+	if offset > len(msg) {
+		return errTruncated
+	}
+	return nil
+}
+
+// skipName returns the offset right after the name at offset.
+func skipName(msg []byte, offset int) (int, error) {
+	for {
+		if offset >= len(msg) {
+			return 0, errTruncated
+		}
+		length := int(msg[offset])
+		if length&0xC0 == 0xC0 {
+			return offset + 2, nil
+		}
+		offset += length + 1
+		if length == 0 {
+			return offset, nil
+		}
+	}
+}
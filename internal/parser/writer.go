@@ -0,0 +1,102 @@
+package parser
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Pack encodes a payload into a DNS message. Section counts are taken from
+// the slices rather than the header, and names are compressed.
+func Pack(payload Payload) ([]byte, error) {
+	buffer := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(buffer[0:2], payload.Header.ID)
+	binary.BigEndian.PutUint16(buffer[2:4], payload.Header.Flags)
+	binary.BigEndian.PutUint16(buffer[4:6], uint16(len(payload.Questions)))
+	binary.BigEndian.PutUint16(buffer[6:8], uint16(len(payload.Answers)))
+	binary.BigEndian.PutUint16(buffer[8:10], uint16(len(payload.Authorities)))
+	binary.BigEndian.PutUint16(buffer[10:12], uint16(len(payload.Additionals)))
+
+	compression := map[string]int{}
+	var err error
+
+	for _, q := range payload.Questions {
+		if buffer, err = appendName(buffer, q.QName, compression); err != nil {
+			return nil, err
+		}
+		buffer = binary.BigEndian.AppendUint16(buffer, q.QType)
+		buffer = binary.BigEndian.AppendUint16(buffer, q.QClass)
+	}
+
+	for _, section := range [][]Resource{payload.Answers, payload.Authorities, payload.Additionals} {
+		for _, rr := range section {
+			if buffer, err = appendResource(buffer, rr, compression); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buffer, nil
+}
+
+func appendResource(buffer []byte, rr Resource, compression map[string]int) ([]byte, error) {
+	buffer, err := appendName(buffer, rr.RName, compression)
+	if err != nil {
+		return nil, err
+	}
+	buffer = binary.BigEndian.AppendUint16(buffer, rr.RType)
+	buffer = binary.BigEndian.AppendUint16(buffer, rr.RClass)
+	buffer = binary.BigEndian.AppendUint32(buffer, rr.RTtl)
+
+	// RDLENGTH is patched once rdata is written
+	lengthOff := len(buffer)
+	buffer = append(buffer, 0, 0)
+
+	switch rr.RType {
+	case TypeNS, TypeCNAME, TypePTR:
+		if buffer, err = appendName(buffer, string(rr.RData), compression); err != nil {
+			return nil, err
+		}
+	default:
+		buffer = append(buffer, rr.RData...)
+	}
+
+	rdlen := len(buffer) - lengthOff - 2
+	if rdlen > 0xFFFF {
+		return nil, errors.New("rdata is too long")
+	}
+	binary.BigEndian.PutUint16(buffer[lengthOff:], uint16(rdlen))
+	return buffer, nil
+}
+
+// appendName writes name, reusing any suffix already present in the message
+// through a compression pointer.
+func appendName(buffer []byte, name string, compression map[string]int) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	for name != "" {
+		if off, ok := compression[name]; ok {
+			return binary.BigEndian.AppendUint16(buffer, 0xC000|uint16(off)), nil
+		}
+		// pointers only have 14 bits for the offset
+		if len(buffer) <= 0x3FFF {
+			compression[name] = len(buffer)
+		}
+
+		label, rest, _ := strings.Cut(name, ".")
+		if label == "" || len(label) > 63 {
+			return nil, errors.New("invalid label in domain name " + name)
+		}
+		buffer = append(buffer, byte(len(label)))
+		buffer = append(buffer, label...)
+		name = rest
+	}
+	return append(buffer, 0), nil
+}
+
+// PackName returns the uncompressed wire format of name.
+func PackName(name string) []byte {
+	buffer, err := appendName(nil, name, map[string]int{})
+	if err != nil {
+		return []byte{0}
+	}
+	return buffer
+}
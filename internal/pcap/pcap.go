@@ -0,0 +1,180 @@
+// Package pcap reads the UDP datagrams of capture files in the classic
+// libpcap format, as written by tcpdump -w, see
+// https://datatracker.ietf.org/doc/html/draft-ietf-opsawg-pcap
+// The newer pcapng format is not supported.
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// Link types of the captured packets, see
+// https://www.tcpdump.org/linktypes.html
+const (
+	linkNull     = 0   // BSD loopback, host byte order address family
+	linkEthernet = 1   // Ethernet II
+	linkRaw      = 101 // raw IPv4 or IPv6
+	linkLinuxSLL = 113 // Linux cooked capture, tcpdump -i any
+)
+
+const (
+	protoUDP = 17
+
+	// maxSnapLen is the largest packet accepted whatever the snapshot
+	// length of the capture says, the default and largest one of tcpdump.
+	maxSnapLen = 262144
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+	etherTypeVLAN = 0x8100
+)
+
+// Datagram is a UDP datagram found in a capture.
+type Datagram struct {
+	Index   int // of the packet in the capture, from 1 as in tcpdump -r
+	Time    time.Time
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	Payload []byte
+}
+
+// ReadUDP returns the UDP datagrams of a capture. Other packets, and
+// fragmented or truncated datagrams, are skipped.
+func ReadUDP(r io.Reader) ([]Datagram, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("reading capture header: %w", err)
+	}
+
+	var order binary.ByteOrder
+	nano := false
+	switch magic := binary.LittleEndian.Uint32(header[0:4]); magic {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xa1b23c4d:
+		order, nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nano = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, errors.New("pcapng captures are not supported, convert with editcap -F pcap")
+	default:
+		return nil, fmt.Errorf("not a pcap capture, magic number %08x", magic)
+	}
+	link := order.Uint32(header[20:24]) & 0xFFFF
+	snapLen := order.Uint32(header[16:20])
+	if snapLen == 0 || snapLen > maxSnapLen {
+		snapLen = maxSnapLen
+	}
+
+	var datagrams []Datagram
+	for index := 1; ; index++ {
+		var record [16]byte
+		if _, err := io.ReadFull(r, record[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return datagrams, nil
+			}
+			return datagrams, fmt.Errorf("packet %d: %w", index, err)
+		}
+		// Checked before allocating, a corrupt length could be up to 4 GiB
+		capLen := order.Uint32(record[8:12])
+		if capLen > snapLen {
+			return datagrams, fmt.Errorf("packet %d: captured length %d above the snapshot length %d", index, capLen, snapLen)
+		}
+		packet := make([]byte, capLen)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return datagrams, fmt.Errorf("packet %d: %w", index, err)
+		}
+
+		fraction := time.Duration(order.Uint32(record[4:8]))
+		if !nano {
+			fraction *= time.Microsecond
+		}
+		d, ok := udp(link, packet)
+		if !ok {
+			continue
+		}
+		d.Index = index
+		d.Time = time.Unix(int64(order.Uint32(record[0:4])), int64(fraction))
+		datagrams = append(datagrams, d)
+	}
+}
+
+// udp decodes the link and IP layers of a packet down to its UDP payload.
+func udp(link uint32, packet []byte) (Datagram, bool) {
+	switch link {
+	case linkNull:
+		if len(packet) < 4 {
+			return Datagram{}, false
+		}
+		// Address family values for IPv6 differ between BSDs, tell the
+		// version from the IP header instead
+		packet = packet[4:]
+	case linkEthernet:
+		if len(packet) < 14 {
+			return Datagram{}, false
+		}
+		etherType := binary.BigEndian.Uint16(packet[12:14])
+		packet = packet[14:]
+		if etherType == etherTypeVLAN && len(packet) >= 4 {
+			etherType, packet = binary.BigEndian.Uint16(packet[2:4]), packet[4:]
+		}
+		if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+			return Datagram{}, false
+		}
+	case linkRaw:
+	case linkLinuxSLL:
+		if len(packet) < 16 {
+			return Datagram{}, false
+		}
+		packet = packet[16:]
+	default:
+		return Datagram{}, false
+	}
+	if len(packet) == 0 {
+		return Datagram{}, false
+	}
+
+	var src, dst netip.Addr
+	switch packet[0] >> 4 {
+	case 4:
+		headerLen := int(packet[0]&0xF) * 4
+		if len(packet) < 20 || headerLen < 20 || len(packet) < headerLen || packet[9] != protoUDP {
+			return Datagram{}, false
+		}
+		// Fragments other than a whole datagram cannot be decoded alone
+		if binary.BigEndian.Uint16(packet[6:8])&0x3FFF != 0 {
+			return Datagram{}, false
+		}
+		src, dst = netip.AddrFrom4([4]byte(packet[12:16])), netip.AddrFrom4([4]byte(packet[16:20]))
+		packet = packet[headerLen:]
+	case 6:
+		// Extension headers are not followed, DNS over UDP rarely has any
+		if len(packet) < 40 || packet[6] != protoUDP {
+			return Datagram{}, false
+		}
+		src, dst = netip.AddrFrom16([16]byte(packet[8:24])), netip.AddrFrom16([16]byte(packet[24:40]))
+		packet = packet[40:]
+	default:
+		return Datagram{}, false
+	}
+
+	if len(packet) < 8 {
+		return Datagram{}, false
+	}
+	length := int(binary.BigEndian.Uint16(packet[4:6]))
+	if length < 8 || len(packet) < length {
+		return Datagram{}, false
+	}
+	return Datagram{
+		Src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(packet[0:2])),
+		Dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(packet[2:4])),
+		Payload: packet[8:length],
+	}, true
+}
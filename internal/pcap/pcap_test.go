@@ -0,0 +1,52 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// capture returns a little endian capture of raw IP packets with the given
+// snapshot length, holding one packet record with a captured length of
+// capLen and data as its content.
+func capture(snapLen, capLen uint32, data []byte) []byte {
+	var b bytes.Buffer
+	for _, v := range []uint32{0xa1b2c3d4, 0x00040002, 0, 0, snapLen, linkRaw} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	for _, v := range []uint32{1, 0, capLen, capLen} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	b.Write(data)
+	return b.Bytes()
+}
+
+func TestReadUDPCapLen(t *testing.T) {
+	// IPv4 UDP datagram from 10.0.0.1:1000 to 10.0.0.2:53 carrying "dns"
+	packet := []byte{0x45, 0, 0, 31, 0, 0, 0, 0, 64, protoUDP, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2,
+		0x03, 0xE8, 0, 53, 0, 11, 0, 0, 'd', 'n', 's'}
+	tests := []struct {
+		name    string
+		snapLen uint32
+		capLen  uint32
+		err     string
+	}{
+		{"within snapshot length", 65535, uint32(len(packet)), ""},
+		{"no snapshot length", 0, uint32(len(packet)), ""},
+		{"above snapshot length", 16, uint32(len(packet)), "above the snapshot length 16"},
+		{"corrupt length", 0xFFFFFFFF, 0xFFFFFFF0, "above the snapshot length 262144"},
+	}
+	for _, tt := range tests {
+		datagrams, err := ReadUDP(bytes.NewReader(capture(tt.snapLen, tt.capLen, packet)))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || len(datagrams) != 1 || string(datagrams[0].Payload) != "dns" {
+			t.Errorf("%s: %v, %d datagrams", tt.name, err, len(datagrams))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Package policy decides, query by query, whether a client may resolve a
+// name. Policies are evaluated in order in a Chain, the first one with an
+// opinion decides.
+package policy
+
+import (
+	"bytes"
+	"net/netip"
+	"time"
+)
+
+// Query is what policies decide on.
+type Query struct {
+	Client netip.Addr
+	// MAC and Device are the hardware address and the name of the client
+	// device, when known.
+	MAC    string
+	Device string
+	// Name is the lowercased question name, without trailing dot.
+	Name []byte
+	Type uint16
+	Time time.Time
+}
+
+// Action is what a policy decides for a query.
+type Action int
+
+const (
+	// Pass leaves the decision to the next policies, the query is
+	// resolved when all pass.
+	Pass Action = iota
+	// Block answers the query as a blocked name.
+	Block
+)
+
+// Verdict is the decision of a policy, Rule describes what it is based on.
+type Verdict struct {
+	Action Action
+	Rule   string
+}
+
+// Policy decides on queries. Check is called concurrently.
+type Policy interface {
+	Check(q *Query) Verdict
+}
+
+// Chain evaluates policies in order.
+type Chain []Policy
+
+// Check returns the verdict of the first policy not passing q.
+func (c Chain) Check(q *Query) Verdict {
+	for _, p := range c {
+		if v := p.Check(q); v.Action != Pass {
+			return v
+		}
+	}
+	return Verdict{}
+}
+
+// inDomains reports whether name is equal to or a subdomain of a domain of
+// set. It does not allocate.
+func inDomains(set map[string]bool, name []byte) bool {
+	for suffix := name; len(suffix) > 0; {
+		if set[string(suffix)] {
+			return true
+		}
+		_, suffix, _ = bytes.Cut(suffix, []byte("."))
+	}
+	return false
+}
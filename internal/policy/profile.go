@@ -0,0 +1,349 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the policy file, in JSON:
+//
+//	{"profiles": [{
+//		"name": "kids",
+//		"clients": ["192.168.1.20", "192.168.1.32/28", "aa:bb:cc:dd:ee:ff", "device:kids-tablet"],
+//		"quotas": [{"name": "video", "domains": ["youtube.com"], "limit": 500, "period": "day"}],
+//		"schedules": [{"name": "bedtime", "domains": ["roblox.com"], "from": "22:00", "to": "07:00"}]
+//	}]}
+type Config struct {
+	Profiles []ProfileConfig `json:"profiles"`
+}
+
+// ProfileConfig applies quotas and schedules to clients, given as
+// addresses, prefixes, hardware addresses or device names prefixed with
+// "device:", see device.Directory. A client belongs to the first profile
+// listing it.
+type ProfileConfig struct {
+	Name      string           `json:"name"`
+	Clients   []string         `json:"clients"`
+	Quotas    []QuotaConfig    `json:"quotas"`
+	Schedules []ScheduleConfig `json:"schedules"`
+}
+
+// QuotaConfig allows each client Limit queries per Period, "hour" or
+// "day", for Domains and their subdomains, or for any name when empty.
+// Queries over quota are blocked until the period ends.
+type QuotaConfig struct {
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"`
+	Limit   int      `json:"limit"`
+	Period  string   `json:"period"`
+}
+
+// ScheduleConfig blocks Domains and their subdomains, or any name when
+// empty, between From and To local time, "22:00" and "07:00" say, on Days,
+// "mon" to "sun", or every day when empty. A window ending before it
+// starts ends the next day.
+type ScheduleConfig struct {
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"`
+	Days    []string `json:"days"`
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+}
+
+// Profiles is the policy enforcing the quotas and schedules of client
+// profiles.
+type Profiles struct {
+	profiles []*profile
+}
+
+type profile struct {
+	name      string
+	clients   []netip.Prefix
+	macs      map[string]bool
+	devices   map[string]bool
+	quotas    []*quota
+	schedules []*schedule
+}
+
+type quota struct {
+	rule    string
+	domains map[string]bool // nil for any name
+	limit   int
+	period  string
+
+	mu      sync.Mutex
+	current int            // period counts are for, see periodOf
+	counts  map[client]int // queries of each client during current
+}
+
+// client is who quotas are counted for: the device when its hardware
+// address is known, since its address may change, the address otherwise.
+type client struct {
+	addr netip.Addr
+	mac  string
+}
+
+type schedule struct {
+	rule     string
+	domains  map[string]bool // nil for any name
+	days     [7]bool         // by time.Weekday
+	from, to int             // minutes since midnight
+}
+
+// Load reads the policy file at path.
+func Load(path string) (*Profiles, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	p, err := New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// New returns the policy of the profiles of cfg.
+func New(cfg Config) (*Profiles, error) {
+	var p Profiles
+	for _, pc := range cfg.Profiles {
+		prof := &profile{name: pc.Name, macs: map[string]bool{}, devices: map[string]bool{}}
+		for _, c := range pc.Clients {
+			if name, ok := strings.CutPrefix(c, "device:"); ok {
+				if name == "" {
+					return nil, fmt.Errorf("profile %s: client %q has no device name", pc.Name, c)
+				}
+				prof.devices[strings.ToLower(name)] = true
+				continue
+			}
+			if mac, err := net.ParseMAC(c); err == nil {
+				prof.macs[mac.String()] = true
+				continue
+			}
+			prefix, err := parseClient(c)
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: client %q is not an address, prefix, hardware address or device:name: %w", pc.Name, c, err)
+			}
+			prof.clients = append(prof.clients, prefix)
+		}
+		for i, qc := range pc.Quotas {
+			q, err := newQuota(pc.Name, i, qc)
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: %w", pc.Name, err)
+			}
+			prof.quotas = append(prof.quotas, q)
+		}
+		for i, sc := range pc.Schedules {
+			s, err := newSchedule(pc.Name, i, sc)
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: %w", pc.Name, err)
+			}
+			prof.schedules = append(prof.schedules, s)
+		}
+		p.profiles = append(p.profiles, prof)
+	}
+	return &p, nil
+}
+
+func parseClient(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func domainSet(domains []string) map[string]bool {
+	if len(domains) == 0 {
+		return nil
+	}
+	set := map[string]bool{}
+	for _, d := range domains {
+		set[strings.ToLower(strings.TrimSuffix(d, "."))] = true
+	}
+	return set
+}
+
+// ruleName describes the i-th rule of kind in a profile, by its name if
+// it has one.
+func ruleName(profile string, kind string, i int, name string) string {
+	if name == "" {
+		name = fmt.Sprint(i + 1)
+	}
+	return "profile " + profile + " " + kind + " " + name
+}
+
+func newQuota(profile string, i int, qc QuotaConfig) (*quota, error) {
+	if qc.Period != "hour" && qc.Period != "day" {
+		return nil, fmt.Errorf("quota period %q, expected hour or day", qc.Period)
+	}
+	if qc.Limit < 0 {
+		return nil, fmt.Errorf("negative quota limit %d", qc.Limit)
+	}
+	return &quota{
+		rule:    ruleName(profile, "quota", i, qc.Name),
+		domains: domainSet(qc.Domains),
+		limit:   qc.Limit,
+		period:  qc.Period,
+		counts:  map[client]int{},
+	}, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func newSchedule(profile string, i int, sc ScheduleConfig) (*schedule, error) {
+	s := &schedule{rule: ruleName(profile, "schedule", i, sc.Name), domains: domainSet(sc.Domains)}
+	for _, d := range sc.Days {
+		day, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return nil, fmt.Errorf("schedule day %q, expected mon to sun", d)
+		}
+		s.days[day] = true
+	}
+	if len(sc.Days) == 0 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	var err error
+	if s.from, err = parseClock(sc.From); err != nil {
+		return nil, err
+	}
+	if s.to, err = parseClock(sc.To); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseClock returns the minutes since midnight of a hh:mm time.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("schedule time %q, expected hh:mm", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Check blocks queries of a profile client outside its schedules or over
+// its quotas.
+func (p *Profiles) Check(q *Query) Verdict {
+	prof := p.profile(q)
+	if prof == nil {
+		return Verdict{}
+	}
+	for _, s := range prof.schedules {
+		if s.blocks(q) {
+			return Verdict{Action: Block, Rule: s.rule}
+		}
+	}
+	// Queries blocked by a quota do not count against the others
+	for _, quota := range prof.quotas {
+		if quota.exceeded(q) {
+			return Verdict{Action: Block, Rule: quota.rule}
+		}
+	}
+	for _, quota := range prof.quotas {
+		quota.count(q)
+	}
+	return Verdict{}
+}
+
+func (p *Profiles) profile(q *Query) *profile {
+	addr := q.Client.Unmap()
+	for _, prof := range p.profiles {
+		if (q.MAC != "" && prof.macs[q.MAC]) || (q.Device != "" && prof.devices[strings.ToLower(q.Device)]) {
+			return prof
+		}
+		for _, prefix := range prof.clients {
+			if prefix.Contains(addr) {
+				return prof
+			}
+		}
+	}
+	return nil
+}
+
+func (s *schedule) blocks(q *Query) bool {
+	if s.domains != nil && !inDomains(s.domains, q.Name) {
+		return false
+	}
+	t := q.Time
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if s.from <= s.to {
+		return s.days[day] && minute >= s.from && minute < s.to
+	}
+	// Past midnight, the window started the day before
+	yesterday := (day + 6) % 7
+	return (s.days[day] && minute >= s.from) || (s.days[yesterday] && minute < s.to)
+}
+
+// applies reports whether q counts against the quota.
+func (quota *quota) applies(q *Query) bool {
+	return quota.domains == nil || inDomains(quota.domains, q.Name)
+}
+
+// periodOf returns the period of the quota t falls in.
+func (quota *quota) periodOf(t time.Time) int {
+	year, month, day := t.Date()
+	period := year*10000 + int(month)*100 + day
+	if quota.period == "hour" {
+		period = period*100 + t.Hour()
+	}
+	return period
+}
+
+// clientOf returns who q is counted for.
+func clientOf(q *Query) client {
+	if q.MAC != "" {
+		return client{mac: q.MAC}
+	}
+	return client{addr: q.Client.Unmap()}
+}
+
+// rollover forgets the counts of past periods when period starts, a query
+// stamped a little earlier than the last one counting in the later period.
+// The caller holds quota.mu.
+func (quota *quota) rollover(period int) {
+	if period > quota.current {
+		quota.current = period
+		clear(quota.counts)
+	}
+}
+
+// exceeded reports whether the client of q is over quota.
+func (quota *quota) exceeded(q *Query) bool {
+	if !quota.applies(q) {
+		return false
+	}
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	quota.rollover(quota.periodOf(q.Time))
+	return quota.counts[clientOf(q)] >= quota.limit
+}
+
+// count counts q against the quota of its client.
+func (quota *quota) count(q *Query) {
+	if !quota.applies(q) {
+		return
+	}
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	quota.rollover(quota.periodOf(q.Time))
+	quota.counts[clientOf(q)]++
+}
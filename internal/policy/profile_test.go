@@ -0,0 +1,160 @@
+package policy
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// at returns the time of day hh:mm on October 12 2026, a Monday, plus days.
+func at(days, hour, minute int) time.Time {
+	return time.Date(2026, 10, 12+days, hour, minute, 0, 0, time.UTC)
+}
+
+func TestScheduleBlocks(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		days     []string
+		time     time.Time
+		blocked  bool
+	}{
+		{"inside same day window", "09:00", "17:00", nil, at(0, 12, 0), true},
+		{"at start", "09:00", "17:00", nil, at(0, 9, 0), true},
+		{"at end", "09:00", "17:00", nil, at(0, 17, 0), false},
+		{"before", "09:00", "17:00", nil, at(0, 8, 59), false},
+		{"past midnight, evening", "22:00", "07:00", nil, at(0, 23, 30), true},
+		{"past midnight, early morning", "22:00", "07:00", nil, at(1, 6, 59), true},
+		{"past midnight, at end", "22:00", "07:00", nil, at(1, 7, 0), false},
+		{"past midnight, afternoon", "22:00", "07:00", nil, at(0, 15, 0), false},
+		{"monday night, on monday", "22:00", "07:00", []string{"mon"}, at(0, 23, 0), true},
+		{"monday night, into tuesday", "22:00", "07:00", []string{"mon"}, at(1, 3, 0), true},
+		{"monday night, tuesday evening", "22:00", "07:00", []string{"mon"}, at(1, 23, 0), false},
+		{"monday night, early monday", "22:00", "07:00", []string{"mon"}, at(0, 3, 0), false},
+		{"sunday night into monday", "22:00", "07:00", []string{"sun"}, at(0, 3, 0), true},
+		{"weekdays, on saturday", "09:00", "17:00", []string{"mon", "tue", "wed", "thu", "fri"}, at(5, 12, 0), false},
+	}
+	for _, tt := range tests {
+		s, err := newSchedule("test", 0, ScheduleConfig{From: tt.from, To: tt.to, Days: tt.days})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := &Query{Name: []byte("example.com"), Time: tt.time}
+		if got := s.blocks(q); got != tt.blocked {
+			t.Errorf("%s: %s-%s %v at %v: blocked %v, want %v", tt.name, tt.from, tt.to, tt.days, tt.time, got, tt.blocked)
+		}
+	}
+}
+
+func TestQuotaRollover(t *testing.T) {
+	tests := []struct {
+		name    string
+		period  string
+		first   time.Time // when the quota is used up
+		then    time.Time
+		blocked bool
+	}{
+		{"same hour", "hour", at(0, 10, 5), at(0, 10, 59), true},
+		{"next hour", "hour", at(0, 10, 5), at(0, 11, 0), false},
+		{"same hour next day", "hour", at(0, 10, 5), at(1, 10, 5), false},
+		{"same day", "day", at(0, 0, 0), at(0, 23, 59), true},
+		{"next day", "day", at(0, 23, 59), at(1, 0, 0), false},
+		{"next month", "day", time.Date(2026, 10, 31, 12, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), false},
+	}
+	client := netip.MustParseAddr("192.168.1.20")
+	for _, tt := range tests {
+		p, err := New(Config{Profiles: []ProfileConfig{{
+			Name:    "kids",
+			Clients: []string{"192.168.1.0/24"},
+			Quotas:  []QuotaConfig{{Limit: 2, Period: tt.period}},
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if v := p.Check(&Query{Client: client, Name: []byte("example.com"), Time: tt.first}); v.Action != Pass {
+				t.Fatalf("%s: query %d within quota blocked", tt.name, i+1)
+			}
+		}
+		v := p.Check(&Query{Client: client, Name: []byte("example.com"), Time: tt.then})
+		if blocked := v.Action == Block; blocked != tt.blocked {
+			t.Errorf("%s: blocked %v, want %v", tt.name, blocked, tt.blocked)
+		}
+		if q := p.profiles[0].quotas[0]; len(q.counts) > 1 {
+			t.Errorf("%s: %d clients counted, past periods are kept", tt.name, len(q.counts))
+		}
+	}
+}
+
+func TestQuotaCounting(t *testing.T) {
+	p, err := New(Config{Profiles: []ProfileConfig{{
+		Name:    "kids",
+		Clients: []string{"192.168.1.0/24"},
+		Quotas: []QuotaConfig{
+			{Name: "all", Limit: 3, Period: "day"},
+			{Name: "video", Domains: []string{"video.example"}, Limit: 1, Period: "day"},
+		},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := at(0, 12, 0)
+	check := func(client string, name string) Action {
+		return p.Check(&Query{Client: netip.MustParseAddr(client), Name: []byte(name), Time: now}).Action
+	}
+
+	if check("192.168.1.20", "video.example") != Pass {
+		t.Fatal("first video query blocked")
+	}
+	// Blocked by the video quota, these must not use up the other one
+	for i := 0; i < 5; i++ {
+		if check("192.168.1.20", "www.video.example") != Block {
+			t.Fatal("video query over quota passed")
+		}
+	}
+	// The v4-mapped form of the address is the same client
+	if check("::ffff:192.168.1.20", "example.com") != Pass || check("192.168.1.20", "example.com") != Pass {
+		t.Fatal("queries within the overall quota blocked")
+	}
+	if check("::ffff:192.168.1.20", "example.org") != Block {
+		t.Error("v4-mapped client counted apart from its IPv4 address")
+	}
+	if check("192.168.1.21", "example.com") != Pass {
+		t.Error("another client shares the quota")
+	}
+}
+
+func TestProfileClients(t *testing.T) {
+	for _, bad := range []string{"192.168.1.300", "10.0.0.0/33", "kids-tablet", "device:"} {
+		if _, err := New(Config{Profiles: []ProfileConfig{{Name: "kids", Clients: []string{bad}}}}); err == nil {
+			t.Errorf("client %q accepted", bad)
+		}
+	}
+
+	p, err := New(Config{Profiles: []ProfileConfig{{
+		Name:      "kids",
+		Clients:   []string{"192.168.1.32/28", "AA:BB:CC:DD:EE:FF", "device:Kids-Tablet"},
+		Schedules: []ScheduleConfig{{From: "00:00", To: "23:59"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		client  string
+		mac     string
+		device  string
+		blocked bool
+	}{
+		{"192.168.1.40", "", "", true},
+		{"192.168.1.20", "", "", false},
+		{"192.168.1.20", "aa:bb:cc:dd:ee:ff", "", true},
+		{"192.168.1.20", "", "kids-tablet", true},
+		{"192.168.1.20", "", "device:kids-tablet", false},
+	}
+	for _, tt := range tests {
+		q := &Query{Client: netip.MustParseAddr(tt.client), MAC: tt.mac, Device: tt.device, Name: []byte("example.com"), Time: at(0, 12, 0)}
+		if blocked := p.Check(q).Action == Block; blocked != tt.blocked {
+			t.Errorf("%s %q %q: blocked %v, want %v", tt.client, tt.mac, tt.device, blocked, tt.blocked)
+		}
+	}
+}
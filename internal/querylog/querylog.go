@@ -0,0 +1,41 @@
+package querylog
+
+import (
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/ring"
+)
+
+// Entry describes an answered query and where its answer came from.
+type Entry struct {
+	Time         time.Time `json:"time"`
+	Client       string    `json:"client"`
+	ClientMAC    string    `json:"client_mac,omitempty"`
+	ClientName   string    `json:"client_name,omitempty"`
+	Name         string    `json:"name"`
+	Type         string    `json:"type"`
+	Rcode        string    `json:"rcode"`
+	Source       string    `json:"source"`
+	SourceDetail string    `json:"source_detail,omitempty"`
+	DurationMs   float64   `json:"duration_ms"`
+	// Breakdown is only recorded for slow queries
+	Breakdown *Breakdown `json:"breakdown,omitempty"`
+}
+
+// Breakdown tells where the time answering a query went.
+type Breakdown struct {
+	TraceID    string  `json:"trace_id"`
+	PolicyMs   float64 `json:"policy_ms"`   // local zones, blocklist and policies
+	CacheMs    float64 `json:"cache_ms"`    // cache lookup and store
+	UpstreamMs float64 `json:"upstream_ms"` // upstream round trip
+	// Retransmits of the query received from the client while it was
+	// being answered, upstreams are queried once
+	ClientRetransmits int `json:"client_retransmits"`
+}
+
+// Log keeps the most recent entries.
+type Log = ring.Ring[Entry]
+
+func New(size int) *Log {
+	return ring.New[Entry](size)
+}
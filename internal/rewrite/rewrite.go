@@ -0,0 +1,216 @@
+// Package rewrite modifies answers before they reach clients, such as
+// replacing the public address of a service with its internal one behind a
+// NAT, or dropping some records of an RRset.
+package rewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// Config is the rewrite file, in JSON:
+//
+//	{"rules": [
+//		{"pattern": "*.corp.example.com", "replace": {"203.0.113.10": "10.0.0.10"}},
+//		{"pattern": "example.org", "drop": [{"type": "AAAA"}, {"type": "A", "value": "192.0.2.1"}]}
+//	]}
+type Config struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+// RuleConfig rewrites the answer section of the answers to queries for
+// names matching Pattern: example.com matches the name and its subdomains,
+// *.example.com only its subdomains. The rules of all matching patterns
+// apply, in order.
+type RuleConfig struct {
+	Pattern string `json:"pattern"`
+	// Replace maps addresses of A and AAAA records to the addresses they
+	// are replaced with, of the same family.
+	Replace map[string]string `json:"replace"`
+	Drop    []DropConfig      `json:"drop"`
+}
+
+// DropConfig drops the records of type Type, and if Value is set only
+// those whose rdata is Value, written as by the decode subcommand, e.g.
+// 192.0.2.1 or "10 mail.example.com.".
+type DropConfig struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Rewriter applies rewrite rules to answers.
+type Rewriter struct {
+	domains   map[string][]*rule // rules matching a domain and its subdomains
+	wildcards map[string][]*rule // rules matching the subdomains of a domain
+}
+
+type rule struct {
+	replace map[netip.Addr]netip.Addr
+	drop    []drop
+}
+
+type drop struct {
+	rtype uint16
+	addr  netip.Addr // for A and AAAA values
+	value string     // for other values
+}
+
+// Load reads the rewrite file at path.
+func Load(path string) (*Rewriter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r, err := New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+func New(cfg Config) (*Rewriter, error) {
+	r := &Rewriter{domains: map[string][]*rule{}, wildcards: map[string][]*rule{}}
+	for i, rc := range cfg.Rules {
+		pattern := strings.ToLower(strings.TrimSuffix(rc.Pattern, "."))
+		if pattern == "" {
+			return nil, fmt.Errorf("rule %d: missing pattern", i)
+		}
+		ru, err := newRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rc.Pattern, err)
+		}
+		if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+			r.wildcards[domain] = append(r.wildcards[domain], ru)
+		} else {
+			r.domains[pattern] = append(r.domains[pattern], ru)
+		}
+	}
+	return r, nil
+}
+
+func newRule(rc RuleConfig) (*rule, error) {
+	ru := &rule{replace: map[netip.Addr]netip.Addr{}}
+	for from, to := range rc.Replace {
+		fromAddr, err := netip.ParseAddr(from)
+		if err != nil {
+			return nil, err
+		}
+		toAddr, err := netip.ParseAddr(to)
+		if err != nil {
+			return nil, err
+		}
+		if fromAddr.Is4() != toAddr.Is4() {
+			return nil, fmt.Errorf("cannot replace %s with %s, addresses must be of the same family", from, to)
+		}
+		ru.replace[fromAddr] = toAddr
+	}
+	for _, dc := range rc.Drop {
+		rtype, ok := parser.ParseType(dc.Type)
+		if !ok {
+			return nil, fmt.Errorf("unknown record type %q", dc.Type)
+		}
+		d := drop{rtype: rtype, value: dc.Value}
+		if dc.Value != "" && (rtype == parser.TypeA || rtype == parser.TypeAAAA) {
+			addr, err := netip.ParseAddr(dc.Value)
+			if err != nil {
+				return nil, err
+			}
+			d.addr = addr
+		}
+		ru.drop = append(ru.drop, d)
+	}
+	return ru, nil
+}
+
+// Matches reports whether rules apply to name, lowercase without trailing
+// dot. It does not allocate.
+func (r *Rewriter) Matches(name []byte) bool {
+	if len(r.domains[string(name)]) > 0 {
+		return true
+	}
+	for suffix := name; ; {
+		_, parent, ok := bytes.Cut(suffix, []byte("."))
+		if !ok {
+			return false
+		}
+		if len(r.domains[string(parent)]) > 0 || len(r.wildcards[string(parent)]) > 0 {
+			return true
+		}
+		suffix = parent
+	}
+}
+
+// rules returns the rules matching name, from the most specific pattern.
+func (r *Rewriter) rules(name []byte) []*rule {
+	rules := r.domains[string(name)]
+	for suffix := name; ; {
+		_, parent, ok := bytes.Cut(suffix, []byte("."))
+		if !ok {
+			return rules
+		}
+		rules = append(append(rules[:len(rules):len(rules)], r.wildcards[string(parent)]...), r.domains[string(parent)]...)
+		suffix = parent
+	}
+}
+
+// Rewrite applies the rules matching name, the name queried, to answers.
+// It returns the rewritten answers and whether they changed. Signed
+// answers are left untouched: validating clients would reject them once
+// rewritten, just as they would without their signatures.
+func (r *Rewriter) Rewrite(name []byte, answers []parser.Resource) ([]parser.Resource, bool) {
+	for _, rr := range answers {
+		if rr.RType == parser.TypeRRSIG {
+			return answers, false
+		}
+	}
+	changed := false
+	for _, ru := range r.rules(name) {
+		kept := answers[:0]
+		for _, rr := range answers {
+			if ru.drops(rr) {
+				changed = true
+				continue
+			}
+			if rr.RType == parser.TypeA || rr.RType == parser.TypeAAAA {
+				if addr, ok := netip.AddrFromSlice(rr.RData); ok {
+					if to, ok := ru.replace[addr]; ok {
+						rr.RData = to.AsSlice()
+						changed = true
+					}
+				}
+			}
+			kept = append(kept, rr)
+		}
+		answers = kept
+	}
+	return answers, changed
+}
+
+func (ru *rule) drops(rr parser.Resource) bool {
+	for _, d := range ru.drop {
+		if d.rtype != rr.RType {
+			continue
+		}
+		switch {
+		case d.value == "":
+			return true
+		case d.addr.IsValid():
+			if addr, ok := netip.AddrFromSlice(rr.RData); ok && addr == d.addr {
+				return true
+			}
+		case strings.EqualFold(strings.TrimSuffix(rr.RDataString(), "."), strings.TrimSuffix(d.value, ".")):
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package rewrite
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+func record(rtype uint16, value string) parser.Resource {
+	rr := parser.Resource{RName: "www.example.com", RType: rtype, RClass: parser.ClassIN, RTtl: 300}
+	switch rtype {
+	case parser.TypeA, parser.TypeAAAA:
+		rr.RData = netip.MustParseAddr(value).AsSlice()
+	default:
+		rr.RData = []byte(value)
+	}
+	return rr
+}
+
+// values returns the rdata of answers as text.
+func values(answers []parser.Resource) []string {
+	var values []string
+	for _, rr := range answers {
+		values = append(values, parser.TypeString(rr.RType)+" "+rr.RDataString())
+	}
+	return values
+}
+
+func TestNewPatterns(t *testing.T) {
+	r, err := New(Config{Rules: []RuleConfig{
+		{Pattern: "Example.com.", Replace: map[string]string{"203.0.113.10": "10.0.0.10"}},
+		{Pattern: "*.example.org", Replace: map[string]string{"203.0.113.10": "10.0.0.20"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want string // replacement, empty when no rule matches
+	}{
+		{"example.com", "10.0.0.10"},
+		{"www.example.com", "10.0.0.10"},
+		{"a.b.example.com", "10.0.0.10"},
+		{"badexample.com", ""},
+		{"example.org", ""},
+		{"www.example.org", "10.0.0.20"},
+		{"a.b.example.org", "10.0.0.20"},
+		{"com", ""},
+	}
+	for _, tt := range tests {
+		if matches := r.Matches([]byte(tt.name)); matches != (tt.want != "") {
+			t.Errorf("%s: matches %v, want %v", tt.name, matches, tt.want != "")
+		}
+		answers, changed := r.Rewrite([]byte(tt.name), []parser.Resource{record(parser.TypeA, "203.0.113.10")})
+		want := "A 203.0.113.10"
+		if tt.want != "" {
+			want = "A " + tt.want
+		}
+		if got := values(answers); changed != (tt.want != "") || len(got) != 1 || got[0] != want {
+			t.Errorf("%s: rewritten to %v, changed %v, want %s", tt.name, got, changed, want)
+		}
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule RuleConfig
+	}{
+		{"missing pattern", RuleConfig{Replace: map[string]string{"192.0.2.1": "10.0.0.1"}}},
+		{"IPv4 replaced with IPv6", RuleConfig{Pattern: "example.com", Replace: map[string]string{"192.0.2.1": "2001:db8::1"}}},
+		{"IPv6 replaced with IPv4", RuleConfig{Pattern: "example.com", Replace: map[string]string{"2001:db8::1": "10.0.0.1"}}},
+		{"invalid address", RuleConfig{Pattern: "example.com", Replace: map[string]string{"192.0.2": "10.0.0.1"}}},
+		{"unknown type", RuleConfig{Pattern: "example.com", Drop: []DropConfig{{Type: "BOGUS"}}}},
+		{"invalid address value", RuleConfig{Pattern: "example.com", Drop: []DropConfig{{Type: "A", Value: "example"}}}},
+	}
+	for _, tt := range tests {
+		if _, err := New(Config{Rules: []RuleConfig{tt.rule}}); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	answers := func() []parser.Resource {
+		return []parser.Resource{
+			record(parser.TypeCNAME, "edge.example.net"),
+			record(parser.TypeA, "203.0.113.10"),
+			record(parser.TypeA, "192.0.2.1"),
+			record(parser.TypeAAAA, "2001:db8::10"),
+		}
+	}
+	tests := []struct {
+		name    string
+		rule    RuleConfig
+		answers []parser.Resource // answers() when nil
+		want    []string
+	}{
+		{
+			"replace IPv4",
+			RuleConfig{Replace: map[string]string{"203.0.113.10": "10.0.0.10"}},
+			nil,
+			[]string{"CNAME edge.example.net.", "A 10.0.0.10", "A 192.0.2.1", "AAAA 2001:db8::10"},
+		},
+		{
+			"replace IPv6",
+			RuleConfig{Replace: map[string]string{"2001:db8::10": "fd00::10"}},
+			nil,
+			[]string{"CNAME edge.example.net.", "A 203.0.113.10", "A 192.0.2.1", "AAAA fd00::10"},
+		},
+		{
+			"replace both families",
+			RuleConfig{Replace: map[string]string{"203.0.113.10": "10.0.0.10", "2001:db8::10": "fd00::10"}},
+			nil,
+			[]string{"CNAME edge.example.net.", "A 10.0.0.10", "A 192.0.2.1", "AAAA fd00::10"},
+		},
+		{
+			"IPv4-mapped address is not IPv4",
+			RuleConfig{Replace: map[string]string{"::ffff:203.0.113.10": "::ffff:10.0.0.10"}},
+			nil,
+			[]string{"CNAME edge.example.net.", "A 203.0.113.10", "A 192.0.2.1", "AAAA 2001:db8::10"},
+		},
+		{
+			"drop type",
+			RuleConfig{Drop: []DropConfig{{Type: "aaaa"}}},
+			nil,
+			[]string{"CNAME edge.example.net.", "A 203.0.113.10", "A 192.0.2.1"},
+		},
+		{
+			"drop address",
+			RuleConfig{Drop: []DropConfig{{Type: "A", Value: "192.0.2.1"}}},
+			nil,
+			[]string{"CNAME edge.example.net.", "A 203.0.113.10", "AAAA 2001:db8::10"},
+		},
+		{
+			"drop name, any case and trailing dot",
+			RuleConfig{Drop: []DropConfig{{Type: "CNAME", Value: "Edge.Example.net"}}},
+			nil,
+			[]string{"A 203.0.113.10", "A 192.0.2.1", "AAAA 2001:db8::10"},
+		},
+		{
+			"drop value of another type",
+			RuleConfig{Drop: []DropConfig{{Type: "AAAA", Value: "192.0.2.1"}}},
+			nil,
+			[]string{"CNAME edge.example.net.", "A 203.0.113.10", "A 192.0.2.1", "AAAA 2001:db8::10"},
+		},
+		{
+			"drop then replace",
+			RuleConfig{Drop: []DropConfig{{Type: "A", Value: "192.0.2.1"}}, Replace: map[string]string{"203.0.113.10": "10.0.0.10"}},
+			nil,
+			[]string{"CNAME edge.example.net.", "A 10.0.0.10", "AAAA 2001:db8::10"},
+		},
+		{
+			"signed answer",
+			RuleConfig{Drop: []DropConfig{{Type: "AAAA"}}, Replace: map[string]string{"203.0.113.10": "10.0.0.10"}},
+			append(answers(), record(parser.TypeRRSIG, "signature")),
+			[]string{"CNAME edge.example.net.", "A 203.0.113.10", "A 192.0.2.1", "AAAA 2001:db8::10", `RRSIG \# 9 7369676e6174757265`},
+		},
+	}
+	for _, tt := range tests {
+		tt.rule.Pattern = "example.com"
+		r, err := New(Config{Rules: []RuleConfig{tt.rule}})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		in := tt.answers
+		if in == nil {
+			in = answers()
+		}
+		before := values(in)
+		rewritten, changed := r.Rewrite([]byte("www.example.com"), in)
+		got := values(rewritten)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: rewritten to %v, want %v", tt.name, got, tt.want)
+		}
+		if changed != !slices.Equal(before, tt.want) {
+			t.Errorf("%s: changed %v", tt.name, changed)
+		}
+	}
+}
+
+func TestRewriteRulesInOrder(t *testing.T) {
+	// The most specific pattern applies first, then the rules of the
+	// parent domain to what it left
+	r, err := New(Config{Rules: []RuleConfig{
+		{Pattern: "example.com", Replace: map[string]string{"10.0.0.10": "10.0.0.99", "192.0.2.1": "10.0.0.1"}},
+		{Pattern: "www.example.com", Replace: map[string]string{"203.0.113.10": "10.0.0.10"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := []parser.Resource{record(parser.TypeA, "203.0.113.10"), record(parser.TypeA, "192.0.2.1")}
+	rewritten, _ := r.Rewrite([]byte("www.example.com"), in)
+	want := []string{"A 10.0.0.99", "A 10.0.0.1"}
+	if got := values(rewritten); !slices.Equal(got, want) {
+		t.Errorf("rewritten to %v, want %v", got, want)
+	}
+}
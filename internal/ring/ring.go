@@ -0,0 +1,54 @@
+// Package ring keeps the most recent items of a stream, such as answered
+// queries, for the API to show.
+package ring
+
+import "sync"
+
+// Ring keeps the most recent items added to it. It is safe for concurrent
+// use.
+type Ring[T any] struct {
+	mu    sync.Mutex
+	items []T
+	next  int
+	full  bool
+}
+
+// New returns a ring keeping the size most recent items.
+func New[T any](size int) *Ring[T] {
+	return &Ring[T]{items: make([]T, size)}
+}
+
+func (r *Ring[T]) Add(item T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.items) == 0 {
+		return
+	}
+	r.items[r.next] = item
+	r.next = (r.next + 1) % len(r.items)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Recent returns up to n items, all of them when n is 0 or less, most
+// recent first.
+func (r *Ring[T]) Recent(n int) []T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := r.next
+	if r.full {
+		count = len(r.items)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+
+	recent := make([]T, 0, n)
+	for i := 1; i <= n; i++ {
+		recent = append(recent, r.items[(r.next-i+len(r.items))%len(r.items)])
+	}
+	return recent
+}
@@ -0,0 +1,31 @@
+package ring
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecent(t *testing.T) {
+	tests := []struct {
+		size  int
+		added int
+		n     int
+		want  []int
+	}{
+		{3, 0, 0, []int{}},
+		{3, 2, 0, []int{2, 1}},
+		{3, 5, 0, []int{5, 4, 3}},
+		{3, 5, 2, []int{5, 4}},
+		{3, 5, 10, []int{5, 4, 3}},
+		{0, 5, 0, []int{}},
+	}
+	for _, tt := range tests {
+		r := New[int](tt.size)
+		for i := 1; i <= tt.added; i++ {
+			r.Add(i)
+		}
+		if got := r.Recent(tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("size %d, %d added, Recent(%d) = %v, want %v", tt.size, tt.added, tt.n, got, tt.want)
+		}
+	}
+}
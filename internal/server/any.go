@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// anyTTL is the TTL of synthesized ANY answers, RFC 8482 suggests a long one
+const anyTTL = 3600
+
+// minimalAny answers a QTYPE=ANY query with a single synthesized HINFO
+// record instead of every RRset of the name, see
+// https://datatracker.ietf.org/doc/html/rfc8482#section-4.2
+// Forwarding ANY queries makes the resolver a good amplifier for little use,
+// most clients asking for ANY only want to know the name exists.
+func minimalAny(req *request) parser.Payload {
+	reply := newReply(req, parser.RcodeNoError)
+	q := req.full().Questions[0]
+
+	// HINFO rdata is two character strings, CPU and OS
+	cpu := "RFC8482"
+	rdata := append([]byte{byte(len(cpu))}, cpu...)
+	rdata = append(rdata, 0)
+
+	reply.Answers = []parser.Resource{{
+		RName:  q.QName,
+		RType:  parser.TypeHINFO,
+		RClass: q.QClass,
+		RTtl:   anyTTL,
+		RData:  rdata,
+	}}
+	return reply
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/gertanoh/dns-resolver/internal/blocklist"
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+func TestMinimalAny(t *testing.T) {
+	b := blocklist.NewBuilder()
+	b.Add("ads", "ads.example.com")
+	list := b.Build()
+	tests := []struct {
+		name    string
+		mode    string
+		source  string
+		rcode   uint16
+		answers int
+	}{
+		{"www.example.com", BlockNull, SourceSynthesized, parser.RcodeNoError, 1},
+		{"ads.example.com", BlockNull, SourceBlocklist, parser.RcodeNoError, 0},
+		{"tracker.ads.example.com", BlockNXDomain, SourceBlocklist, parser.RcodeNXDomain, 0},
+	}
+	client := netip.MustParseAddr("192.168.1.20")
+	for _, tt := range tests {
+		s := New(Config{Upstream: staticUpstream{}, MinimalAny: true, Blocklist: list, BlockMode: tt.mode})
+		answer, source, err := s.Resolve(context.Background(), query(tt.name, parser.TypeANY), client, nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if source.Kind != tt.source {
+			t.Errorf("%s: answered from %s, want %s", tt.name, source.Kind, tt.source)
+		}
+		payload, err := parser.Parse(answer)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if rcode := payload.Header.Flags & parser.RcodeMask; rcode != tt.rcode || len(payload.Answers) != tt.answers {
+			t.Errorf("%s: rcode %d with %d answers, want %d with %d", tt.name, rcode, len(payload.Answers), tt.rcode, tt.answers)
+			continue
+		}
+		if tt.answers == 0 {
+			continue
+		}
+		hinfo := payload.Answers[0]
+		// CPU "RFC8482" and an empty OS, as character strings
+		want := "\x07RFC8482\x00"
+		if hinfo.RType != parser.TypeHINFO || hinfo.RTtl != anyTTL || string(hinfo.RData) != want {
+			t.Errorf("%s: answer type %d, TTL %d, rdata %q, want HINFO, %d, %q", tt.name, hinfo.RType, hinfo.RTtl, hinfo.RData, anyTTL, want)
+		}
+	}
+}
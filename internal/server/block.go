@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// How blocked names are answered
+const (
+	BlockNXDomain = "nxdomain" // the name does not exist
+	BlockNull     = "null"     // the name resolves to 0.0.0.0 or ::
+)
+
+// blockedTTL is the TTL of null answers, short enough for unblocking to
+// take effect quickly
+const blockedTTL = 60
+
+// blocked answers a query for a blocked name according to mode.
+func blocked(req *request, mode string) parser.Payload {
+	if mode == BlockNXDomain {
+		return newReply(req, parser.RcodeNXDomain)
+	}
+
+	reply := newReply(req, parser.RcodeNoError)
+	q := req.full().Questions[0]
+	var rdata []byte
+	switch q.QType {
+	case parser.TypeA:
+		rdata = net.IPv4zero.To4()
+	case parser.TypeAAAA:
+		rdata = net.IPv6zero
+	default:
+		return reply
+	}
+	reply.Answers = []parser.Resource{{RName: q.QName, RType: q.QType, RClass: q.QClass, RTtl: blockedTTL, RData: rdata}}
+	return reply
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/cache"
+	"github.com/gertanoh/dns-resolver/internal/clock"
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// maxCacheTTL caps how long an answer is kept, whatever its TTL
+const maxCacheTTL = 86400
+
+// maxStaleTTL is the TTL of records served past their expiry, see
+// https://datatracker.ietf.org/doc/html/rfc8767#section-4
+const maxStaleTTL = 30
+
+// store caches msg, the upstream answer to the query viewed by v, for the
+// lowest TTL of its records, or for negative answers the SOA TTL bounded by
+// its minimum field, see https://datatracker.ietf.org/doc/html/rfc2308#section-5
+// The OPT record is dropped, it is added back for EDNS clients. Answers
+// tailored to a client subnet are not shared with other clients.
+func (s *Server) store(key []byte, v parser.QuestionView, msg []byte, now clock.Time) {
+	if v.HasClientSubnet || len(msg) < v.End || binary.BigEndian.Uint16(msg[4:6]) != 1 ||
+		!bytes.EqualFold(msg[12:v.End], v.Msg[12:v.End]) {
+		return
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	rcode := flags & parser.RcodeMask
+	if flags&parser.FlagTC != 0 || (rcode != parser.RcodeNoError && rcode != parser.RcodeNXDomain) {
+		return
+	}
+	negative := rcode == parser.RcodeNXDomain || binary.BigEndian.Uint16(msg[6:8]) == 0
+
+	var scratch [32]int
+	offsets := scratch[:0]
+	ttl := uint32(maxCacheTTL)
+	soa := false
+	optStart, afterOPT := -1, false
+	err := parser.WalkRecords(msg, func(rr parser.RecordView) {
+		if rr.Type == parser.TypeOPT {
+			optStart = rr.Start
+			return
+		}
+		if optStart >= 0 {
+			afterOPT = true
+		}
+		offsets = append(offsets, rr.TTLOffset)
+		switch {
+		case !negative:
+			ttl = min(ttl, rr.TTL)
+		case rr.Section == parser.SectionAuthority && rr.Type == parser.TypeSOA && len(rr.RData) >= 20 && !soa:
+			minimum := binary.BigEndian.Uint32(rr.RData[len(rr.RData)-4:])
+			ttl = min(rr.TTL, minimum, maxCacheTTL)
+			soa = true
+		}
+	})
+	// Without SOA, a negative answer must not be cached
+	if err != nil || afterOPT || ttl == 0 || (negative && !soa) {
+		return
+	}
+
+	stored := slices.Clone(msg)
+	if optStart >= 0 {
+		stored = stored[:optStart]
+		binary.BigEndian.PutUint16(stored[10:12], binary.BigEndian.Uint16(stored[10:12])-1)
+	}
+	s.cache.Set(key, cache.Entry{Msg: stored, TTLOffsets: slices.Clone(offsets), Stored: now, TTL: ttl})
+}
+
+// appendCached appends to dst the answer to the query viewed by v from a
+// cached entry: with the client's ID and question, TTLs decreased by the
+// time spent in cache, staleTTL for those expired, and an OPT record for
+// EDNS clients.
+func appendCached(dst []byte, e cache.Entry, v parser.QuestionView, now clock.Time, staleTTL uint32) []byte {
+	start := len(dst)
+	dst = append(dst, e.Msg...)
+	msg := dst[start:]
+
+	binary.BigEndian.PutUint16(msg[0:2], v.ID)
+	flags := binary.BigEndian.Uint16(msg[2:4])&^parser.FlagRD | v.Flags&parser.FlagRD
+	binary.BigEndian.PutUint16(msg[2:4], flags)
+	// Same name but maybe not the same case, keep the client's
+	copy(msg[12:v.End], v.Msg[12:v.End])
+
+	elapsed := uint32(now.Sub(e.Stored) / time.Second)
+	for _, off := range e.TTLOffsets {
+		ttl := binary.BigEndian.Uint32(msg[off:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = staleTTL
+		}
+		binary.BigEndian.PutUint32(msg[off:], ttl)
+	}
+
+	if v.HasOPT {
+		dst = parser.AppendOPT(dst, maxUDPSize)
+		binary.BigEndian.PutUint16(dst[start+10:], binary.BigEndian.Uint16(dst[start+10:])+1)
+	}
+	return dst
+}
+
+// staleTTL returns the TTL of the records of e served stale at now:
+// maxStaleTTL, or less when e leaves the stretch window sooner, so that
+// clients do not keep them past it.
+func (s *Server) staleTTL(e cache.Entry, now clock.Time) uint32 {
+	left := time.Duration(float64(e.TTL)*s.stretch*float64(time.Second)) - now.Sub(e.Stored)
+	return uint32(min(maxStaleTTL, max(1, (left+time.Second-1)/time.Second)))
+}
+
+// refresh resolves the query of req again in the background, replacing the
+// stale cache entry of key. A single refresh of a key runs at a time, none
+// in the PanicCacheOnly mode.
+func (s *Server) refresh(key []byte, req *request) {
+	up := s.exchanger()
+	if up == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.refreshing[string(key)] {
+		s.mu.Unlock()
+		return
+	}
+	k := string(key)
+	s.refreshing[k] = true
+	s.mu.Unlock()
+
+	// req and its buffer are recycled once answered
+	query := slices.Clone(req.query)
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.refreshing, k)
+			s.mu.Unlock()
+		}()
+
+		view, err := parser.ViewQuestion(query)
+		if err != nil {
+			return
+		}
+		response, err := up.Exchange(context.Background(), query, nil)
+		if err != nil {
+			log.Printf("Failed to refresh stale answer: %v", err)
+			return
+		}
+		if err := parser.WalkRecords(response, func(parser.RecordView) {}); err != nil {
+			log.Printf("Failed to refresh stale answer: malformed answer from upstream %s: %v", up, err)
+			return
+		}
+		s.store([]byte(k), view, response, clock.Now())
+	}()
+}
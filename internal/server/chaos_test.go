@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/cache"
+	"github.com/gertanoh/dns-resolver/internal/clock"
+	"github.com/gertanoh/dns-resolver/internal/parser"
+	"github.com/gertanoh/dns-resolver/internal/upstream"
+)
+
+// chaosTimeout is how long exchanges of queries dropped by chaos mode take
+const chaosTimeout = 20 * time.Millisecond
+
+// dropAll is an upstream whose queries are all lost.
+func dropAll() *upstream.Chaos {
+	return &upstream.Chaos{Upstream: staticUpstream{}, DropRate: 1, Timeout: chaosTimeout, Seed: 1}
+}
+
+// primeCache stores the answer to q in the cache of s as if it had been
+// received age ago, staticUpstream answers having a TTL of 300s.
+func primeCache(t *testing.T, s *Server, q []byte, age time.Duration) {
+	view, err := parser.ViewQuestion(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := staticUpstream{}.Exchange(context.Background(), q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.store(view.AppendKey(nil), view, answer, clock.Now().Add(-age))
+}
+
+func TestChaosDropTimesOut(t *testing.T) {
+	s := New(Config{Upstream: dropAll()})
+	q := query("www.example.com", parser.TypeA)
+	client := netip.MustParseAddr("192.168.1.20")
+
+	start := time.Now()
+	if _, _, err := s.Resolve(context.Background(), q, client, nil); err == nil {
+		t.Fatal("dropped query answered")
+	}
+	if elapsed := time.Since(start); elapsed < chaosTimeout {
+		t.Errorf("dropped query failed after %v, before the %v timeout", elapsed, chaosTimeout)
+	}
+
+	// The caller's deadline wins over the upstream timeout
+	ctx, cancel := context.WithTimeout(context.Background(), chaosTimeout/4)
+	defer cancel()
+	if _, _, err := s.Resolve(ctx, q, client, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want the context deadline", err)
+	}
+}
+
+func TestChaosServesStale(t *testing.T) {
+	tests := []struct {
+		name    string
+		stretch float64
+		age     time.Duration
+		source  string // "" for no answer
+		ttl     uint32
+	}{
+		{"fresh", 1.5, 200 * time.Second, SourceCache, 100},
+		{"expired without stretch", 1, 310 * time.Second, "", 0},
+		{"expired within stretch", 1.5, 310 * time.Second, SourceStale, maxStaleTTL},
+		{"expired near the end of stretch", 1.5, 440 * time.Second, SourceStale, 10},
+		{"expired past stretch", 1.5, 460 * time.Second, "", 0},
+	}
+	q := query("www.example.com", parser.TypeA)
+	client := netip.MustParseAddr("192.168.1.20")
+	for _, tt := range tests {
+		s := New(Config{Upstream: dropAll(), Cache: cache.New(100, 1), Stretch: tt.stretch})
+		primeCache(t, s, q, tt.age)
+
+		answer, source, err := s.Resolve(context.Background(), q, client, nil)
+		if tt.source == "" {
+			if err == nil {
+				t.Errorf("%s: answered from %s with the upstream down", tt.name, source)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if source.Kind != tt.source {
+			t.Errorf("%s: answered from %s, want %s", tt.name, source.Kind, tt.source)
+		}
+		payload, err := parser.Parse(answer)
+		if err != nil || len(payload.Answers) != 2 {
+			t.Errorf("%s: answer %v with %d records, want 2", tt.name, err, len(payload.Answers))
+			continue
+		}
+		// Ages are whole seconds but the clock moves on while resolving
+		if ttl := payload.Answers[0].RTtl; ttl != tt.ttl && ttl != tt.ttl-1 {
+			t.Errorf("%s: TTL %d, want %d", tt.name, ttl, tt.ttl)
+		}
+	}
+}
+
+func TestChaosSameSeedSameFaults(t *testing.T) {
+	q := query("www.example.com", parser.TypeA)
+	outcomes := func() []bool {
+		c := &upstream.Chaos{Upstream: staticUpstream{}, DropRate: 0.5, Timeout: time.Millisecond, Seed: 42}
+		var answered []bool
+		for i := 0; i < 20; i++ {
+			_, err := c.Exchange(context.Background(), q, nil)
+			answered = append(answered, err == nil)
+		}
+		return answered
+	}
+	first, second := outcomes(), outcomes()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("exchange %d answered %v, then %v with the same seed", i, first[i], second[i])
+		}
+	}
+}
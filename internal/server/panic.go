@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gertanoh/dns-resolver/internal/upstream"
+)
+
+// Panic modes, conservative configurations switched to during security
+// incidents or upstream outages, see SetPanicMode.
+const (
+	PanicOff = "off"
+	// PanicCacheOnly answers from local data and cache only, cached
+	// answers however old, queries missing from cache get SERVFAIL and no
+	// traffic goes upstream.
+	PanicCacheOnly = "cache-only"
+	// PanicFallback sends the queries missing from cache to the fallback
+	// upstream instead of the usual one.
+	PanicFallback = "fallback"
+)
+
+// panicModes are indexed by Server.panicMode
+var panicModes = []string{PanicOff, PanicCacheOnly, PanicFallback}
+
+// SetPanicMode switches to one of the panic modes, or back to normal
+// operation with PanicOff. It takes effect on the next query.
+func (s *Server) SetPanicMode(mode string) error {
+	for i, m := range panicModes {
+		if m != mode {
+			continue
+		}
+		if mode == PanicFallback && s.fallback == nil {
+			return errors.New("no fallback upstream configured")
+		}
+		s.panicMode.Store(uint32(i))
+		return nil
+	}
+	return fmt.Errorf("unknown panic mode %q, expected %s, %s or %s", mode, PanicOff, PanicCacheOnly, PanicFallback)
+}
+
+// PanicMode returns the current panic mode.
+func (s *Server) PanicMode() string {
+	return panicModes[s.panicMode.Load()]
+}
+
+// exchanger returns where queries missing from cache are sent in the
+// current panic mode, nil when they must not leave the resolver.
+func (s *Server) exchanger() upstream.Exchanger {
+	switch panicModes[s.panicMode.Load()] {
+	case PanicCacheOnly:
+		return nil
+	case PanicFallback:
+		return s.fallback
+	}
+	return s.upstream
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/cache"
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+func TestCacheOnlyServesAnyAge(t *testing.T) {
+	s := New(Config{Upstream: staticUpstream{}, Cache: cache.New(100, 1), Stretch: 1.5})
+	cached := query("www.example.com", parser.TypeA)
+	// Long past its TTL of 300s and past the stretch
+	primeCache(t, s, cached, 24*time.Hour)
+	client := netip.MustParseAddr("192.168.1.20")
+
+	if err := s.SetPanicMode(PanicCacheOnly); err != nil {
+		t.Fatal(err)
+	}
+	answer, source, err := s.Resolve(context.Background(), cached, client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := parser.Parse(answer)
+	if err != nil || source.Kind != SourceStale || len(payload.Answers) != 2 || payload.Answers[0].RTtl != maxStaleTTL {
+		t.Errorf("cache-only answer from %s, %v: %+v", source.Kind, err, payload.Answers)
+	}
+	answer, source, err = s.Resolve(context.Background(), query("missing.example.com", parser.TypeA), client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.Kind != SourcePanic || uint16(answer[3])&parser.RcodeMask != parser.RcodeServFail {
+		t.Errorf("query missing from cache answered from %s with rcode %d, want SERVFAIL", source.Kind, answer[3]&0xF)
+	}
+
+	// Back to normal, the entry is too old to be served
+	if err := s.SetPanicMode(PanicOff); err != nil {
+		t.Fatal(err)
+	}
+	if _, source, err = s.Resolve(context.Background(), cached, client, nil); err != nil || source.Kind != SourceUpstream {
+		t.Errorf("answered from %s, %v, want upstream", source.Kind, err)
+	}
+}
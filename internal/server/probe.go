@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/netip"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// Probe resolves name through the whole pipeline, as a query from the
+// loopback address would be, and fails unless it gets addresses back.
+func (s *Server) Probe(ctx context.Context, name string) error {
+	answer, source, err := s.lookup(ctx, name, parser.TypeA, false)
+	if err != nil {
+		return err
+	}
+	if rcode := answer.Header.Flags & parser.RcodeMask; rcode != parser.RcodeNoError {
+		return fmt.Errorf("%s answered %s", source, parser.RcodeString(rcode))
+	}
+	if len(answer.Answers) == 0 {
+		return fmt.Errorf("%s answered without records", source)
+	}
+	return nil
+}
+
+// Prefetch resolves name through the whole pipeline so its answer is
+// cached by the time clients ask. It is not counted in the stats and only
+// fails when no answer comes back, NXDOMAIN is as worth caching as any.
+func (s *Server) Prefetch(ctx context.Context, name string, qtype uint16) error {
+	_, _, err := s.lookup(ctx, name, qtype, true)
+	return err
+}
+
+// lookup resolves a question as a query from the loopback address.
+func (s *Server) lookup(ctx context.Context, name string, qtype uint16, prefetch bool) (parser.Payload, Source, error) {
+	query, err := parser.Pack(parser.Payload{
+		Header:    parser.Header{ID: uint16(rand.Intn(1 << 16)), Flags: parser.FlagRD},
+		Questions: []parser.Question{{QName: name, QType: qtype, QClass: parser.ClassIN}},
+	})
+	if err != nil {
+		return parser.Payload{}, Source{}, err
+	}
+	view, err := parser.ViewQuestion(query)
+	if err != nil {
+		return parser.Payload{}, Source{}, err
+	}
+
+	var req request
+	req.init(query, view, netip.IPv6Loopback())
+	req.prefetch = prefetch
+	response, err := s.resolve(ctx, &req, nil)
+	if err != nil {
+		return parser.Payload{}, req.source, err
+	}
+	answer, err := parser.Parse(response)
+	if err != nil {
+		return parser.Payload{}, req.source, fmt.Errorf("invalid answer from %s: %w", req.source, err)
+	}
+	return answer, req.source, nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/binary"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+	"github.com/gertanoh/dns-resolver/internal/zone"
+)
+
+// minUDPSize is the payload size every client accepts, see
+// https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.1
+const minUDPSize = 512
+
+// newReply returns an empty answer to req with the given response code.
+// The question is echoed back and, if the client speaks EDNS, so is an OPT
+// record advertising our own payload size.
+func newReply(req *request, rcode uint16) parser.Payload {
+	reply := parser.Payload{
+		Header: parser.Header{
+			ID:    req.view.ID,
+			Flags: parser.FlagQR | parser.FlagRA | req.view.Flags&(parser.OpcodeMask|parser.FlagRD) | rcode,
+		},
+		Questions: req.full().Questions,
+	}
+	if req.view.HasOPT {
+		reply.Additionals = append(reply.Additionals, parser.Resource{RType: parser.TypeOPT, RClass: maxUDPSize})
+	}
+	return reply
+}
+
+// localAnswer returns the authoritative reply to req from a local zone, or
+// from an override of the hosts file when the answer has no zone.
+func localAnswer(req *request, answer zone.Answer) parser.Payload {
+	req.source = Source{Kind: SourceOverride}
+	if answer.Zone != "" {
+		req.source = Source{Kind: SourceLocalZone, Detail: answer.Zone}
+	}
+	reply := newReply(req, answer.Rcode)
+	if answer.Rcode != parser.RcodeServFail {
+		reply.Header.Flags |= parser.FlagAA
+	}
+	reply.Answers = answer.Answers
+	reply.Authorities = answer.Authorities
+	return reply
+}
+
+// formErr returns the answer to a query the resolver cannot make sense of,
+// a bare header with FORMERR. Messages without a full header, and
+// responses, which would start a loop between two servers, get no answer.
+func formErr(query []byte) ([]byte, bool) {
+	if len(query) < 12 {
+		return nil, false
+	}
+	flags := binary.BigEndian.Uint16(query[2:4])
+	if flags&parser.FlagQR != 0 {
+		return nil, false
+	}
+	reply := make([]byte, 12)
+	copy(reply[0:2], query[0:2])
+	flags = parser.FlagQR | parser.FlagRA | flags&(parser.OpcodeMask|parser.FlagRD) | parser.RcodeFormErr
+	binary.BigEndian.PutUint16(reply[2:4], flags)
+	return reply, true
+}
+
+// truncate cuts response, the answer to the query viewed by v, down to its
+// question with the TC flag set when it exceeds what the client accepts
+// over UDP: 512 bytes, or the payload size advertised by EDNS clients,
+// however large. The resolver does not listen on TCP, so answers the
+// client can take are never truncated: it could not retry, see
+// https://datatracker.ietf.org/doc/html/rfc2181#section-9
+func truncate(response []byte, v parser.QuestionView) []byte {
+	limit := minUDPSize
+	if v.HasOPT {
+		limit = max(minUDPSize, int(v.UDPSize))
+	}
+	if len(response) <= limit || len(response) < v.End {
+		return response
+	}
+
+	response = response[:v.End]
+	binary.BigEndian.PutUint16(response[2:4], binary.BigEndian.Uint16(response[2:4])|parser.FlagTC)
+	clear(response[6:12])
+	if v.HasOPT {
+		response = parser.AppendOPT(response, maxUDPSize)
+		binary.BigEndian.PutUint16(response[10:12], 1)
+	}
+	return response
+}
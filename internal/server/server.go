@@ -0,0 +1,761 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"log"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/anomaly"
+	"github.com/gertanoh/dns-resolver/internal/blocklist"
+	"github.com/gertanoh/dns-resolver/internal/cache"
+	"github.com/gertanoh/dns-resolver/internal/clock"
+	"github.com/gertanoh/dns-resolver/internal/device"
+	"github.com/gertanoh/dns-resolver/internal/ipset"
+	"github.com/gertanoh/dns-resolver/internal/kube"
+	"github.com/gertanoh/dns-resolver/internal/metrics"
+	"github.com/gertanoh/dns-resolver/internal/parser"
+	"github.com/gertanoh/dns-resolver/internal/policy"
+	"github.com/gertanoh/dns-resolver/internal/querylog"
+	"github.com/gertanoh/dns-resolver/internal/rewrite"
+	"github.com/gertanoh/dns-resolver/internal/upstream"
+	"github.com/gertanoh/dns-resolver/internal/warmup"
+	"github.com/gertanoh/dns-resolver/internal/zone"
+)
+
+// maxUDPSize is the largest message accepted from clients and the payload
+// size advertised to EDNS clients. Plain DNS messages are lower than 512.
+const maxUDPSize = 1232
+
+// queryKey identifies a query from a given client. Stub resolvers keep the
+// same ID and question when they retransmit, so two queries with the same
+// key are duplicates of each other. The question is kept as a hash so that
+// keys do not allocate.
+type queryKey struct {
+	client   netip.AddrPort
+	id       uint16
+	question uint64
+}
+
+// resolution tracks the answer to a query. Resolutions are recycled through
+// resolutionPool along with their response buffer.
+type resolution struct {
+	done        bool
+	response    []byte
+	expires     time.Time
+	retransmits int // received while resolving
+}
+
+var resolutionPool = sync.Pool{New: func() any { return new(resolution) }}
+
+// bufferPool holds the buffers messages are read into and answers written to
+var bufferPool = sync.Pool{New: func() any {
+	buf := make([]byte, upstream.MaxMessageSize)
+	return &buf
+}}
+
+// request is a query going through the resolution pipeline. Stages route it
+// with the question view and name, the query is only fully decoded, by
+// full, for stages that need more.
+type request struct {
+	query  []byte
+	view   parser.QuestionView
+	client netip.Addr
+	source Source
+	// prefetch is set on the resolver's own warm-up queries, left out of
+	// the stats
+	prefetch bool
+
+	// Where the time went, measured when metrics or the slow-query log
+	// need it
+	timed    bool
+	trace    uint64
+	lapStart time.Time
+	spent    breakdown
+
+	payload parser.Payload
+	parsed  bool
+
+	nameBuf [255]byte
+	nameLen int
+}
+
+func (r *request) init(query []byte, view parser.QuestionView, client netip.Addr) {
+	r.query, r.view, r.client = query, view, client
+	r.nameLen = len(view.AppendName(r.nameBuf[:0]))
+}
+
+type breakdown struct {
+	policy, cache, upstream time.Duration
+	retransmits             int // received from the client
+}
+
+// lap adds the time since the previous lap to d, when r is timed.
+func (r *request) lap(d *time.Duration) {
+	if !r.timed {
+		return
+	}
+	now := time.Now()
+	*d += now.Sub(r.lapStart)
+	r.lapStart = now
+}
+
+// name returns the lowercased question name, see
+// parser.QuestionView.AppendName. It is kept as a length rather than a
+// slice: a request pointing into itself would be moved to the heap.
+func (r *request) name() []byte {
+	return r.nameBuf[:r.nameLen]
+}
+
+// full returns the decoded query, decoding it on first use.
+func (r *request) full() parser.Payload {
+	if !r.parsed {
+		// The view already checked the message is well formed
+		r.payload, _ = parser.Parse(r.query)
+		r.parsed = true
+	}
+	return r.payload
+}
+
+// clientIP returns the client address as a net.IP.
+func (r *request) clientIP() net.IP {
+	return net.IP(r.client.Unmap().AsSlice())
+}
+
+type Config struct {
+	Upstream upstream.Exchanger
+	// Fallback, when set, replaces Upstream in the PanicFallback mode.
+	Fallback upstream.Exchanger
+	// Retransmissions received within DupWindow after a query was answered
+	// are served from that answer.
+	DupWindow time.Duration
+	// SortList, when set, orders address answers for the client's subnet.
+	SortList *SortList
+	// MinimalAny answers ANY queries locally instead of forwarding them.
+	MinimalAny bool
+	// Zones, when set, answers queries for local names and reverse zones.
+	Zones *zone.Zones
+	// Kubernetes, when set, answers queries for the service names of a
+	// cluster.
+	Kubernetes *kube.Cluster
+	// Blocklist, when set, holds names answered according to BlockMode
+	// instead of being resolved.
+	Blocklist *blocklist.List
+	BlockMode string
+	// BlockHits, when set, records the queries answered from the blocklist.
+	BlockHits *blocklist.Hits
+	// Devices, when set, names clients in logs and gives policies their
+	// hardware address and device name.
+	Devices *device.Directory
+	// Policy, when set, may block queries depending on the client, the
+	// name and the time, answered according to BlockMode too.
+	Policy policy.Chain
+	// Rewrite, when set, modifies the answers to queries for some names.
+	Rewrite *rewrite.Rewriter
+	// IPSet, when set, exports the addresses answered for some names to
+	// firewall sets.
+	IPSet *ipset.Exporter
+	// Anomaly, when set, watches the names clients resolve for signs of
+	// malware.
+	Anomaly *anomaly.Detector
+	// Cache, when set, keeps upstream answers until they expire.
+	Cache *cache.Cache
+	// Stretch, when above 1, serves cached answers until their age reaches
+	// Stretch times their TTL, refreshing expired ones in the background:
+	// clients get answers from cache rather than waiting for the upstream,
+	// at the cost of answers a little older than their TTL allows.
+	Stretch float64
+	// Stats, when set, counts the queries of names resolved from cache or
+	// upstream, to prefetch the most queried ones on the next start.
+	Stats *warmup.Stats
+	// LogQueries logs a line for every answered query.
+	LogQueries bool
+	// QueryLog, when set, records every answered query.
+	QueryLog *querylog.Log
+	// Metrics, when set, gets latency histograms with trace ID exemplars.
+	Metrics *metrics.Registry
+	// Queries answered in SlowQuery or more are logged with a breakdown of
+	// where the time went, and recorded in SlowLog when set. 0 disables.
+	SlowQuery time.Duration
+	SlowLog   *querylog.Log
+	// Debug dumps messages and tells EDNS clients where answers came from
+	// in the EXTRA-TEXT of an Extended DNS Error.
+	Debug bool
+}
+
+type Server struct {
+	upstream   upstream.Exchanger
+	fallback   upstream.Exchanger
+	panicMode  atomic.Uint32 // index in panicModes
+	dupWindow  time.Duration
+	sortList   *SortList
+	minAny     bool
+	zones      atomic.Pointer[zone.Zones] // replaced on reload
+	kubernetes *kube.Cluster
+	blocklist  atomic.Pointer[blocklist.List] // replaced on reload
+	blockMode  string
+	blockHits  *blocklist.Hits
+	devices    *device.Directory
+	policy     policy.Chain
+	rewrite    *rewrite.Rewriter
+	ipset      *ipset.Exporter
+	anomaly    *anomaly.Detector
+	cache      *cache.Cache
+	stretch    float64
+	stats      *warmup.Stats
+	logQueries bool
+	queryLog   *querylog.Log
+	debug      bool
+
+	latency     *metrics.HistogramVec
+	upstreamRTT *metrics.Histogram
+	slowQueries *metrics.Counter
+	slowQuery   time.Duration
+	slowLog     *querylog.Log
+
+	seed     maphash.Seed
+	mu       sync.Mutex
+	inflight map[queryKey]*resolution
+	// keys of the stale cache entries being refreshed
+	refreshing map[string]bool
+
+	closing  atomic.Bool
+	serving  map[*net.UDPConn]chan struct{} // closed when Serve returns
+	handlers sync.WaitGroup
+}
+
+// New returns a server forwarding queries to the configured upstream.
+func New(cfg Config) *Server {
+	s := &Server{
+		upstream:   cfg.Upstream,
+		fallback:   cfg.Fallback,
+		dupWindow:  cfg.DupWindow,
+		sortList:   cfg.SortList,
+		minAny:     cfg.MinimalAny,
+		kubernetes: cfg.Kubernetes,
+		blockMode:  cfg.BlockMode,
+		blockHits:  cfg.BlockHits,
+		devices:    cfg.Devices,
+		policy:     cfg.Policy,
+		rewrite:    cfg.Rewrite,
+		ipset:      cfg.IPSet,
+		anomaly:    cfg.Anomaly,
+		cache:      cfg.Cache,
+		stretch:    max(cfg.Stretch, 1),
+		stats:      cfg.Stats,
+		logQueries: cfg.LogQueries,
+		queryLog:   cfg.QueryLog,
+		debug:      cfg.Debug,
+		seed:       maphash.MakeSeed(),
+		inflight:   map[queryKey]*resolution{},
+		refreshing: map[string]bool{},
+		serving:    map[*net.UDPConn]chan struct{}{},
+		slowQuery:  cfg.SlowQuery,
+		slowLog:    cfg.SlowLog,
+	}
+	s.zones.Store(cfg.Zones)
+	s.blocklist.Store(cfg.Blocklist)
+	if cfg.Metrics != nil {
+		s.latency = cfg.Metrics.HistogramVec("dns_query_duration_seconds", "Time to answer queries, by source of the answer.", "source", metrics.LatencyBuckets)
+		s.upstreamRTT = cfg.Metrics.Histogram("dns_upstream_rtt_seconds", "Round trip time of upstream exchanges.", metrics.LatencyBuckets)
+		s.slowQueries = cfg.Metrics.Counter("dns_slow_queries", "Queries answered in the slow-query threshold or more.")
+	}
+	return s
+}
+
+// SetZones replaces the local zones, e.g. after the hosts file changed.
+func (s *Server) SetZones(z *zone.Zones) {
+	s.zones.Store(z)
+}
+
+// SetBlocklist replaces the blocklist, e.g. after its files changed.
+func (s *Server) SetBlocklist(l *blocklist.List) {
+	s.blocklist.Store(l)
+}
+
+// FlushCache removes the cached answers for domain and its subdomains, or
+// all of them when domain is empty, and returns how many were removed.
+func (s *Server) FlushCache(domain string) (int, error) {
+	if s.cache == nil {
+		return 0, nil
+	}
+	var wire []byte
+	if domain = strings.ToLower(strings.TrimSuffix(domain, ".")); domain != "" {
+		wire = parser.PackName(domain)
+		if len(wire) == 1 {
+			return 0, fmt.Errorf("invalid domain %q", domain)
+		}
+	}
+	return s.cache.Flush(wire), nil
+}
+
+// Serve reads queries from conn and answers each one in its own goroutine.
+// It returns nil once Shutdown is called.
+func (s *Server) Serve(conn *net.UDPConn) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.sweep(stop)
+
+	s.mu.Lock()
+	s.serving[conn] = stop
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.serving, conn)
+		s.mu.Unlock()
+	}()
+
+	for {
+		buf := bufferPool.Get().(*[]byte)
+		n, clientAddr, err := conn.ReadFromUDPAddrPort((*buf)[:maxUDPSize])
+		if err != nil {
+			bufferPool.Put(buf)
+			if s.closing.Load() {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Println(err)
+			continue
+		}
+		// IPv4 clients of a dual stack socket show up as mapped addresses
+		clientAddr = netip.AddrPortFrom(clientAddr.Addr().Unmap(), clientAddr.Port())
+		s.handlers.Add(1)
+		go s.handle(conn, buf, n, clientAddr)
+	}
+}
+
+// Shutdown stops reading queries and waits until the ones already read are
+// answered, or ctx is done. Sockets are left open: queries still arriving
+// on them are for whoever else reads them, such as an upgraded binary.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closing.Store(true)
+	s.mu.Lock()
+	serving := make([]chan struct{}, 0, len(s.serving))
+	for conn, stop := range s.serving {
+		// Wake up the reads, Serve returns seeing closing
+		conn.SetReadDeadline(time.Now())
+		serving = append(serving, stop)
+	}
+	s.mu.Unlock()
+
+	// No query is read after Serve returned, handlers can be waited for
+	for _, stop := range serving {
+		select {
+		case <-stop:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) handle(conn *net.UDPConn, buf *[]byte, n int, clientAddr netip.AddrPort) {
+	defer s.handlers.Done()
+	defer bufferPool.Put(buf)
+	start := time.Now()
+	query := (*buf)[:n]
+
+	if s.debug {
+		parser.Read(query, n)
+	}
+	view, err := parser.ViewQuestion(query)
+	if err != nil {
+		if reply, ok := formErr(query); ok {
+			log.Printf("Invalid query from %s: %v", clientAddr, err)
+			conn.WriteToUDPAddrPort(reply, clientAddr)
+		}
+		return
+	}
+	if view.Flags&parser.FlagQR != 0 {
+		return
+	}
+
+	key := queryKey{client: clientAddr, id: view.ID, question: maphash.Bytes(s.seed, query[12:view.End])}
+	r, answer, dup := s.track(key)
+	if dup {
+		s.replay(conn, answer, clientAddr)
+		return
+	}
+
+	var req request
+	req.init(query, view, clientAddr.Addr())
+	if s.latency != nil || s.slowQuery > 0 {
+		req.timed, req.trace, req.lapStart = true, rand.Uint64()|1, start
+	}
+	out := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(out)
+
+	response, err := s.resolve(context.Background(), &req, *out)
+	if err != nil {
+		log.Println(err)
+		s.forget(key, r)
+		return
+	}
+	response = truncate(response, view)
+	req.spent.retransmits = s.complete(r, response)
+
+	conn.WriteToUDPAddrPort(response, clientAddr)
+	// Sets get the addresses the client was actually sent, once it has them
+	if s.ipset != nil {
+		s.ipset.Export(req.name(), response)
+	}
+	// Names answered locally, or blocked, tell nothing about the client
+	if s.anomaly != nil && (req.source.Kind == SourceUpstream || req.source.Kind == SourceCache || req.source.Kind == SourceStale) {
+		s.anomaly.Observe(req.client, req.name(), uint16(response[3])&parser.RcodeMask == parser.RcodeNXDomain)
+	}
+	s.record(&req, response, time.Since(start))
+}
+
+// record logs the answer to req along with where it came from, and
+// observes its latency.
+func (s *Server) record(req *request, response []byte, elapsed time.Duration) {
+	if s.latency != nil {
+		s.latency.With(req.source.Kind).Observe(elapsed, req.trace)
+	}
+	slow := s.slowQuery > 0 && elapsed >= s.slowQuery
+	if !s.logQueries && s.queryLog == nil && !slow {
+		return
+	}
+	name := string(req.view.WireName())
+	if payload := req.full(); len(payload.Questions) > 0 {
+		name = payload.Questions[0].QName
+	}
+	qtype := parser.TypeString(req.view.QType)
+	rcode := parser.RcodeString(uint16(response[3]) & parser.RcodeMask)
+	var dev device.Device
+	if s.devices != nil {
+		dev, _ = s.devices.Lookup(req.client)
+	}
+	client := req.client.String()
+	if dev.Hostname != "" {
+		client += " (" + dev.Hostname + ")"
+	}
+	if s.logQueries {
+		log.Printf("%s %s %s %s from %s in %v", client, name, qtype, rcode, req.source, elapsed)
+	}
+
+	entry := querylog.Entry{
+		Time:         time.Now(),
+		Client:       req.client.String(),
+		ClientMAC:    dev.MAC,
+		ClientName:   dev.Hostname,
+		Name:         name,
+		Type:         qtype,
+		Rcode:        rcode,
+		Source:       req.source.Kind,
+		SourceDetail: req.source.Detail,
+		DurationMs:   milliseconds(elapsed),
+	}
+	if s.queryLog != nil {
+		s.queryLog.Add(entry)
+	}
+	if slow {
+		entry.Breakdown = &querylog.Breakdown{
+			TraceID:           fmt.Sprintf("%016x", req.trace),
+			PolicyMs:          milliseconds(req.spent.policy),
+			CacheMs:           milliseconds(req.spent.cache),
+			UpstreamMs:        milliseconds(req.spent.upstream),
+			ClientRetransmits: req.spent.retransmits,
+		}
+		log.Printf("Slow query: %s %s %s from %s in %v, trace %s: policy %v, cache %v, upstream %v, %d client retransmits",
+			client, name, qtype, req.source, elapsed, entry.Breakdown.TraceID,
+			req.spent.policy, req.spent.cache, req.spent.upstream, req.spent.retransmits)
+		if s.slowQueries != nil {
+			s.slowQueries.Inc()
+		}
+		if s.slowLog != nil {
+			s.slowLog.Add(entry)
+		}
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// parse decodes a message, dumping it in debug mode.
+func (s *Server) parse(msg []byte) (parser.Payload, error) {
+	if s.debug {
+		return parser.Read(msg, len(msg))
+	}
+	return parser.Parse(msg)
+}
+
+// track registers a resolution for key. A duplicate of a query seen within
+// the window gets dup, and the answer to that query in a pooled buffer when
+// there is one already, otherwise it is counted as a retransmit. Both are
+// done under the lock finding the duplicate: once unlocked, the resolution
+// may be recycled for another query.
+func (s *Server) track(key queryKey) (r *resolution, answer *[]byte, dup bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.inflight[key]; ok {
+		if !r.done {
+			r.retransmits++
+			return nil, nil, true
+		}
+		answer = bufferPool.Get().(*[]byte)
+		*answer = append((*answer)[:0], r.response...)
+		return nil, answer, true
+	}
+	r = resolutionPool.Get().(*resolution)
+	r.done = false
+	r.retransmits = 0
+	r.response = r.response[:0]
+	s.inflight[key] = r
+	return r, nil, false
+}
+
+// replay handles a duplicate query, answer being the answer to the original
+// query or nil while it is being resolved.
+func (s *Server) replay(conn *net.UDPConn, answer *[]byte, clientAddr netip.AddrPort) {
+	if answer == nil {
+		// The in-flight resolution answers the client once for all its copies
+		log.Printf("Retransmit of query from %s, attached to in-flight resolution", clientAddr)
+		return
+	}
+	defer bufferPool.Put(answer)
+	// Already answered, the client most likely lost the response
+	log.Printf("Retransmit of query from %s, replaying answer", clientAddr)
+	conn.WriteToUDPAddrPort(*answer, clientAddr)
+}
+
+// complete keeps the response of r for replays until the window is over.
+// It returns the number of retransmits received while resolving.
+func (s *Server) complete(r *resolution, response []byte) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.response = append(r.response[:0], response...)
+	r.done = true
+	r.expires = time.Now().Add(s.dupWindow)
+	retransmits := r.retransmits
+	r.retransmits = 0
+	return retransmits
+}
+
+func (s *Server) forget(key queryKey, r *resolution) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inflight[key] == r {
+		delete(s.inflight, key)
+		resolutionPool.Put(r)
+	}
+}
+
+// sweep recycles completed resolutions once their window is over.
+func (s *Server) sweep(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, r := range s.inflight {
+				if r.done && now.After(r.expires) {
+					delete(s.inflight, key)
+					resolutionPool.Put(r)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Resolve answers query as if it came from client, writing the answer to
+// buf when possible. It returns the answer and where it came from.
+func (s *Server) Resolve(ctx context.Context, query []byte, client netip.Addr, buf []byte) ([]byte, Source, error) {
+	view, err := parser.ViewQuestion(query)
+	if err != nil {
+		return nil, Source{}, err
+	}
+	var req request
+	req.init(query, view, client)
+	response, err := s.resolve(ctx, &req, buf)
+	return response, req.source, err
+}
+
+// resolve answers the query, locally when possible, and returns the
+// answer for the client. It records in req where the answer came from.
+//
+// This is the hot path: answers from cache or upstream are written to buf
+// without allocating, unless the answer has to be reordered or annotated.
+func (s *Server) resolve(ctx context.Context, req *request, buf []byte) ([]byte, error) {
+	// Only standard queries are supported, NOTIFY, UPDATE and others are not
+	if req.view.Flags&parser.OpcodeMask != 0 {
+		req.source = Source{Kind: SourceSynthesized, Detail: "opcode"}
+		return s.finish(req, newReply(req, parser.RcodeNotImp))
+	}
+
+	if zones := s.zones.Load(); zones != nil && zones.Covers(req.name()) {
+		if answer, ok := zones.Lookup(req.full().Questions[0]); ok {
+			return s.finish(req, localAnswer(req, answer))
+		}
+	}
+	if s.kubernetes != nil && s.kubernetes.Covers(req.name()) {
+		if answer, ok := s.kubernetes.Lookup(req.full().Questions[0]); ok {
+			return s.finish(req, localAnswer(req, answer))
+		}
+	}
+
+	if list := s.blocklist.Load(); list != nil {
+		if match, ok := list.Lookup(req.name()); ok {
+			req.lap(&req.spent.policy)
+			req.source = Source{Kind: SourceBlocklist, Detail: match.Source + " " + match.Rule}
+			if s.blockHits != nil {
+				s.blockHits.Record(req.client, req.name(), match)
+			}
+			return s.finish(req, blocked(req, s.blockMode))
+		}
+	}
+
+	if len(s.policy) > 0 {
+		// A copy, policies may keep the name and req must stay on the stack
+		var name [255]byte
+		q := policy.Query{Client: req.client, Name: append(name[:0], req.name()...), Type: req.view.QType, Time: time.Now()}
+		if s.devices != nil {
+			if dev, ok := s.devices.Lookup(req.client); ok {
+				q.MAC, q.Device = dev.MAC, dev.Hostname
+			}
+		}
+		if v := s.policy.Check(&q); v.Action == policy.Block {
+			req.lap(&req.spent.policy)
+			req.source = Source{Kind: SourcePolicy, Detail: v.Rule}
+			return s.finish(req, blocked(req, s.blockMode))
+		}
+	}
+
+	req.lap(&req.spent.policy)
+
+	// After the blocklist and the policy, which still hold for ANY queries
+	if s.minAny && req.view.QType == parser.TypeANY {
+		req.source = Source{Kind: SourceSynthesized, Detail: "RFC 8482"}
+		return s.finish(req, minimalAny(req))
+	}
+
+	if s.stats != nil && !req.prefetch {
+		s.stats.Record(req.name(), req.view.QType)
+	}
+
+	var keyBuf [260]byte
+	key := req.view.AppendKey(keyBuf[:0])
+
+	up := s.exchanger()
+	if s.cache != nil {
+		now := clock.Now()
+		// With nowhere to resolve them again, answers are served however old
+		stretch := s.stretch
+		if up == nil {
+			stretch = 0
+		}
+		e, stale, ok := s.cache.GetStale(key, now, stretch)
+		req.lap(&req.spent.cache)
+		if ok {
+			req.source = Source{Kind: SourceCache}
+			var staleTTL uint32
+			if stale {
+				req.source = Source{Kind: SourceStale}
+				staleTTL = maxStaleTTL
+				if up != nil {
+					staleTTL = s.staleTTL(e, now)
+					s.refresh(key, req)
+				}
+			}
+			return s.postProcess(req, appendCached(buf[:0], e, req.view, now, staleTTL))
+		}
+	}
+
+	if up == nil {
+		req.source = Source{Kind: SourcePanic, Detail: PanicCacheOnly}
+		return s.finish(req, newReply(req, parser.RcodeServFail))
+	}
+	response, err := up.Exchange(ctx, req.query, buf)
+	req.lap(&req.spent.upstream)
+	if s.upstreamRTT != nil && req.timed {
+		s.upstreamRTT.Observe(req.spent.upstream, req.trace)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upstream %s: %w", up, err)
+	}
+	// Clients are better off retrying than getting an answer they cannot read
+	if err := parser.WalkRecords(response, func(parser.RecordView) {}); err != nil {
+		return nil, fmt.Errorf("malformed answer from upstream %s: %w", up, err)
+	}
+	req.source = Source{Kind: SourceUpstream, Detail: up.String()}
+
+	if s.cache != nil {
+		s.store(key, req.view, response, clock.Now())
+		req.lap(&req.spent.cache)
+	}
+	return s.postProcess(req, response)
+}
+
+// postProcess rewrites and reorders the answer for the client and
+// annotates it in debug mode. Answers needing none of it are returned
+// untouched.
+func (s *Server) postProcess(req *request, response []byte) ([]byte, error) {
+	rewrite := s.rewrite != nil && s.rewrite.Matches(req.name())
+	if s.sortList == nil && !s.debug && !rewrite {
+		return response, nil
+	}
+
+	answer, err := s.parse(response)
+	if err != nil {
+		// Not ours to fix, hand it over untouched
+		log.Printf("Failed to parse answer: %v", err)
+		return response, nil
+	}
+	rewritten := false
+	if rewrite {
+		answer.Answers, rewritten = s.rewrite.Rewrite(req.name(), answer.Answers)
+	}
+	if !s.sortAnswers(req, answer.Answers) && !rewritten && !s.debug {
+		return response, nil
+	}
+	packed, err := s.finish(req, answer)
+	if err != nil {
+		log.Printf("Failed to encode answer: %v", err)
+		return response, nil
+	}
+	return packed, nil
+}
+
+// sortAnswers orders the answers for the client when a sortlist is
+// configured, and reports whether they changed.
+func (s *Server) sortAnswers(req *request, answers []parser.Resource) bool {
+	return s.sortList != nil && s.sortList.Sort(answers, s.sortList.clientSubnet(req.full(), req.clientIP()))
+}
+
+// finish encodes the reply to req. In debug mode, EDNS clients are told
+// where the answer came from.
+func (s *Server) finish(req *request, reply parser.Payload) ([]byte, error) {
+	if req.view.HasOPT && s.debug {
+		reply.SetOption(parser.ExtendedError(0, "source: "+req.source.String()))
+	}
+	return parser.Pack(reply)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/cache"
+	"github.com/gertanoh/dns-resolver/internal/clock"
+	"github.com/gertanoh/dns-resolver/internal/parser"
+	"github.com/gertanoh/dns-resolver/internal/upstream"
+)
+
+// query returns a query for name as a stub resolver would send it.
+func query(name string, qtype uint16) []byte {
+	msg, err := parser.Pack(parser.Payload{
+		Header:    parser.Header{ID: 0xbeef, Flags: parser.FlagRD},
+		Questions: []parser.Question{{QName: name, QType: qtype, QClass: parser.ClassIN}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// staticUpstream answers every query with the same addresses, without
+// leaving the process, so that benchmarks only measure the resolver.
+type staticUpstream struct{}
+
+func (staticUpstream) String() string {
+	return "static"
+}
+
+func (staticUpstream) Exchange(ctx context.Context, query []byte, buf []byte) ([]byte, error) {
+	payload, err := parser.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	payload.Header.Flags |= parser.FlagQR | parser.FlagRA
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		payload.Answers = append(payload.Answers, parser.Resource{
+			RName: payload.Questions[0].QName, RType: parser.TypeA, RClass: parser.ClassIN, RTtl: 300, RData: net.ParseIP(ip).To4(),
+		})
+	}
+	answer, err := parser.Pack(payload)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf[:0], answer...), nil
+}
+
+// preparedUpstream copies a prepared answer, patching its ID, the way a
+// socket read fills the buffer given to a real upstream.
+type preparedUpstream struct {
+	answer []byte
+}
+
+func (p *preparedUpstream) String() string {
+	return "prepared"
+}
+
+func (p *preparedUpstream) Exchange(ctx context.Context, query []byte, buf []byte) ([]byte, error) {
+	buf = append(buf[:0], p.answer...)
+	binary.BigEndian.PutUint16(buf, binary.BigEndian.Uint16(query))
+	return buf, nil
+}
+
+// fastPathServers are the servers of the fast path benchmarks, answering
+// from cache or forwarding every query.
+func fastPathServers(t testing.TB) map[string]*Server {
+	answer, err := staticUpstream{}.Exchange(context.Background(), query("www.example.com", parser.TypeA), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]*Server{
+		"cache-hit": New(Config{Upstream: &preparedUpstream{answer: answer}, Cache: cache.New(1000, 32)}),
+		"forward":   New(Config{Upstream: &preparedUpstream{answer: answer}}),
+	}
+}
+
+// TestFastPathAllocs checks queries answered from cache or upstream do not
+// allocate.
+func TestFastPathAllocs(t *testing.T) {
+	client := netip.MustParseAddr("192.168.1.20")
+	q := query("www.Example.com", parser.TypeA)
+	buf := make([]byte, upstream.MaxMessageSize)
+	for name, srv := range fastPathServers(t) {
+		allocs := testing.AllocsPerRun(1000, func() {
+			if _, _, err := srv.Resolve(context.Background(), q, client, buf); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%s: %v allocations per query, want 0", name, allocs)
+		}
+	}
+}
+
+func benchmarkResolve(b *testing.B, name string) {
+	srv := fastPathServers(b)[name]
+	client := netip.MustParseAddr("192.168.1.20")
+	q := query("www.Example.com", parser.TypeA)
+	buf := make([]byte, upstream.MaxMessageSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := srv.Resolve(context.Background(), q, client, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResolveCacheHit(b *testing.B) {
+	benchmarkResolve(b, "cache-hit")
+}
+
+func BenchmarkResolveForward(b *testing.B) {
+	benchmarkResolve(b, "forward")
+}
+
+// BenchmarkClockNow compares the clock cached answers are aged with, read
+// once per cache hit and twice per forwarded query, to the monotonic clock
+// of the time package.
+func BenchmarkClockNow(b *testing.B) {
+	b.Run("clock", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			clock.Now()
+		}
+	})
+	b.Run("time", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			time.Now()
+		}
+	})
+}
+
+// TestTrackReplaysCopy checks the answer replayed to a retransmit is a copy
+// taken under the lock, unaffected by the resolution being recycled.
+func TestTrackReplaysCopy(t *testing.T) {
+	s := New(Config{Upstream: staticUpstream{}, DupWindow: time.Minute})
+	key := queryKey{client: netip.MustParseAddrPort("192.168.1.20:5353"), id: 1}
+
+	r, _, dup := s.track(key)
+	if dup {
+		t.Fatal("first query tracked as a duplicate")
+	}
+	if _, answer, dup := s.track(key); !dup || answer != nil {
+		t.Fatalf("retransmit while resolving: dup %v, answer %v, want a duplicate without answer", dup, answer)
+	}
+	if retransmits := s.complete(r, []byte("first answer")); retransmits != 1 {
+		t.Errorf("%d retransmits, want 1", retransmits)
+	}
+
+	_, answer, dup := s.track(key)
+	if !dup || answer == nil {
+		t.Fatal("retransmit after the answer got no answer to replay")
+	}
+	// The resolution is recycled for another query
+	s.forget(key, r)
+	other := queryKey{client: key.client, id: 2}
+	r2, _, _ := s.track(other)
+	s.complete(r2, []byte("other answer"))
+	if string(*answer) != "first answer" {
+		t.Errorf("replayed %q, want %q", *answer, "first answer")
+	}
+}
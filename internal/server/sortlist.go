@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// SortList orders A and AAAA answers the way a resolv.conf sortlist does:
+// addresses on the client's own subnet come first, then addresses in
+// Networks in the order they are listed, then everything else.
+type SortList struct {
+	Prefix4  int // prefix length of the client subnet for IPv4 clients
+	Prefix6  int // prefix length of the client subnet for IPv6 clients
+	Networks []*net.IPNet
+}
+
+// ParseSortList parses networks separated by commas or spaces. Like in
+// resolv.conf, a network is either in CIDR notation or an address followed
+// by a dotted netmask, e.g. 130.155.160.0/255.255.240.0.
+func ParseSortList(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if _, network, err := net.ParseCIDR(field); err == nil {
+			networks = append(networks, network)
+			continue
+		}
+		addr, mask, _ := strings.Cut(field, "/")
+		ip := net.ParseIP(addr).To4()
+		netmask := net.ParseIP(mask).To4()
+		if ip == nil || netmask == nil {
+			return nil, fmt.Errorf("invalid sortlist network %q", field)
+		}
+		networks = append(networks, &net.IPNet{IP: ip.Mask(net.IPMask(netmask)), Mask: net.IPMask(netmask)})
+	}
+	return networks, nil
+}
+
+// clientSubnet returns the subnet answers are sorted for. The EDNS Client
+// Subnet of the query wins over the source address so that downstream
+// forwarders get answers ordered for their own clients.
+func (l *SortList) clientSubnet(query parser.Payload, client net.IP) *net.IPNet {
+	if subnet, ok := parser.ClientSubnet(query); ok {
+		if ones, _ := subnet.Mask.Size(); ones > 0 {
+			return subnet
+		}
+	}
+	if ip := client.To4(); ip != nil {
+		mask := net.CIDRMask(l.Prefix4, 32)
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(l.Prefix6, 128)
+	return &net.IPNet{IP: client.Mask(mask), Mask: mask}
+}
+
+func (l *SortList) rank(subnet *net.IPNet, ip net.IP) int {
+	if subnet.Contains(ip) {
+		return 0
+	}
+	for i, network := range l.Networks {
+		if network.Contains(ip) {
+			return i + 1
+		}
+	}
+	return len(l.Networks) + 1
+}
+
+// Sort reorders the address records of the answer section in place,
+// leaving other records where they are. It reports whether anything moved.
+func (l *SortList) Sort(answers []parser.Resource, subnet *net.IPNet) bool {
+	var slots []int
+	for i, rr := range answers {
+		if (rr.RType == parser.TypeA && len(rr.RData) == net.IPv4len) ||
+			(rr.RType == parser.TypeAAAA && len(rr.RData) == net.IPv6len) {
+			slots = append(slots, i)
+		}
+	}
+	if len(slots) < 2 {
+		return false
+	}
+
+	addresses := make([]parser.Resource, len(slots))
+	for i, slot := range slots {
+		addresses[i] = answers[slot]
+	}
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return l.rank(subnet, addresses[i].RData) < l.rank(subnet, addresses[j].RData)
+	})
+
+	moved := false
+	for i, slot := range slots {
+		if answers[slot].RType != addresses[i].RType || !net.IP(answers[slot].RData).Equal(addresses[i].RData) {
+			moved = true
+		}
+		answers[slot] = addresses[i]
+	}
+	return moved
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+func addressRecords(addrs ...string) []parser.Resource {
+	var answers []parser.Resource
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		rr := parser.Resource{RName: "www.example.com", RType: parser.TypeAAAA, RClass: parser.ClassIN, RTtl: 300, RData: ip}
+		if v4 := ip.To4(); v4 != nil {
+			rr.RType, rr.RData = parser.TypeA, v4
+		}
+		answers = append(answers, rr)
+	}
+	return answers
+}
+
+func TestParseSortList(t *testing.T) {
+	networks, err := ParseSortList("10.0.0.0/8, 130.155.160.0/255.255.240.0,2001:db8::/32 192.0.2.7/255.255.255.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, network := range networks {
+		got = append(got, network.String())
+	}
+	want := []string{"10.0.0.0/8", "130.155.160.0/20", "2001:db8::/32", "192.0.2.0/24"}
+	if !slices.Equal(got, want) {
+		t.Errorf("networks %v, want %v", got, want)
+	}
+	for _, s := range []string{"10.0.0.0", "10.0.0.0/33", "example.com/8", "10.0.0.0/255.255.0.0.0"} {
+		if _, err := ParseSortList(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	l := &SortList{Prefix4: 24, Prefix6: 56}
+	ecs := func(family uint16, prefix byte, addr ...byte) parser.Payload {
+		var p parser.Payload
+		p.SetOption(parser.Option{Code: parser.OptionClientSubnet, Data: append([]byte{0, byte(family), prefix, 0}, addr...)})
+		return p
+	}
+	tests := []struct {
+		name   string
+		query  parser.Payload
+		client string
+		subnet string
+	}{
+		{"IPv4 client", parser.Payload{}, "192.168.1.20", "192.168.1.0/24"},
+		{"IPv4-mapped client", parser.Payload{}, "::ffff:192.168.1.20", "192.168.1.0/24"},
+		{"IPv6 client", parser.Payload{}, "2001:db8:1:2:3::20", "2001:db8:1::/56"},
+		{"client subnet", ecs(1, 16, 198, 51), "192.168.1.20", "198.51.0.0/16"},
+		{"IPv6 client subnet", ecs(2, 48, 0x20, 0x01, 0x0d, 0xb8, 0, 7), "192.168.1.20", "2001:db8:7::/48"},
+		{"client subnet without prefix", ecs(1, 0), "192.168.1.20", "192.168.1.0/24"},
+	}
+	for _, tt := range tests {
+		if subnet := l.clientSubnet(tt.query, net.ParseIP(tt.client)); subnet.String() != tt.subnet {
+			t.Errorf("%s: subnet %s, want %s", tt.name, subnet, tt.subnet)
+		}
+	}
+
+	// Prefixes at both ends of their range
+	l = &SortList{Prefix4: 0, Prefix6: 128}
+	if subnet := l.clientSubnet(parser.Payload{}, net.ParseIP("192.168.1.20")); subnet.String() != "0.0.0.0/0" {
+		t.Errorf("IPv4 subnet %s with a 0 prefix", subnet)
+	}
+	if subnet := l.clientSubnet(parser.Payload{}, net.ParseIP("2001:db8::20")); subnet.String() != "2001:db8::20/128" {
+		t.Errorf("IPv6 subnet %s with a 128 prefix", subnet)
+	}
+}
+
+func TestSort(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, lan6, _ := net.ParseCIDR("2001:db8:1::/56")
+	networks, err := ParseSortList("10.0.0.0/8,172.16.0.0/12,2001:db8:2::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &SortList{Prefix4: 24, Prefix6: 56, Networks: networks}
+	tests := []struct {
+		name    string
+		subnet  *net.IPNet
+		answers []parser.Resource
+		want    []string
+		moved   bool
+	}{
+		{
+			"client subnet first, then networks in order",
+			lan,
+			addressRecords("198.51.100.1", "172.16.0.1", "10.0.0.1", "192.168.1.10"),
+			[]string{"192.168.1.10", "10.0.0.1", "172.16.0.1", "198.51.100.1"},
+			true,
+		},
+		{
+			"order kept within a rank",
+			lan,
+			addressRecords("198.51.100.2", "10.0.0.2", "198.51.100.1", "10.0.0.1"),
+			[]string{"10.0.0.2", "10.0.0.1", "198.51.100.2", "198.51.100.1"},
+			true,
+		},
+		{
+			"already sorted",
+			lan,
+			addressRecords("192.168.1.10", "10.0.0.1", "198.51.100.1"),
+			[]string{"192.168.1.10", "10.0.0.1", "198.51.100.1"},
+			false,
+		},
+		{
+			"IPv6 client subnet",
+			lan6,
+			addressRecords("2001:db8:9::1", "2001:db8:2::1", "2001:db8:1:ff::1"),
+			[]string{"2001:db8:1:ff::1", "2001:db8:2::1", "2001:db8:9::1"},
+			true,
+		},
+		{
+			"other records stay in place",
+			lan,
+			append(append(
+				[]parser.Resource{{RName: "example.com", RType: parser.TypeCNAME, RClass: parser.ClassIN, RData: []byte("www.example.com")}},
+				addressRecords("198.51.100.1", "192.168.1.10")...),
+				parser.Resource{RName: "www.example.com", RType: parser.TypeTXT, RClass: parser.ClassIN, RData: []byte("\x04text")},
+			),
+			[]string{"CNAME", "192.168.1.10", "198.51.100.1", "TXT"},
+			true,
+		},
+		{"single address", lan, addressRecords("198.51.100.1"), []string{"198.51.100.1"}, false},
+	}
+	for _, tt := range tests {
+		moved := l.Sort(tt.answers, tt.subnet)
+		var got []string
+		for _, rr := range tt.answers {
+			if rr.RType == parser.TypeA || rr.RType == parser.TypeAAAA {
+				got = append(got, net.IP(rr.RData).String())
+			} else {
+				got = append(got, parser.TypeString(rr.RType))
+			}
+		}
+		if !slices.Equal(got, tt.want) || moved != tt.moved {
+			t.Errorf("%s: sorted to %v, moved %v, want %v, %v", tt.name, got, moved, tt.want, tt.moved)
+		}
+	}
+}
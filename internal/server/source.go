@@ -0,0 +1,28 @@
+package server
+
+// Kinds of answer sources
+const (
+	SourceLocalZone   = "local-zone"
+	SourceOverride    = "override"
+	SourceBlocklist   = "blocklist"
+	SourcePolicy      = "policy"
+	SourceCache       = "cache"
+	SourceStale       = "stale" // expired cache entry, see Config.Stretch
+	SourceSynthesized = "synthesized"
+	SourceUpstream    = "upstream"
+	SourcePanic       = "panic" // cache miss in the PanicCacheOnly mode
+)
+
+// Source tells where the answer to a query came from, such as the local
+// zone or the upstream server that provided it.
+type Source struct {
+	Kind   string
+	Detail string
+}
+
+func (s Source) String() string {
+	if s.Detail == "" {
+		return s.Kind
+	}
+	return s.Kind + " " + s.Detail
+}
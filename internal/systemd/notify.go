@@ -0,0 +1,29 @@
+package systemd
+
+import (
+	"net"
+	"os"
+)
+
+// Notify sends state, such as "READY=1", to the service manager when
+// running as a Type=notify systemd service. It is a no-op otherwise, see
+// https://www.freedesktop.org/software/systemd/man/sd_notify.html
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract sockets are given with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,118 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Chaos degrades the exchanges of an Exchanger on purpose, for developers
+// to see how the resolver copes with slow and broken upstream servers. The
+// same Seed makes for the same sequence of faults, handed out in the order
+// exchanges start: a run only repeats when queries arrive one at a time, as
+// concurrent queries race for their turn.
+type Chaos struct {
+	Upstream Exchanger
+	// Latency is added to every exchange, along with a random part up to
+	// Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// DropRate is the fraction of queries left unanswered. Exchanges of
+	// dropped queries fail after Timeout, like lost packets would.
+	DropRate float64
+	Timeout  time.Duration
+	// MalformRate is the fraction of answers corrupted before being
+	// returned.
+	MalformRate float64
+	Seed        int64
+
+	once sync.Once
+	mu   sync.Mutex
+	rng  *rand.Rand
+}
+
+var errChaosDrop = errors.New("query dropped by chaos mode")
+
+func (c *Chaos) String() string {
+	return c.Upstream.String() + " (chaos)"
+}
+
+// fault is what happens to an exchange
+type fault struct {
+	delay   time.Duration
+	drop    bool
+	malform bool
+	// where and how the answer is corrupted, see malform
+	kind int
+	pos  float64
+}
+
+func (c *Chaos) draw() fault {
+	c.once.Do(func() { c.rng = rand.New(rand.NewSource(c.Seed)) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := fault{delay: c.Latency}
+	if c.Jitter > 0 {
+		f.delay += time.Duration(c.rng.Int63n(int64(c.Jitter)))
+	}
+	f.drop = c.rng.Float64() < c.DropRate
+	f.malform = c.rng.Float64() < c.MalformRate
+	f.kind = c.rng.Intn(3)
+	f.pos = c.rng.Float64()
+	return f
+}
+
+func (c *Chaos) Exchange(ctx context.Context, query []byte, buf []byte) ([]byte, error) {
+	f := c.draw()
+	if f.drop {
+		f.delay = c.Timeout
+	}
+	if f.delay > 0 {
+		timer := time.NewTimer(f.delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if f.drop {
+		return nil, fmt.Errorf("%w after %v", errChaosDrop, c.Timeout)
+	}
+
+	answer, err := c.Upstream.Exchange(ctx, query, buf)
+	if err != nil || !f.malform {
+		return answer, err
+	}
+	return malform(answer, f), nil
+}
+
+// malform corrupts answer past its header, the way broken servers and
+// middleboxes do: cut short, with a byte overwritten or with a compression
+// pointer pointing forward.
+func malform(answer []byte, f fault) []byte {
+	if len(answer) <= 12 {
+		return answer
+	}
+	pos := 12 + int(f.pos*float64(len(answer)-12))
+	switch f.kind {
+	case 0:
+		return answer[:pos]
+	case 1:
+		answer[pos] ^= 0xFF
+	default:
+		if len(answer) < 12+2 {
+			// no room for a pointer past the header
+			return answer[:12]
+		}
+		if pos+1 >= len(answer) {
+			pos = len(answer) - 2
+		}
+		answer[pos], answer[pos+1] = 0xC0|0x3F, 0xFF
+	}
+	return answer
+}
@@ -0,0 +1,32 @@
+package upstream
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMalformKeepsHeader(t *testing.T) {
+	for size := 0; size <= 20; size++ {
+		original := make([]byte, size)
+		for i := range original {
+			original[i] = byte(i + 1)
+		}
+		for kind := 0; kind < 3; kind++ {
+			for _, pos := range []float64{0, 0.5, 0.999} {
+				answer := malform(append([]byte{}, original...), fault{kind: kind, pos: pos})
+				if size <= 12 {
+					if !bytes.Equal(answer, original) {
+						t.Errorf("%d bytes, kind %d at %v: %x changed to %x", size, kind, pos, original, answer)
+					}
+					continue
+				}
+				if len(answer) < 12 || !bytes.Equal(answer[:12], original[:12]) {
+					t.Errorf("%d bytes, kind %d at %v: header %x changed to %x", size, kind, pos, original[:12], answer)
+				}
+				if bytes.Equal(answer, original) {
+					t.Errorf("%d bytes, kind %d at %v: answer left intact", size, kind, pos)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// dnsMessage is the media type of DoH requests and answers
+const dnsMessage = "application/dns-message"
+
+// HTTPS forwards queries to a DNS over HTTPS server, see
+// https://datatracker.ietf.org/doc/html/rfc8484
+type HTTPS struct {
+	URL    string
+	client *http.Client
+}
+
+// NewHTTPS returns an upstream posting queries to url. config may hold a
+// ClientSessionCache to resume sessions, onHandshake is told about each
+// handshake when set.
+func NewHTTPS(url string, timeout time.Duration, config *tls.Config, onHandshake HandshakeFunc) *HTTPS {
+	config = config.Clone()
+	config.NextProtos = []string{"h2", "http/1.1"}
+	transport := &http.Transport{
+		// Dialing TLS ourselves tells handshakes apart from reused
+		// connections
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c := config.Clone()
+			if c.ServerName == "" {
+				c.ServerName, _, _ = net.SplitHostPort(addr)
+			}
+			return dialTLS(ctx, addr, c, onHandshake)
+		},
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}
+	return &HTTPS{URL: url, client: &http.Client{Transport: transport, Timeout: timeout}}
+}
+
+func (h *HTTPS) String() string {
+	return h.URL
+}
+
+func (h *HTTPS) Exchange(ctx context.Context, query []byte, buf []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("query is shorter than a DNS header")
+	}
+	// The ID should be 0 so that answers can be cached by HTTP caches,
+	// it is put back in the answer
+	msg := append([]byte{0, 0}, query[2:]...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessage)
+	req.Header.Set("Accept", dnsMessage)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", h.URL, resp.Status)
+	}
+
+	buf = buf[:0]
+	if cap(buf) < MaxMessageSize {
+		buf = make([]byte, 0, MaxMessageSize)
+	}
+	response := bytes.NewBuffer(buf)
+	if _, err := io.Copy(response, io.LimitReader(resp.Body, 1<<16)); err != nil {
+		return nil, err
+	}
+	answer := response.Bytes()
+	if len(answer) < 12 {
+		return nil, errors.New("answer is shorter than a DNS header")
+	}
+	copy(answer[0:2], query[0:2])
+	if !answers(answer, query) {
+		return nil, errors.New("answer does not match the query")
+	}
+	return answer, nil
+}
@@ -0,0 +1,175 @@
+package upstream
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// SessionCache keeps the TLS sessions of upstream servers so that new
+// connections resume them instead of paying full handshakes. It can be
+// saved to a file and loaded back, so that restarts do not lose them
+// either. Least recently used sessions are evicted beyond its capacity.
+type SessionCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // of *sessionEntry, most recently used first
+}
+
+// maxSessionAge is how long saved sessions are loaded back, the longest
+// ticket lifetime servers may give (RFC 8446 section 4.6.1)
+const maxSessionAge = 7 * 24 * time.Hour
+
+type sessionEntry struct {
+	key   string
+	state *tls.ClientSessionState
+}
+
+// savedSession is the persisted form of a session, see
+// tls.ClientSessionState.ResumptionState
+type savedSession struct {
+	Key    string `json:"key"`
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+	Saved  int64  `json:"saved"` // Unix seconds
+}
+
+func NewSessionCache(capacity int) *SessionCache {
+	return &SessionCache{capacity: capacity, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// Get implements tls.ClientSessionCache.
+func (c *SessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*sessionEntry).state, true
+}
+
+// Put implements tls.ClientSessionCache, a nil state removes the session.
+func (c *SessionCache) Put(key string, state *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		if state == nil {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+			return
+		}
+		elem.Value.(*sessionEntry).state = state
+		c.order.MoveToFront(elem)
+		return
+	}
+	if state == nil {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&sessionEntry{key: key, state: state})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*sessionEntry).key)
+	}
+}
+
+// Save writes the sessions to path, replacing the file atomically. The file
+// holds secrets resuming the sessions and is only readable by its owner.
+func (c *SessionCache) Save(path string) error {
+	now := time.Now().Unix()
+	c.mu.Lock()
+	var saved []savedSession
+	for elem := c.order.Back(); elem != nil; elem = elem.Prev() {
+		e := elem.Value.(*sessionEntry)
+		ticket, state, err := e.state.ResumptionState()
+		if err != nil || state == nil {
+			continue
+		}
+		data, err := state.Bytes()
+		if err != nil {
+			continue
+		}
+		saved = append(saved, savedSession{Key: e.key, Ticket: ticket, State: data, Saved: now})
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load adds the sessions saved to path. A missing file is not an error.
+// Sessions saved longer than maxSessionAge ago or that do not parse are
+// dropped, those the servers have since forgotten merely fall back to
+// full handshakes.
+func (c *SessionCache) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []savedSession
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	oldest := time.Now().Add(-maxSessionAge).Unix()
+	for _, s := range saved {
+		if s.Saved < oldest {
+			continue
+		}
+		state, err := tls.ParseSessionState(s.State)
+		if err != nil {
+			continue
+		}
+		resumption, err := tls.NewResumptionState(s.Ticket, state)
+		if err != nil {
+			continue
+		}
+		c.Put(s.Key, resumption)
+	}
+	return nil
+}
+
+// HandshakeFunc is told about every TLS handshake with an upstream server,
+// how long it took and whether it resumed a session.
+type HandshakeFunc func(d time.Duration, resumed bool)
+
+// dialTLS connects to addr and completes the TLS handshake, reporting it
+// to onHandshake when set.
+func dialTLS(ctx context.Context, addr string, config *tls.Config, onHandshake HandshakeFunc) (*tls.Conn, error) {
+	var dialer net.Dialer
+	raw, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, config)
+	start := time.Now()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if onHandshake != nil {
+		onHandshake(time.Since(start), conn.ConnectionState().DidResume)
+	}
+	return conn, nil
+}
@@ -0,0 +1,120 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// handshake completes a TLS 1.2 handshake with a throwaway server, whose
+// session ticket the client puts in cache under serverName.
+func handshake(t *testing.T, cache *SessionCache, serverName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MaxVersion:   tls.VersionTLS12,
+	})
+	go server.Handshake()
+	client := tls.Client(clientConn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		ClientSessionCache: cache,
+	})
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionCacheSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	saved := NewSessionCache(10)
+	handshake(t, saved, "dns.example")
+	if _, ok := saved.Get("dns.example"); !ok {
+		t.Fatal("handshake left no session")
+	}
+	if err := saved.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewSessionCache(10)
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Get("dns.example"); !ok {
+		t.Error("saved session not loaded back")
+	}
+
+	// Rewrite the file with the session under other keys, expired or corrupt
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []savedSession
+	if err := json.Unmarshal(data, &sessions); err != nil || len(sessions) != 1 {
+		t.Fatalf("saved %d sessions, error %v", len(sessions), err)
+	}
+	valid := sessions[0]
+	expired, corrupt := valid, valid
+	expired.Key, expired.Saved = "expired.example", time.Now().Add(-maxSessionAge-time.Hour).Unix()
+	corrupt.Key, corrupt.State = "corrupt.example", []byte("garbage")
+	data, err = json.Marshal([]savedSession{valid, expired, corrupt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded = NewSessionCache(10)
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Get("dns.example"); !ok {
+		t.Error("valid session not loaded")
+	}
+	for _, key := range []string{"expired.example", "corrupt.example"} {
+		if _, ok := loaded.Get(key); ok {
+			t.Errorf("%s loaded", key)
+		}
+	}
+}
+
+func TestSessionCacheLoadMissing(t *testing.T) {
+	c := NewSessionCache(10)
+	if err := c.Load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "bad.json")
+	if err := os.WriteFile(path, []byte("not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load(path); err == nil {
+		t.Error("unparsable file loaded")
+	}
+}
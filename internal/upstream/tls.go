@@ -0,0 +1,121 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxIdleTLSConns bounds the connections to a DoT server kept open once a
+// burst is over.
+const maxIdleTLSConns = 8
+
+// TLS forwards queries to a DNS over TLS server, see
+// https://datatracker.ietf.org/doc/html/rfc7858
+// Connections are kept open and reused by later queries, one query at a
+// time.
+type TLS struct {
+	Addr    string
+	Timeout time.Duration
+	// Config holds the server name and, to resume sessions, a
+	// ClientSessionCache.
+	Config      *tls.Config
+	OnHandshake HandshakeFunc
+
+	mu   sync.Mutex
+	idle []*tls.Conn
+}
+
+func (t *TLS) String() string {
+	return "tls://" + t.Addr
+}
+
+func (t *TLS) Exchange(ctx context.Context, query []byte, buf []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("query is shorter than a DNS header")
+	}
+	ctx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+
+	// A kept connection may have been closed by the server meanwhile,
+	// the query is then sent again on a new one
+	conn, reused := t.get()
+	for {
+		if conn == nil {
+			var err error
+			if conn, err = dialTLS(ctx, t.Addr, t.Config, t.OnHandshake); err != nil {
+				return nil, err
+			}
+		}
+		response, err := exchangeStream(ctx, conn, query, buf)
+		if err == nil {
+			t.put(conn)
+			return response, nil
+		}
+		conn.Close()
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+		conn, reused = nil, false
+	}
+}
+
+// exchangeStream sends query on a stream connection and reads the answer,
+// each prefixed with its length, see
+// https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte, buf []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		response := buf[:n]
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return nil, err
+		}
+		if answers(response, query) {
+			return response, nil
+		}
+	}
+}
+
+func (t *TLS) get() (*tls.Conn, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n := len(t.idle); n > 0 {
+		conn := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		return conn, true
+	}
+	return nil, false
+}
+
+func (t *TLS) put(conn *tls.Conn) {
+	conn.SetDeadline(time.Time{})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.idle) >= maxIdleTLSConns {
+		conn.Close()
+		return
+	}
+	t.idle = append(t.idle, conn)
+}
@@ -0,0 +1,139 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxMessageSize is the largest answer read from upstream servers, buffers
+// given to Exchange should be able to hold it.
+const MaxMessageSize = 4096
+
+// Exchanger sends a DNS query to an upstream server and returns its raw
+// answer, read into buf when it is large enough.
+type Exchanger interface {
+	Exchange(ctx context.Context, query []byte, buf []byte) ([]byte, error)
+	String() string
+}
+
+// UDP forwards queries to a single upstream server over UDP. Each query
+// goes from a socket of its own, so from a new random source port, with a
+// random ID: an off-path attacker has to guess both to forge an answer that
+// ends up in the cache.
+type UDP struct {
+	Addr    string
+	Timeout time.Duration
+}
+
+func (u *UDP) String() string {
+	return u.Addr
+}
+
+func (u *UDP) Exchange(ctx context.Context, query []byte, buf []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("query is shorter than a DNS header")
+	}
+	if cap(buf) < MaxMessageSize {
+		buf = make([]byte, MaxMessageSize)
+	}
+	buf = buf[:cap(buf)]
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(u.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// The client's ID is put back in the query, and in the answer, once done
+	id := binary.BigEndian.Uint16(query)
+	binary.BigEndian.PutUint16(query, randomID())
+	defer binary.BigEndian.PutUint16(query, id)
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams that do not answer our query
+		if answers(buf[:n], query) {
+			binary.BigEndian.PutUint16(buf, id)
+			return buf[:n], nil
+		}
+	}
+}
+
+// randomBytes holds random bytes read ahead from crypto/rand, reading them
+// two at a time would allocate on each query.
+var randomBytes struct {
+	sync.Mutex
+	buf  [512]byte
+	next int
+}
+
+// randomID returns a query ID from crypto/rand.
+func randomID() uint16 {
+	randomBytes.Lock()
+	defer randomBytes.Unlock()
+
+	if randomBytes.next == 0 {
+		if _, err := rand.Read(randomBytes.buf[:]); err != nil {
+			panic(fmt.Sprintf("crypto/rand failed: %v", err))
+		}
+	}
+	id := binary.BigEndian.Uint16(randomBytes.buf[randomBytes.next:])
+	randomBytes.next = (randomBytes.next + 2) % len(randomBytes.buf)
+	return id
+}
+
+// answers reports whether response has the ID and question of query.
+func answers(response []byte, query []byte) bool {
+	if len(response) < 12 || !bytes.Equal(response[0:2], query[0:2]) || !bytes.Equal(response[4:6], query[4:6]) {
+		return false
+	}
+	end := questionEnd(query)
+	return end > 0 && len(response) >= end && bytes.EqualFold(response[12:end], query[12:end])
+}
+
+// questionEnd returns the offset after the question section of msg, or 0
+// if it cannot be found.
+func questionEnd(msg []byte) int {
+	offset := 12
+	for i := binary.BigEndian.Uint16(msg[4:6]); i > 0; i-- {
+		for {
+			if offset >= len(msg) {
+				return 0
+			}
+			length := int(msg[offset])
+			if length&0xC0 == 0xC0 {
+				offset += 2
+				break
+			}
+			offset += length + 1
+			if length == 0 {
+				break
+			}
+		}
+		offset += 4
+	}
+	if offset > len(msg) {
+		return 0
+	}
+	return offset
+}
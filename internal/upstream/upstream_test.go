@@ -0,0 +1,69 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoServer answers each query with itself, flagged as a response, and
+// sends the IDs and source ports it saw on ids and ports.
+func echoServer(t *testing.T) (addr string, ids chan uint16, ports chan int) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ids, ports = make(chan uint16, 100), make(chan int, 100)
+	go func() {
+		buf := make([]byte, MaxMessageSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			ids <- binary.BigEndian.Uint16(buf)
+			ports <- from.Port
+			buf[2] |= 0x80
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().String(), ids, ports
+}
+
+func TestUDPRandomizesIDAndPort(t *testing.T) {
+	addr, ids, ports := echoServer(t)
+	u := &UDP{Addr: addr, Timeout: time.Second}
+
+	// example.com A IN, ID 0x1234
+	query := []byte{0x12, 0x34, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1}
+	original := append([]byte(nil), query...)
+
+	const queries = 20
+	seenIDs, seenPorts := map[uint16]bool{}, map[int]bool{}
+	for i := 0; i < queries; i++ {
+		answer, err := u.Exchange(context.Background(), query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint16(answer) != 0x1234 {
+			t.Fatalf("answer ID %#x, want the client's 0x1234", binary.BigEndian.Uint16(answer))
+		}
+		if !bytes.Equal(query, original) {
+			t.Fatalf("query changed to %x", query)
+		}
+		seenIDs[<-ids] = true
+		seenPorts[<-ports] = true
+	}
+	// With random 16 bit IDs and ephemeral ports, a few collisions at most
+	if len(seenIDs) < queries-2 {
+		t.Errorf("%d distinct upstream IDs over %d queries", len(seenIDs), queries)
+	}
+	if len(seenPorts) < queries-2 {
+		t.Errorf("%d distinct source ports over %d queries", len(seenPorts), queries)
+	}
+}
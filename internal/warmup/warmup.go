@@ -0,0 +1,231 @@
+// Package warmup keeps track of the most queried names and reads the lists
+// of names prefetched at startup, so the first queries after a restart are
+// answered from cache.
+package warmup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/maphash"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// maxNames bounds the names counted by Stats, each shard holding its share.
+// When a shard is full, its counts are halved and the names left at zero
+// forgotten, so names that were popular long ago make way for the current
+// ones.
+const maxNames = 10000
+
+// Domain is a question to prefetch.
+type Domain struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ReadList reads a warm-up list: one name per line, optionally followed by
+// a record type, A by default. Comments start with #.
+func ReadList(path string) ([]Domain, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var domains []Domain
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			fields = append(fields, "A")
+		case 2:
+		default:
+			return nil, fmt.Errorf("%s:%d: expected a name and an optional type", path, line)
+		}
+		if _, ok := parser.ParseType(fields[1]); !ok {
+			return nil, fmt.Errorf("%s:%d: unknown record type %q", path, line, fields[1])
+		}
+		domains = append(domains, Domain{Name: strings.TrimSuffix(fields[0], "."), Type: strings.ToUpper(fields[1])})
+	}
+	return domains, scanner.Err()
+}
+
+// Stats counts the queries of each name and type. Names are spread over
+// shards, each with its own lock, and counts are atomic: counting a name
+// already seen only takes a read lock on its shard and does not allocate.
+type Stats struct {
+	seed   maphash.Seed
+	shards [statsShards]statsShard
+}
+
+// statsShards is the number of shards of Stats
+const statsShards = 32
+
+type statsShard struct {
+	mu     sync.RWMutex
+	counts map[uint16]map[string]*atomic.Uint64 // by type, then name
+	names  int
+}
+
+// statsEntry is the persisted form of a count.
+type statsEntry struct {
+	Domain
+	Count uint64 `json:"count"`
+}
+
+func NewStats() *Stats {
+	s := &Stats{seed: maphash.MakeSeed()}
+	for i := range s.shards {
+		s.shards[i].counts = map[uint16]map[string]*atomic.Uint64{}
+	}
+	return s
+}
+
+func (s *Stats) shard(name []byte) *statsShard {
+	return &s.shards[maphash.Bytes(s.seed, name)%statsShards]
+}
+
+// Record counts a query for name, lowercase without trailing dot.
+func (s *Stats) Record(name []byte, qtype uint16) {
+	sh := s.shard(name)
+	sh.mu.RLock()
+	count := sh.counts[qtype][string(name)]
+	sh.mu.RUnlock()
+	if count != nil {
+		count.Add(1)
+		return
+	}
+
+	sh.mu.Lock()
+	sh.add(string(name), qtype, 1)
+	sh.mu.Unlock()
+}
+
+// add adds n to the count of name, counting it first if new. When the shard
+// holds its share of maxNames, its counts decay first. The caller holds the
+// write lock.
+func (sh *statsShard) add(name string, qtype uint16, n uint64) {
+	if count := sh.counts[qtype][name]; count != nil {
+		count.Add(n)
+		return
+	}
+	if sh.names >= maxNames/statsShards {
+		sh.decay()
+	}
+	byName := sh.counts[qtype]
+	if byName == nil {
+		byName = map[string]*atomic.Uint64{}
+		sh.counts[qtype] = byName
+	}
+	count := new(atomic.Uint64)
+	count.Store(n)
+	byName[name] = count
+	sh.names++
+}
+
+func (sh *statsShard) decay() {
+	for qtype, byName := range sh.counts {
+		for name, count := range byName {
+			// a query counted meanwhile may be lost, no matter for a decay
+			if c := count.Load() / 2; c > 0 {
+				count.Store(c)
+			} else {
+				delete(byName, name)
+				sh.names--
+			}
+		}
+		if len(byName) == 0 {
+			delete(sh.counts, qtype)
+		}
+	}
+}
+
+// Top returns the n most queried names, most queried first, all of them
+// when n is 0 or less.
+func (s *Stats) Top(n int) []Domain {
+	entries := s.entries()
+	if n > 0 && n < len(entries) {
+		entries = entries[:n]
+	}
+	domains := make([]Domain, len(entries))
+	for i, e := range entries {
+		domains[i] = e.Domain
+	}
+	return domains
+}
+
+// entries returns the counts, highest first.
+func (s *Stats) entries() []statsEntry {
+	var entries []statsEntry
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		for qtype, byName := range sh.counts {
+			for name, count := range byName {
+				entries = append(entries, statsEntry{Domain{name, parser.TypeString(qtype)}, count.Load()})
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// Save writes the counts to path as JSON, replacing the file atomically.
+func (s *Stats) Save(path string) error {
+	data, err := json.Marshal(s.entries())
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load adds the counts saved by Save to path. A missing file is not an
+// error, there is nothing to reuse on first start.
+func (s *Stats) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []statsEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for _, e := range entries {
+		qtype, ok := parser.ParseType(e.Type)
+		if !ok {
+			continue
+		}
+		sh := s.shard([]byte(e.Name))
+		sh.mu.Lock()
+		if sh.names < maxNames/statsShards || sh.counts[qtype][e.Name] != nil {
+			sh.add(e.Name, qtype, e.Count)
+		}
+		sh.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package warmup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadList(t *testing.T) {
+	path := writeFile(t, "# popular names\nexample.com\nwww.example.com. aaaa\n\n  mail.example.com MX # mail\n")
+	domains, err := ReadList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Domain{{"example.com", "A"}, {"www.example.com", "AAAA"}, {"mail.example.com", "MX"}}
+	if !slices.Equal(domains, want) {
+		t.Errorf("domains %v, want %v", domains, want)
+	}
+
+	for _, content := range []string{"example.com A extra\n", "example.com NOTATYPE\n"} {
+		if _, err := ReadList(writeFile(t, content)); err == nil {
+			t.Errorf("%q read", content)
+		}
+	}
+	if _, err := ReadList(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing list read")
+	}
+}
+
+func TestTop(t *testing.T) {
+	s := NewStats()
+	for i, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		for j := 0; j <= i; j++ {
+			s.Record([]byte(name), parser.TypeA)
+		}
+	}
+	s.Record([]byte("a.example.com"), parser.TypeAAAA)
+
+	want := []Domain{{"c.example.com", "A"}, {"b.example.com", "A"}, {"a.example.com", "A"}, {"a.example.com", "AAAA"}}
+	if top := s.Top(0); !slices.Equal(top, want) {
+		t.Errorf("top %v, want %v", top, want)
+	}
+	if top := s.Top(2); !slices.Equal(top, want[:2]) {
+		t.Errorf("top 2 %v, want %v", top, want[:2])
+	}
+}
+
+func TestDecay(t *testing.T) {
+	s := NewStats()
+	popular := []byte("popular.example.com")
+	for i := 0; i < 100; i++ {
+		s.Record(popular, parser.TypeA)
+	}
+	for i := 0; i < 2*maxNames; i++ {
+		s.Record([]byte(fmt.Sprintf("host%d.example.com", i)), parser.TypeA)
+	}
+
+	for i := range s.shards {
+		if names := s.shards[i].names; names > maxNames/statsShards {
+			t.Errorf("shard %d counts %d names, more than %d", i, names, maxNames/statsShards)
+		}
+	}
+	entries := s.entries()
+	if len(entries) > maxNames {
+		t.Errorf("%d names counted, more than %d", len(entries), maxNames)
+	}
+	if e := entries[0]; e.Name != "popular.example.com" || e.Count >= 100 {
+		t.Errorf("top entry %+v, want the popular name with a decayed count", e)
+	}
+}
+
+func TestRecordConcurrent(t *testing.T) {
+	const goroutines, queries = 8, 1000
+	s := NewStats()
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < queries; i++ {
+				s.Record([]byte(fmt.Sprintf("host%d.example.com", i%10)), parser.TypeA)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries := s.entries()
+	if len(entries) != 10 {
+		t.Fatalf("%d names counted, want 10", len(entries))
+	}
+	for _, e := range entries {
+		if e.Count != goroutines*queries/10 {
+			t.Errorf("%s counted %d times, want %d", e.Name, e.Count, goroutines*queries/10)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	s := NewStats()
+	s.Record([]byte("example.com"), parser.TypeA)
+	s.Record([]byte("example.com"), parser.TypeA)
+	s.Record([]byte("example.com"), parser.TypeMX)
+	path := filepath.Join(t.TempDir(), "stats.json")
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loaded counts add to the ones already there
+	loaded := NewStats()
+	loaded.Record([]byte("example.com"), parser.TypeMX)
+	loaded.Record([]byte("example.com"), parser.TypeMX)
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	want := []statsEntry{{Domain{"example.com", "MX"}, 3}, {Domain{"example.com", "A"}, 2}}
+	if entries := loaded.entries(); !slices.Equal(entries, want) {
+		t.Errorf("entries %v, want %v", entries, want)
+	}
+
+	if err := NewStats().Load(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+	if err := NewStats().Load(writeFile(t, "not json")); err == nil {
+		t.Error("corrupt file loaded")
+	}
+}
+
+// BenchmarkRecordParallel measures counting names already seen from all
+// cores at once.
+func BenchmarkRecordParallel(b *testing.B) {
+	s := NewStats()
+	names := make([][]byte, 1000)
+	for i := range names {
+		names[i] = []byte(fmt.Sprintf("host%d.example.com", i))
+		s.Record(names[i], parser.TypeA)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			s.Record(names[i%len(names)], parser.TypeA)
+			i++
+		}
+	})
+}
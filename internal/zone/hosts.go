@@ -0,0 +1,81 @@
+package zone
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Hosts holds local records read from a hosts(5) style file: an address
+// followed by one or more names, # starts a comment. Addresses and names
+// may contain {{name}} placeholders, replaced with the values of Vars.
+type Hosts struct {
+	byName map[string][]net.IP
+	byAddr map[string][]string
+}
+
+func LoadHosts(path string, vars Vars) (*Hosts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hosts := &Hosts{byName: map[string][]net.IP{}, byAddr: map[string][]string{}}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text, err := vars.expand(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected an address followed by names", path, line)
+		}
+		for _, name := range fields[1:] {
+			hosts.add(ip, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+func (h *Hosts) add(ip net.IP, name string) {
+	name = canonical(name)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	h.byName[name] = append(h.byName[name], ip)
+	h.byAddr[ip.String()] = append(h.byAddr[ip.String()], name)
+}
+
+// Addresses returns the addresses of name and whether the name is known.
+func (h *Hosts) Addresses(name string) ([]net.IP, bool) {
+	ips, ok := h.byName[canonical(name)]
+	return ips, ok
+}
+
+// Names returns the names of ip, the first one being its canonical name.
+func (h *Hosts) Names(ip net.IP) []string {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return h.byAddr[ip.String()]
+}
+
+// canonical lowercases name and strips its trailing dot, DNS names compare
+// case insensitively.
+func canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
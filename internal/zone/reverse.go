@@ -0,0 +1,105 @@
+package zone
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Classless is a reverse zone for a subnet smaller than a /24, delegated the
+// RFC 2317 way: the parent zone holds, for every address of the subnet, a
+// CNAME from d.c.b.a.in-addr.arpa to d.<label>.c.b.a.in-addr.arpa, and the
+// PTR records live in the <label>.c.b.a.in-addr.arpa zone.
+// https://datatracker.ietf.org/doc/html/rfc2317
+type Classless struct {
+	Network *net.IPNet
+	Label   string
+}
+
+// ParseClassless parses a subnet in CIDR notation, optionally followed by
+// =label to name the zone. The label defaults to <first address>/<prefix>,
+// e.g. 192.0.2.32/27 is served as 32/27.2.0.192.in-addr.arpa.
+func ParseClassless(s string) (Classless, error) {
+	cidr, label, _ := strings.Cut(s, "=")
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return Classless{}, err
+	}
+	ones, _ := network.Mask.Size()
+	if ip.To4() == nil || ones <= 24 || ones > 31 {
+		return Classless{}, fmt.Errorf("classless reverse zone %s must be an IPv4 subnet between /25 and /31", cidr)
+	}
+	network.IP = network.IP.To4()
+	if label == "" {
+		label = fmt.Sprintf("%d/%d", network.IP[3], ones)
+	}
+	return Classless{Network: network, Label: label}, nil
+}
+
+// Name returns the name of the zone holding the PTR records.
+func (c Classless) Name() string {
+	ip := c.Network.IP
+	return fmt.Sprintf("%s.%d.%d.%d.in-addr.arpa", c.Label, ip[2], ip[1], ip[0])
+}
+
+// Target returns the name the parent CNAME of ip points to.
+func (c Classless) Target(ip net.IP) string {
+	return fmt.Sprintf("%d.%s", ip.To4()[3], c.Name())
+}
+
+// hostOf returns the address named by a name inside the zone, such as
+// 33.32/27.2.0.192.in-addr.arpa.
+func (c Classless) hostOf(name string) (net.IP, bool) {
+	host, ok := strings.CutSuffix(name, "."+c.Name())
+	if !ok {
+		return nil, false
+	}
+	last, err := strconv.ParseUint(host, 10, 8)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.IPv4(c.Network.IP[0], c.Network.IP[1], c.Network.IP[2], byte(last)).To4()
+	if !c.Network.Contains(ip) {
+		return nil, false
+	}
+	return ip, true
+}
+
+// reverseAddr returns the address of an in-addr.arpa or ip6.arpa name.
+func reverseAddr(name string) (net.IP, bool) {
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) != 4 {
+			return nil, false
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, octet := range octets {
+			b, err := strconv.ParseUint(octet, 10, 8)
+			if err != nil {
+				return nil, false
+			}
+			ip[3-i] = byte(b)
+		}
+		return ip, true
+	}
+
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != 32 {
+			return nil, false
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			n, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return nil, false
+			}
+			// nibbles are listed from the least significant
+			pos := 31 - i
+			ip[pos/2] |= byte(n) << (4 * (1 - pos%2))
+		}
+		return ip, true
+	}
+	return nil, false
+}
@@ -0,0 +1,92 @@
+package zone
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Vars are the values of the {{name}} placeholders of a hosts file, so one
+// file can be shared by sites with different addressing.
+type Vars map[string]string
+
+// LoadVars reads the variables of view from the file at path: name = value
+// lines, # starts a comment. Those before any [view] section are defaults,
+// which the section named view overrides.
+func LoadVars(path string, view string) (Vars, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := Vars{}
+	overrides := Vars{}
+	var section string
+	views := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") {
+				return nil, fmt.Errorf("%s:%d: expected [view]", path, line)
+			}
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			views[section] = true
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected name = value", path, line)
+		}
+		switch section {
+		case "":
+			vars[name] = value
+		case view:
+			overrides[name] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if view != "" && !views[view] {
+		return nil, fmt.Errorf("%s: view %q not found", path, view)
+	}
+	for name, value := range overrides {
+		vars[name] = value
+	}
+	return vars, nil
+}
+
+// expand replaces the {{name}} placeholders of text with their values.
+func (v Vars) expand(text string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(text, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(text[start:], "}}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated %s", text[start:])
+		}
+		name := strings.TrimSpace(text[start+2 : start+end])
+		value, ok := v[name]
+		if !ok {
+			return "", fmt.Errorf("undefined variable %s", name)
+		}
+		b.WriteString(text[:start])
+		b.WriteString(value)
+		text = text[start+end+2:]
+	}
+	b.WriteString(text)
+	return b.String(), nil
+}
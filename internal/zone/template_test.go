@@ -0,0 +1,137 @@
+package zone
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFile writes content to a file named name in a temporary directory
+// and returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testVars = `# defaults
+prefix = 192.168.1
+domain = home
+
+[office]
+prefix = 10.0.0   # overrides the default
+printer = 10.0.0.50
+
+[lab]
+`
+
+func TestLoadVars(t *testing.T) {
+	path := writeFile(t, "vars", testVars)
+	tests := []struct {
+		view string
+		want Vars // nil for an error
+	}{
+		{"", Vars{"prefix": "192.168.1", "domain": "home"}},
+		{"office", Vars{"prefix": "10.0.0", "domain": "home", "printer": "10.0.0.50"}},
+		{"lab", Vars{"prefix": "192.168.1", "domain": "home"}},
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		vars, err := LoadVars(path, tt.view)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("view %q: loaded %v", tt.view, vars)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("view %q: %v", tt.view, err)
+			continue
+		}
+		if len(vars) != len(tt.want) {
+			t.Errorf("view %q: %v, want %v", tt.view, vars, tt.want)
+			continue
+		}
+		for name, value := range tt.want {
+			if vars[name] != value {
+				t.Errorf("view %q: %s = %q, want %q", tt.view, name, vars[name], value)
+			}
+		}
+	}
+}
+
+func TestLoadVarsErrors(t *testing.T) {
+	for _, content := range []string{"[office\nprefix = 10.0.0", "prefix 10.0.0", " = 10.0.0"} {
+		if _, err := LoadVars(writeFile(t, "vars", content), ""); err == nil {
+			t.Errorf("%q loaded", content)
+		}
+	}
+	if _, err := LoadVars(filepath.Join(t.TempDir(), "missing"), ""); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := Vars{"prefix": "192.168.1", "domain": "home", "empty": ""}
+	tests := []struct {
+		text string
+		want string // empty for an error
+	}{
+		{"192.168.1.10 nas", "192.168.1.10 nas"},
+		{"{{prefix}}.10 nas.{{domain}}", "192.168.1.10 nas.home"},
+		{"{{ prefix }}.10 nas{{empty}}.{{domain}}", "192.168.1.10 nas.home"},
+		{"{{prefix}}{{prefix}}", "192.168.1192.168.1"},
+		{"{{prefix}}.10 nas.{{site}}", ""},
+		{"{{prefix}}.10 nas.{{domain", ""},
+		{"{{}}", ""},
+	}
+	for _, tt := range tests {
+		got, err := vars.expand(tt.text)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q: expanded to %q", tt.text, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: expanded to %q, %v, want %q", tt.text, got, err, tt.want)
+		}
+	}
+	// Without variables, only text without placeholders expands
+	var none Vars
+	if got, err := none.expand("192.168.1.10 nas"); err != nil || got != "192.168.1.10 nas" {
+		t.Errorf("without variables: %q, %v", got, err)
+	}
+	if _, err := none.expand("{{prefix}}.10 nas"); err == nil {
+		t.Error("undefined variable expanded without variables")
+	}
+}
+
+func TestLoadHostsTemplate(t *testing.T) {
+	path := writeFile(t, "hosts", "{{prefix}}.10 nas.{{domain}} nas # {{undefined}} in a comment\n\n{{printer}} printer.{{domain}}\n")
+	vars, err := LoadVars(writeFile(t, "vars", testVars), "office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := LoadHosts(path, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"nas.home": "10.0.0.10", "nas": "10.0.0.10", "printer.home": "10.0.0.50"} {
+		if ips, ok := hosts.Addresses(name); !ok || len(ips) != 1 || !ips[0].Equal(net.ParseIP(want)) {
+			t.Errorf("%s: %v, want %s", name, ips, want)
+		}
+	}
+
+	// The default view has no printer
+	vars, err = LoadVars(writeFile(t, "vars", testVars), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadHosts(path, vars); err == nil {
+		t.Error("hosts with an undefined variable loaded")
+	}
+}
@@ -0,0 +1,134 @@
+package zone
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// Answer is a response built from local data.
+type Answer struct {
+	// Zone is the local zone the answer comes from, empty for answers
+	// overriding a name from the hosts file.
+	Zone        string
+	Rcode       uint16
+	Answers     []parser.Resource
+	Authorities []parser.Resource
+}
+
+// Zones answers queries from a hosts file and the classless reverse zones
+// hosted by the resolver.
+type Zones struct {
+	hosts     *Hosts
+	classless []Classless
+	ttl       uint32
+	serial    uint32
+}
+
+// New returns zones serving hosts, which may be nil, and the classless
+// reverse zones. Records are served with the given TTL.
+func New(hosts *Hosts, classless []Classless, ttl uint32) *Zones {
+	if hosts == nil {
+		hosts = &Hosts{}
+	}
+	return &Zones{hosts: hosts, classless: classless, ttl: ttl, serial: uint32(time.Now().Unix())}
+}
+
+// Covers reports whether a query for name, lowercase without trailing dot,
+// may be answered by Lookup. It is cheap and does not allocate, so that the
+// lookup is only paid for by names that may be local.
+func (z *Zones) Covers(name []byte) bool {
+	if _, ok := z.hosts.byName[string(name)]; ok {
+		return true
+	}
+	return bytes.HasSuffix(name, []byte(".in-addr.arpa")) || bytes.HasSuffix(name, []byte(".ip6.arpa"))
+}
+
+// Lookup answers q if it falls within local data.
+func (z *Zones) Lookup(q parser.Question) (Answer, bool) {
+	name := canonical(q.QName)
+
+	for _, c := range z.classless {
+		zoneName := c.Name()
+		if name == zoneName {
+			if q.QType == parser.TypeSOA {
+				return Answer{Zone: zoneName, Answers: []parser.Resource{z.soa(c)}}, true
+			}
+			return Answer{Zone: zoneName, Authorities: []parser.Resource{z.soa(c)}}, true
+		}
+		if strings.HasSuffix(name, "."+zoneName) {
+			ip, ok := c.hostOf(name)
+			if !ok {
+				return Answer{Zone: zoneName, Rcode: parser.RcodeNXDomain, Authorities: []parser.Resource{z.soa(c)}}, true
+			}
+			return z.ptr(q.QName, q.QType, ip, c), true
+		}
+	}
+
+	if ip, ok := reverseAddr(name); ok {
+		for _, c := range z.classless {
+			if !c.Network.Contains(ip) {
+				continue
+			}
+			// Answer the way the parent zone would, then follow the CNAME
+			// ourselves since the target is local
+			cname := z.record(q.QName, parser.TypeCNAME, []byte(c.Target(ip)))
+			if q.QType == parser.TypeCNAME {
+				return Answer{Zone: c.Name(), Answers: []parser.Resource{cname}}, true
+			}
+			answer := z.ptr(c.Target(ip), q.QType, ip, c)
+			answer.Answers = append([]parser.Resource{cname}, answer.Answers...)
+			return answer, true
+		}
+		if names := z.hosts.Names(ip); len(names) > 0 && q.QType == parser.TypePTR {
+			return Answer{Answers: []parser.Resource{z.record(q.QName, parser.TypePTR, []byte(names[0]))}}, true
+		}
+		return Answer{}, false
+	}
+
+	ips, ok := z.hosts.Addresses(name)
+	if !ok {
+		return Answer{}, false
+	}
+	// Local names have no other records: forwarded queries for other
+	// types would reveal them and get answers contradicting ours
+	var answer Answer
+	for _, ip := range ips {
+		if q.QType == parser.TypeA && len(ip) == net.IPv4len {
+			answer.Answers = append(answer.Answers, z.record(q.QName, parser.TypeA, ip))
+		}
+		if q.QType == parser.TypeAAAA && len(ip) == net.IPv6len {
+			answer.Answers = append(answer.Answers, z.record(q.QName, parser.TypeAAAA, ip))
+		}
+	}
+	return answer, true
+}
+
+// ptr answers a query for name, the PTR name of ip inside the classless zone c.
+func (z *Zones) ptr(name string, qtype uint16, ip net.IP, c Classless) Answer {
+	names := z.hosts.Names(ip)
+	if len(names) == 0 {
+		return Answer{Zone: c.Name(), Rcode: parser.RcodeNXDomain, Authorities: []parser.Resource{z.soa(c)}}
+	}
+	if qtype != parser.TypePTR && qtype != parser.TypeANY {
+		return Answer{Zone: c.Name(), Authorities: []parser.Resource{z.soa(c)}}
+	}
+	return Answer{Zone: c.Name(), Answers: []parser.Resource{z.record(name, parser.TypePTR, []byte(names[0]))}}
+}
+
+func (z *Zones) record(name string, rtype uint16, rdata []byte) parser.Resource {
+	return parser.Resource{RName: name, RType: rtype, RClass: parser.ClassIN, RTtl: z.ttl, RData: rdata}
+}
+
+// soa returns the SOA record of c, its minimum field is used as negative TTL.
+func (z *Zones) soa(c Classless) parser.Resource {
+	rdata := append(parser.PackName(c.Name()), parser.PackName("hostmaster."+c.Name())...)
+	for _, v := range []uint32{z.serial, 3600, 600, 86400, z.ttl} {
+		rdata = binary.BigEndian.AppendUint32(rdata, v)
+	}
+	return z.record(c.Name(), parser.TypeSOA, rdata)
+}
@@ -0,0 +1,237 @@
+package zone
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+)
+
+// testHosts returns hosts holding the names of ip, given as name=ip pairs.
+func testHosts(pairs ...string) *Hosts {
+	h := &Hosts{byName: map[string][]net.IP{}, byAddr: map[string][]string{}}
+	for i := 0; i < len(pairs); i += 2 {
+		h.add(net.ParseIP(pairs[i+1]), pairs[i])
+	}
+	return h
+}
+
+func mustClassless(t *testing.T, s string) Classless {
+	c, err := ParseClassless(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// records returns the records of answer as text.
+func records(rrs []parser.Resource) []string {
+	var records []string
+	for _, rr := range rrs {
+		records = append(records, rr.String())
+	}
+	return records
+}
+
+func TestParseClassless(t *testing.T) {
+	tests := []struct {
+		in      string
+		network string
+		name    string // empty when invalid
+	}{
+		{"192.0.2.32/27", "192.0.2.32/27", "32/27.2.0.192.in-addr.arpa"},
+		{"192.0.2.45/27", "192.0.2.32/27", "32/27.2.0.192.in-addr.arpa"},
+		{"192.0.2.128/25", "192.0.2.128/25", "128/25.2.0.192.in-addr.arpa"},
+		{"198.51.100.6/31", "198.51.100.6/31", "6/31.100.51.198.in-addr.arpa"},
+		{"192.0.2.64/26=customers", "192.0.2.64/26", "customers.2.0.192.in-addr.arpa"},
+		{"192.0.2.64/26=", "192.0.2.64/26", "64/26.2.0.192.in-addr.arpa"},
+		{"192.0.2.0/24", "", ""},
+		{"192.0.2.1/32", "", ""},
+		{"10.0.0.0/8", "", ""},
+		{"2001:db8::/120", "", ""},
+		{"::ffff:192.0.2.32/123", "", ""},
+		{"192.0.2.32", "", ""},
+		{"example", "", ""},
+	}
+	for _, tt := range tests {
+		c, err := ParseClassless(tt.in)
+		if tt.name == "" {
+			if err == nil {
+				t.Errorf("%s: parsed as %s", tt.in, c.Name())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if c.Network.String() != tt.network || c.Name() != tt.name {
+			t.Errorf("%s: network %s named %s, want %s named %s", tt.in, c.Network, c.Name(), tt.network, tt.name)
+		}
+	}
+}
+
+func TestClasslessTarget(t *testing.T) {
+	c := mustClassless(t, "192.0.2.32/27")
+	if target := c.Target(net.ParseIP("192.0.2.33")); target != "33.32/27.2.0.192.in-addr.arpa" {
+		t.Errorf("target %s", target)
+	}
+	tests := []struct {
+		name string
+		ip   string // empty when not an address of the zone
+	}{
+		{"33.32/27.2.0.192.in-addr.arpa", "192.0.2.33"},
+		{"63.32/27.2.0.192.in-addr.arpa", "192.0.2.63"},
+		{"64.32/27.2.0.192.in-addr.arpa", ""},
+		{"31.32/27.2.0.192.in-addr.arpa", ""},
+		{"256.32/27.2.0.192.in-addr.arpa", ""},
+		{"x.32/27.2.0.192.in-addr.arpa", ""},
+		{"33.2.0.192.in-addr.arpa", ""},
+	}
+	for _, tt := range tests {
+		ip, ok := c.hostOf(tt.name)
+		if ok != (tt.ip != "") || (ok && !ip.Equal(net.ParseIP(tt.ip))) {
+			t.Errorf("%s: address %v, %v, want %q", tt.name, ip, ok, tt.ip)
+		}
+	}
+}
+
+func TestReverseAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string // empty when not a reverse name
+	}{
+		{"1.2.0.192.in-addr.arpa", "192.0.2.1"},
+		{"255.255.255.255.in-addr.arpa", "255.255.255.255"},
+		{"2.0.192.in-addr.arpa", ""},
+		{"5.1.2.0.192.in-addr.arpa", ""},
+		{"256.2.0.192.in-addr.arpa", ""},
+		{"a.2.0.192.in-addr.arpa", ""},
+		{"33.32/27.2.0.192.in-addr.arpa", ""},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", "2001:db8::1"},
+		{"F.E.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", "2001:db8::ef"},
+		{"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", ""},
+		{"10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", ""},
+		{"g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", ""},
+		{"www.example.com", ""},
+	}
+	for _, tt := range tests {
+		ip, ok := reverseAddr(tt.name)
+		if ok != (tt.ip != "") || (ok && !ip.Equal(net.ParseIP(tt.ip))) {
+			t.Errorf("%s: address %v, %v, want %q", tt.name, ip, ok, tt.ip)
+		}
+	}
+}
+
+func TestLookupClassless(t *testing.T) {
+	hosts := testHosts(
+		"gw.example.com", "192.0.2.33",
+		"gw-alias.example.com", "192.0.2.33",
+		"host.example.com", "192.0.2.200",
+		"other.example.com", "192.0.2.10",
+	)
+	z := New(hosts, []Classless{mustClassless(t, "192.0.2.32/27")}, 60)
+	const (
+		parent = "33.2.0.192.in-addr.arpa"
+		target = "33.32/27.2.0.192.in-addr.arpa"
+		zone   = "32/27.2.0.192.in-addr.arpa"
+	)
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		ok      bool
+		rcode   uint16
+		answers []string
+		soa     bool // the zone SOA is in the authority section
+	}{
+		{
+			"chain to the PTR", parent, parser.TypePTR, true, parser.RcodeNoError,
+			[]string{parent + ". 60 IN CNAME " + target + ".", target + ". 60 IN PTR gw.example.com."}, false,
+		},
+		{
+			"chain from any case", "33.2.0.192.IN-ADDR.ARPA.", parser.TypePTR, true, parser.RcodeNoError,
+			[]string{"33.2.0.192.IN-ADDR.ARPA. 60 IN CNAME " + target + ".", target + ". 60 IN PTR gw.example.com."}, false,
+		},
+		{
+			"CNAME only", parent, parser.TypeCNAME, true, parser.RcodeNoError,
+			[]string{parent + ". 60 IN CNAME " + target + "."}, false,
+		},
+		{
+			"chain to no data", parent, parser.TypeA, true, parser.RcodeNoError,
+			[]string{parent + ". 60 IN CNAME " + target + "."}, true,
+		},
+		{
+			"chain to no name", "34.2.0.192.in-addr.arpa", parser.TypePTR, true, parser.RcodeNXDomain,
+			[]string{"34.2.0.192.in-addr.arpa. 60 IN CNAME 34." + zone + "."}, true,
+		},
+		{
+			"target", target, parser.TypePTR, true, parser.RcodeNoError,
+			[]string{target + ". 60 IN PTR gw.example.com."}, false,
+		},
+		{"target outside the subnet", "200." + zone, parser.TypePTR, true, parser.RcodeNXDomain, nil, true},
+		{"zone apex", zone, parser.TypePTR, true, parser.RcodeNoError, nil, true},
+		{
+			"address outside classless zones", "200.2.0.192.in-addr.arpa", parser.TypePTR, true, parser.RcodeNoError,
+			[]string{"200.2.0.192.in-addr.arpa. 60 IN PTR host.example.com."}, false,
+		},
+		{"address outside classless zones, other type", "200.2.0.192.in-addr.arpa", parser.TypeA, false, 0, nil, false},
+		{"unknown address", "7.7.0.192.in-addr.arpa", parser.TypePTR, false, 0, nil, false},
+	}
+	for _, tt := range tests {
+		answer, ok := z.Lookup(parser.Question{QName: tt.qname, QType: tt.qtype, QClass: parser.ClassIN})
+		if ok != tt.ok {
+			t.Errorf("%s: answered %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if got := records(answer.Answers); answer.Rcode != tt.rcode || !slices.Equal(got, tt.answers) {
+			t.Errorf("%s: rcode %d with %v, want %d with %v", tt.name, answer.Rcode, got, tt.rcode, tt.answers)
+		}
+		if soa := len(answer.Authorities) == 1 && answer.Authorities[0].RType == parser.TypeSOA; soa != tt.soa {
+			t.Errorf("%s: authorities %v", tt.name, records(answer.Authorities))
+		}
+	}
+}
+
+func TestLookupOverlappingClassless(t *testing.T) {
+	// The target of the first zone is a name of the second one: the chain
+	// is expanded a single hop, not followed into the other zone, which
+	// would loop between zones labelled after each other
+	z := New(testHosts("gw.example.com", "192.0.2.33"), []Classless{
+		mustClassless(t, "192.0.2.0/26=inner"),
+		mustClassless(t, "192.0.2.0/25=inner"),
+	}, 60)
+	answer, ok := z.Lookup(parser.Question{QName: "33.2.0.192.in-addr.arpa", QType: parser.TypePTR, QClass: parser.ClassIN})
+	want := []string{
+		"33.2.0.192.in-addr.arpa. 60 IN CNAME 33.inner.2.0.192.in-addr.arpa.",
+		"33.inner.2.0.192.in-addr.arpa. 60 IN PTR gw.example.com.",
+	}
+	if got := records(answer.Answers); !ok || !slices.Equal(got, want) {
+		t.Errorf("answered %v with %v, want %v", ok, got, want)
+	}
+}
+
+func TestLookupHosts(t *testing.T) {
+	z := New(testHosts("nas.home", "192.168.1.10", "nas.home", "fd00::10", "NAS2.home.", "192.168.1.11"), nil, 60)
+	tests := []struct {
+		qname   string
+		qtype   uint16
+		ok      bool
+		answers []string
+	}{
+		{"nas.home", parser.TypeA, true, []string{"nas.home. 60 IN A 192.168.1.10"}},
+		{"NAS.home.", parser.TypeAAAA, true, []string{"NAS.home. 60 IN AAAA fd00::10"}},
+		{"nas2.home", parser.TypeAAAA, true, nil},
+		{"nas.home", parser.TypeMX, true, nil},
+		{"nas.home", parser.TypeTXT, true, nil},
+		{"other.home", parser.TypeA, false, nil},
+		{"10.1.168.192.in-addr.arpa", parser.TypePTR, true, []string{"10.1.168.192.in-addr.arpa. 60 IN PTR nas.home."}},
+	}
+	for _, tt := range tests {
+		answer, ok := z.Lookup(parser.Question{QName: tt.qname, QType: tt.qtype, QClass: parser.ClassIN})
+		if got := records(answer.Answers); ok != tt.ok || !slices.Equal(got, tt.answers) {
+			t.Errorf("%s %s: answered %v with %v, want %v with %v", tt.qname, parser.TypeString(tt.qtype), ok, got, tt.ok, tt.answers)
+		}
+	}
+}
@@ -1,86 +1,657 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/gertanoh/dns-resolver/internal/parser"
+	"github.com/gertanoh/dns-resolver/internal/anomaly"
+	"github.com/gertanoh/dns-resolver/internal/api"
+	"github.com/gertanoh/dns-resolver/internal/blocklist"
+	"github.com/gertanoh/dns-resolver/internal/cache"
+	"github.com/gertanoh/dns-resolver/internal/cluster"
+	"github.com/gertanoh/dns-resolver/internal/device"
+	"github.com/gertanoh/dns-resolver/internal/handoff"
+	"github.com/gertanoh/dns-resolver/internal/ipset"
+	"github.com/gertanoh/dns-resolver/internal/kube"
+	"github.com/gertanoh/dns-resolver/internal/metrics"
+	"github.com/gertanoh/dns-resolver/internal/policy"
+	"github.com/gertanoh/dns-resolver/internal/querylog"
+	"github.com/gertanoh/dns-resolver/internal/rewrite"
+	"github.com/gertanoh/dns-resolver/internal/server"
+	"github.com/gertanoh/dns-resolver/internal/upstream"
+	"github.com/gertanoh/dns-resolver/internal/warmup"
+	"github.com/gertanoh/dns-resolver/internal/zone"
 )
 
-// Map of question and clientIps
-var registryMap = map[parser.Question]string{}
+// queryLogSize is the number of recent queries kept for the API
+const queryLogSize = 1000
+
+// blockHitsSize is the number of recent blocklist hits kept for the API
+const blockHitsSize = 100
+
+// blockHitSeries caps the series of dns_blocklist_hits: lists hold up to
+// millions of rules, the first ones hit get a series of their own and the
+// others share one, with "other" as source and rule.
+const blockHitSeries = 1000
+
+// anomalyLogSize is the number of recent anomalies kept for the API
+const anomalyLogSize = 100
+
+// persistInterval is how often state persisted across restarts, such as
+// -stats-file, is written, besides on exit
+const persistInterval = 10 * time.Minute
+
+// tlsSessionCacheSize is the number of TLS sessions kept for upstream
+// servers, one per server is enough
+const tlsSessionCacheSize = 64
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "decode" {
+		os.Exit(decodeCommand(os.Args[2:]))
+	}
 
 	var port int
+	var upstreamAddr string
+	var panicMode, fallbackAddr string
+	var upstreamTimeout time.Duration
+	var tlsSessionFile string
+	var dupWindow time.Duration
+	var sortAnswers bool
+	var sortList string
+	var sortPrefix4, sortPrefix6 int
+	var minimalAny bool
+	var zones localZones
+	var localTTL uint
+	var blocklists string
+	var blockMode string
+	var policyFile string
+	var rewriteFile string
+	var kubeConfig, kubeDomain string
+	var kubeSync time.Duration
+	var kubeTTL uint
+	var ipsetRules, ipsetSink string
+	var cacheSize, cacheShards int
+	var stretch float64
+	var warmUpFile, statsFile string
+	var warmUpTop int
+	var logQueries bool
+	var slowQuery time.Duration
+	var anomalies anomaly.Config
+	var devices device.Config
+	var deviceLeases string
+	var deviceRefresh time.Duration
+	var apiAddr, apiTokenFile string
+	var debug bool
+	var probeName string
+	var probeFailure string
+	var probeTimeout time.Duration
+	var drainTimeout, upgradeTimeout time.Duration
+	var clusterName, clusterListen, clusterPeers, clusterKeyFile string
+	var chaos upstream.Chaos
 	flag.IntVar(&port, "p", 53, "port server is listenning to")
+	flag.StringVar(&panicMode, "panic-mode", server.PanicOff, "conservative mode for incidents and outages, also switched on the API: off, cache-only (local data and cache only, no upstream traffic) or fallback (queries go to -panic-fallback)")
+	flag.StringVar(&fallbackAddr, "panic-fallback", "", "upstream DNS server of the fallback panic mode, in the -upstream format")
+	flag.StringVar(&upstreamAddr, "upstream", "8.8.8.8:53", "upstream DNS server queries are forwarded to: host:port over UDP, tls://host[:port][#server-name] over TLS, or an https:// URL over HTTPS")
+	flag.DurationVar(&upstreamTimeout, "upstream-timeout", 3*time.Second, "time to wait for an upstream answer")
+	flag.StringVar(&tlsSessionFile, "tls-session-file", "", "file where the TLS sessions of upstream servers are persisted, to resume them after a restart")
+	flag.DurationVar(&dupWindow, "dup-window", 5*time.Second, "window after an answer during which client retransmits are replayed instead of forwarded")
+	flag.BoolVar(&sortAnswers, "sort-answers", false, "order A/AAAA answers so addresses on the client's subnet come first")
+	flag.StringVar(&sortList, "sortlist", "", "networks preferred after the client's subnet, in order, resolv.conf style (e.g. 10.0.0.0/8,130.155.0.0/255.255.0.0)")
+	flag.IntVar(&sortPrefix4, "sort-prefix4", 24, "prefix length of the client subnet for IPv4 clients")
+	flag.IntVar(&sortPrefix6, "sort-prefix6", 64, "prefix length of the client subnet for IPv6 clients")
+	flag.BoolVar(&minimalAny, "minimal-any", true, "answer ANY queries with a minimal HINFO record (RFC 8482) instead of forwarding them")
+	flag.StringVar(&zones.hostsFile, "hosts", "", "hosts file answering forward lookups and PTR lookups of its addresses")
+	flag.StringVar(&zones.varsFile, "hosts-vars", "", "file of the values of the {{name}} placeholders of -hosts, name = value lines with per-view overrides in [view] sections")
+	flag.StringVar(&zones.view, "hosts-view", "", "section of -hosts-vars overriding its default values, e.g. the name of the site")
+	flag.StringVar(&zones.reverseZones, "reverse-zone", "", "comma separated RFC 2317 classless reverse zones to serve from the hosts file, e.g. 192.0.2.32/27 or 192.0.2.32/27=32-63")
+	flag.UintVar(&localTTL, "local-ttl", 300, "TTL of records served from local data")
+	flag.StringVar(&kubeConfig, "kube", "", "serve the service names of a Kubernetes cluster, from in-cluster credentials (in-cluster) or a kubeconfig file")
+	flag.StringVar(&kubeDomain, "kube-domain", "cluster.local", "domain of the Kubernetes cluster")
+	flag.DurationVar(&kubeSync, "kube-sync", 30*time.Second, "interval between reads of the Kubernetes services and endpoints")
+	flag.UintVar(&kubeTTL, "kube-ttl", 5, "TTL of records served from the Kubernetes cluster")
+	flag.StringVar(&blocklists, "blocklist", "", "comma separated blocklist files: domains, hosts file lines or ||domain^ rules")
+	flag.StringVar(&blockMode, "block-mode", server.BlockNXDomain, "answer to blocked names: nxdomain or null (0.0.0.0 and ::)")
+	flag.StringVar(&policyFile, "policy", "", "JSON file of client profiles with query quotas and blocking schedules")
+	flag.StringVar(&rewriteFile, "rewrite", "", "JSON file of rules replacing addresses in, or dropping records from, the answers for some names")
+	flag.StringVar(&ipsetRules, "ipset", "", "comma separated pattern=set4[/set6] rules exporting the addresses of matching names to firewall sets, e.g. *.example.com=allowed4/allowed6")
+	flag.StringVar(&ipsetSink, "ipset-sink", "", "where -ipset addresses go: nft:family table (e.g. nft:inet filter) or unixgram:path for JSON datagrams")
+	flag.IntVar(&cacheSize, "cache-size", 10000, "number of answers kept in cache, 0 disables caching")
+	flag.IntVar(&cacheShards, "cache-shards", 32, "number of independently locked cache shards")
+	flag.Float64Var(&stretch, "optimistic-stretch", 0, "serve cached answers until their age reaches this factor of their TTL, e.g. 1.2, refreshing expired ones in the background, 0 disables")
+	flag.StringVar(&warmUpFile, "warmup", "", "file of names prefetched into the cache at startup, one per line with an optional record type")
+	flag.StringVar(&statsFile, "stats-file", "", "file where the most queried names are persisted, to prefetch them on the next start")
+	flag.IntVar(&warmUpTop, "warmup-top", 200, "number of the most queried names of -stats-file prefetched at startup")
+	flag.BoolVar(&logQueries, "log-queries", true, "log a line for every answered query")
+	flag.DurationVar(&slowQuery, "slow-query", 0, "log queries answered in this time or more with a breakdown of where the time went, 0 disables")
+	flag.BoolVar(&devices.Neighbors, "client-neighbors", false, "tell clients apart by the hardware addresses of the ARP table, and of the NDP table when the ip command is installed")
+	flag.StringVar(&deviceLeases, "client-leases", "", "comma separated dnsmasq lease files giving the hardware address and hostname of DHCP clients")
+	flag.StringVar(&devices.Names, "client-names", "", "file of address or hardware address and device name lines, e.g. aa:bb:cc:dd:ee:ff kids-tablet")
+	flag.DurationVar(&deviceRefresh, "client-refresh", 30*time.Second, "interval between reads of -client-neighbors, -client-leases and -client-names")
+	flag.DurationVar(&anomalies.Window, "anomaly-window", time.Minute, "window over which -anomaly-nxdomain and -anomaly-dga are counted")
+	flag.IntVar(&anomalies.NXDomain, "anomaly-nxdomain", 0, "log an anomaly when a client gets this many NXDOMAIN answers within -anomaly-window, e.g. 50, 0 disables")
+	flag.IntVar(&anomalies.DGA, "anomaly-dga", 0, "log an anomaly when a client resolves this many random looking names, as made up by malware, within -anomaly-window, e.g. 20, 0 disables")
+	flag.IntVar(&anomalies.MinLength, "anomaly-dga-length", 10, "shortest label looked at by -anomaly-dga")
+	flag.Float64Var(&anomalies.Entropy, "anomaly-dga-entropy", 3.2, "lowest Shannon entropy, in bits per character, of labels counted by -anomaly-dga")
+	flag.StringVar(&apiAddr, "api", "", "address of the HTTP JSON API, e.g. 127.0.0.1:8053, disabled when empty")
+	flag.StringVar(&apiTokenFile, "api-token-file", "", "file holding the bearer token required by the API actions, such as /cache/flush, which are only taken from loopback otherwise")
+	flag.BoolVar(&debug, "debug", false, "dump messages and report answer sources to EDNS clients as Extended DNS Error text")
+	flag.StringVar(&probeName, "probe", "", "name resolved through the whole pipeline at startup before reporting ready, e.g. example.com")
+	flag.StringVar(&probeFailure, "probe-failure", "wait", "what to do when the startup probe fails: wait (keep serving, retry, stay not ready) or exit")
+	flag.DurationVar(&probeTimeout, "probe-timeout", 10*time.Second, "time given to the startup probe to succeed")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 5*time.Second, "time given to queries being answered when shutting down or after an upgrade")
+	flag.DurationVar(&upgradeTimeout, "upgrade-timeout", 30*time.Second, "time given to the new binary to become ready on upgrade (SIGUSR2)")
+	flag.StringVar(&clusterListen, "cluster-listen", "", "address cluster events from peers are received on, e.g. :5380, enables cluster mode")
+	flag.StringVar(&clusterPeers, "cluster-peers", "", "comma separated addresses of the peers cluster events are sent to")
+	flag.StringVar(&clusterKeyFile, "cluster-key-file", "", "file holding the key, shared by all nodes, authenticating cluster events")
+	flag.StringVar(&clusterName, "cluster-name", "", "name of this node in cluster events, the hostname by default")
+	flag.DurationVar(&chaos.Latency, "chaos-latency", 0, "developer mode: latency added to upstream exchanges")
+	flag.DurationVar(&chaos.Jitter, "chaos-jitter", 0, "developer mode: random latency added to upstream exchanges, up to this")
+	flag.Float64Var(&chaos.DropRate, "chaos-drop", 0, "developer mode: fraction of upstream queries dropped, from 0 to 1")
+	flag.Float64Var(&chaos.MalformRate, "chaos-malformed", 0, "developer mode: fraction of upstream answers corrupted, from 0 to 1")
+	flag.Int64Var(&chaos.Seed, "chaos-seed", 1, "developer mode: seed of the chaos faults, the same seed gives the same faults to queries sent one at a time")
 	flag.Parse()
 
-	// Resolve UDP address
-	addr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(port))
+	if probeFailure != "wait" && probeFailure != "exit" {
+		log.Printf("Invalid -probe-failure %q, expected wait or exit", probeFailure)
+		os.Exit(1)
+	}
+	if blockMode != server.BlockNXDomain && blockMode != server.BlockNull {
+		log.Printf("Invalid -block-mode %q, expected nxdomain or null", blockMode)
+		os.Exit(1)
+	}
+	if sortPrefix4 < 0 || sortPrefix4 > 32 {
+		log.Printf("Invalid -sort-prefix4 %d, expected 0 to 32", sortPrefix4)
+		os.Exit(1)
+	}
+	if sortPrefix6 < 0 || sortPrefix6 > 128 {
+		log.Printf("Invalid -sort-prefix6 %d, expected 0 to 128", sortPrefix6)
+		os.Exit(1)
+	}
+	if anomalies.Window <= 0 {
+		log.Printf("Invalid -anomaly-window %v, expected a positive duration", anomalies.Window)
+		os.Exit(1)
+	}
+
+	var registry *metrics.Registry
+	if apiAddr != "" {
+		registry = metrics.NewRegistry()
+	}
+	var persist []persisted
+	sessions := upstream.NewSessionCache(tlsSessionCacheSize)
+	if tlsSessionFile != "" {
+		if err := sessions.Load(tlsSessionFile); err != nil {
+			log.Println("Error loading TLS sessions:", err)
+			os.Exit(1)
+		}
+		persist = append(persist, persisted{"TLS sessions", tlsSessionFile, sessions.Save})
+	}
+	onHandshake := handshakeMetrics(registry)
+	up, err := newUpstream(upstreamAddr, upstreamTimeout, sessions, onHandshake)
 	if err != nil {
-		log.Println("Error resolving address: ", err)
+		log.Println("Invalid -upstream:", err)
 		os.Exit(1)
 	}
+	var fallback upstream.Exchanger
+	if fallbackAddr != "" {
+		if fallback, err = newUpstream(fallbackAddr, upstreamTimeout, sessions, onHandshake); err != nil {
+			log.Println("Invalid -panic-fallback:", err)
+			os.Exit(1)
+		}
+	}
+	if chaos.Latency > 0 || chaos.Jitter > 0 || chaos.DropRate > 0 || chaos.MalformRate > 0 {
+		log.Printf("Chaos mode: upstream latency %v+%v, %.0f%% dropped, %.0f%% malformed, seed %d",
+			chaos.Latency, chaos.Jitter, chaos.DropRate*100, chaos.MalformRate*100, chaos.Seed)
+		chaos.Upstream, chaos.Timeout = up, upstreamTimeout
+		up = &chaos
+	}
 
-	conn, err := net.ListenUDP("udp", addr)
+	cfg := server.Config{
+		Upstream:   up,
+		Fallback:   fallback,
+		DupWindow:  dupWindow,
+		MinimalAny: minimalAny,
+		LogQueries: logQueries,
+		SlowQuery:  slowQuery,
+		BlockMode:  blockMode,
+		Debug:      debug,
+	}
+	if sortAnswers || sortList != "" {
+		networks, err := server.ParseSortList(sortList)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		cfg.SortList = &server.SortList{Prefix4: sortPrefix4, Prefix6: sortPrefix6, Networks: networks}
+	}
+	zones.ttl = uint32(localTTL)
+	if zones.configured() {
+		z, err := zones.load()
+		if err != nil {
+			log.Println("Error loading local zones:", err)
+			os.Exit(1)
+		}
+		cfg.Zones = z
+	}
+	if kubeConfig != "" {
+		var client *kube.Client
+		var err error
+		if kubeConfig == "in-cluster" {
+			client, err = kube.InCluster()
+		} else {
+			client, err = kube.FromKubeconfig(kubeConfig)
+		}
+		if err != nil {
+			log.Println("Error loading Kubernetes credentials:", err)
+			os.Exit(1)
+		}
+		k8s := kube.New(client, kubeDomain, uint32(kubeTTL))
+		go k8s.Run(context.Background(), kubeSync)
+		cfg.Kubernetes = k8s
+	}
+
+	if apiAddr != "" {
+		cfg.QueryLog = querylog.New(queryLogSize)
+		cfg.Metrics = registry
+		if slowQuery > 0 {
+			cfg.SlowLog = querylog.New(queryLogSize)
+		}
+	}
+	if anomalies.NXDomain > 0 || anomalies.DGA > 0 {
+		detector, err := anomaly.New(anomalies, anomalyLogSize)
+		if err != nil {
+			log.Println("Error setting up anomaly detection:", err)
+			os.Exit(1)
+		}
+		cfg.Anomaly = detector
+		if registry != nil {
+			nxdomain := registry.Counter("dns_anomaly_nxdomain_bursts", "NXDOMAIN bursts raised by clients.")
+			dga := registry.Counter("dns_anomaly_dga", "Bursts of random looking names raised by clients.")
+			cfg.Anomaly.OnEvent = func(e anomaly.Event) {
+				if e.Kind == anomaly.NXDomainBurst {
+					nxdomain.Inc()
+				} else {
+					dga.Inc()
+				}
+			}
+		}
+	}
+	if cacheSize > 0 {
+		cfg.Cache = cache.New(cacheSize, cacheShards)
+		cfg.Stretch = stretch
+	}
+	if statsFile != "" {
+		cfg.Stats = warmup.NewStats()
+		if err := cfg.Stats.Load(statsFile); err != nil {
+			log.Println("Error loading query stats:", err)
+			os.Exit(1)
+		}
+		persist = append(persist, persisted{"query stats", statsFile, cfg.Stats.Save})
+	}
+	for _, p := range persist {
+		go p.saveEvery(persistInterval)
+	}
+	warmUpDomains, err := warmUpList(warmUpFile, cfg.Stats, warmUpTop)
 	if err != nil {
-		fmt.Println("Error listenning on UDP port:", err)
+		log.Println("Error loading warm-up list:", err)
 		os.Exit(1)
 	}
-	defer conn.Close()
+	if blocklists != "" {
+		list, err := loadBlocklists(blocklists)
+		if err != nil {
+			log.Println("Error loading blocklist:", err)
+			os.Exit(1)
+		}
+		log.Printf("Blocking %d domains", list.Len())
+		cfg.Blocklist = list
+		if registry != nil {
+			cfg.BlockHits = blocklist.NewHits(blockHitsSize)
+			hits := registry.CounterVec("dns_blocklist_hits", "Queries blocked by each blocklist rule.", "source", "rule").Limit(blockHitSeries, "other", "other")
+			cfg.BlockHits.OnHit = func(h blocklist.Hit) {
+				hits.With(h.Source, h.Rule).Inc()
+			}
+		}
+	}
+	if rewriteFile != "" {
+		rewriter, err := rewrite.Load(rewriteFile)
+		if err != nil {
+			log.Println("Error loading rewrite rules:", err)
+			os.Exit(1)
+		}
+		cfg.Rewrite = rewriter
+	}
+	if ipsetRules != "" {
+		exporter, err := loadIPSet(ipsetRules, ipsetSink)
+		if err != nil {
+			log.Println("Error setting up IP set export:", err)
+			os.Exit(1)
+		}
+		cfg.IPSet = exporter
+	}
+	if deviceLeases != "" {
+		devices.Leases = strings.Split(deviceLeases, ",")
+	}
+	if devices.Neighbors || devices.Leases != nil || devices.Names != "" {
+		cfg.Devices = device.New(devices)
+		if err := cfg.Devices.Refresh(context.Background()); err != nil {
+			log.Println("Error reading client devices:", err)
+			os.Exit(1)
+		}
+		go cfg.Devices.Run(context.Background(), deviceRefresh)
+		if cfg.BlockHits != nil {
+			cfg.BlockHits.ClientName = cfg.Devices.Name
+		}
+		if cfg.Anomaly != nil {
+			cfg.Anomaly.ClientName = cfg.Devices.Name
+		}
+	}
+	if policyFile != "" {
+		profiles, err := policy.Load(policyFile)
+		if err != nil {
+			log.Println("Error loading policy:", err)
+			os.Exit(1)
+		}
+		cfg.Policy = append(cfg.Policy, profiles)
+	}
 
-	fmt.Printf("Listenning on UDP port %d\n", port)
+	srv := server.New(cfg)
+	if err := srv.SetPanicMode(panicMode); err != nil {
+		log.Println("Invalid -panic-mode:", err)
+		os.Exit(1)
+	}
+	// The mode the previous binary was in on upgrade wins over the flag
+	if mode, ok := os.LookupEnv(envPanicMode); ok {
+		os.Unsetenv(envPanicMode)
+		if err := srv.SetPanicMode(mode); err != nil {
+			log.Printf("Ignoring the panic mode handed over on upgrade: %v", err)
+		} else {
+			panicMode = mode
+		}
+	}
+	if panicMode != server.PanicOff {
+		log.Printf("Panic mode %s", panicMode)
+	}
+	var ready atomic.Bool
 
-	buffer := make([]byte, 512) // DNS messages are lower than 512
+	socks, err := openSockets(handoff.Inherited(), port, apiAddr, clusterListen)
+	if err != nil {
+		log.Println("Error opening sockets:", err)
+		os.Exit(1)
+	}
+	defer socks.dns.Close()
 
-	for {
-		// Read from connection
-		n, clientAddr, err := conn.ReadFromUDP(buffer)
+	adm := &admin{srv: srv, blocklists: blocklists, zones: zones}
+	if apiTokenFile != "" {
+		token, err := os.ReadFile(apiTokenFile)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Println("Error reading API token:", err)
+			os.Exit(1)
 		}
-		question, err := parser.Read(buffer, n)
+		if adm.token = bytes.TrimSpace(token); len(adm.token) == 0 {
+			log.Println("Error reading API token: empty", apiTokenFile)
+			os.Exit(1)
+		}
+	}
+	if socks.cluster != nil {
+		node, err := startCluster(clusterName, socks.cluster, clusterPeers, clusterKeyFile, adm.apply)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Println("Error starting cluster mode:", err)
+			os.Exit(1)
+		}
+		adm.cluster = node
+	}
+
+	if socks.api != nil {
+		a := api.New()
+		a.HandleJSON("/cache/flush", adm.handler(cluster.FlushCache))
+		a.HandleJSON("/reload/blocklist", adm.handler(cluster.ReloadBlocklist))
+		a.HandleJSON("/reload/zones", adm.handler(cluster.ReloadZones))
+		setPanicMode := adm.handler(cluster.PanicMode)
+		a.HandleJSON("/panic-mode", func(r *http.Request) (any, error) {
+			if r.Method == http.MethodGet {
+				return map[string]string{"mode": srv.PanicMode()}, nil
+			}
+			return setPanicMode(r)
+		})
+		a.HandleJSON("/queries", func(r *http.Request) (any, error) {
+			n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+			return cfg.QueryLog.Recent(n), nil
+		})
+		a.HandleJSON("/slow-queries", func(r *http.Request) (any, error) {
+			if cfg.SlowLog == nil {
+				return nil, &api.StatusError{Status: http.StatusNotFound, Err: errors.New("slow-query log disabled, see -slow-query")}
+			}
+			n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+			return cfg.SlowLog.Recent(n), nil
+		})
+		a.Handle("/metrics", cfg.Metrics)
+		a.HandleJSON("/blocklist/hits", func(r *http.Request) (any, error) {
+			if cfg.BlockHits == nil {
+				return nil, &api.StatusError{Status: http.StatusNotFound, Err: errors.New("no blocklist configured, see -blocklist")}
+			}
+			return cfg.BlockHits.Recent(), nil
+		})
+		a.HandleJSON("/clients", func(r *http.Request) (any, error) {
+			if cfg.Devices == nil {
+				return nil, &api.StatusError{Status: http.StatusNotFound, Err: errors.New("client identification disabled, see -client-neighbors, -client-leases and -client-names")}
+			}
+			return cfg.Devices.All(), nil
+		})
+		a.HandleJSON("/anomalies", func(r *http.Request) (any, error) {
+			if cfg.Anomaly == nil {
+				return nil, &api.StatusError{Status: http.StatusNotFound, Err: errors.New("anomaly detection disabled, see -anomaly-nxdomain and -anomaly-dga")}
+			}
+			return cfg.Anomaly.Recent(), nil
+		})
+		a.HandleJSON("/ready", func(r *http.Request) (any, error) {
+			if !ready.Load() {
+				return nil, &api.StatusError{Status: http.StatusServiceUnavailable, Err: errors.New("startup probe has not succeeded yet")}
+			}
+			return map[string]bool{"ready": true}, nil
+		})
+		go func() {
+			log.Println("API stopped:", a.Serve(socks.api))
+		}()
+	}
+
+	// Catch a broken upstream or configuration before clients rely on us
+	if probeName != "" && probeFailure == "exit" {
+		if err := selfTest(srv, probeName, probeTimeout); err != nil {
+			log.Printf("Startup probe did not succeed within %v, exiting", probeTimeout)
+			os.Exit(1)
+		}
+		markReady(&ready)
+	}
+
+	fmt.Printf("Listenning on UDP %s\n", socks.dns.LocalAddr())
+	go handleSignals(srv, socks, drainTimeout, upgradeTimeout, func() {
+		for _, p := range persist {
+			p.save()
 		}
+	})
+	if len(warmUpDomains) > 0 && cfg.Cache != nil {
+		go warmUp(srv, warmUpDomains, upstreamTimeout)
+	}
+
+	switch {
+	case probeName == "":
+		markReady(&ready)
+	case probeFailure == "wait":
+		go func() {
+			for selfTest(srv, probeName, probeTimeout) != nil {
+				time.Sleep(probeTimeout)
+			}
+			markReady(&ready)
+		}()
+	}
 
-		for _, q := range question.Questions {
-			registryMap[q] = clientAddr.String()
+	if err := srv.Serve(socks.dns); err != nil {
+		log.Println(err)
+		return
+	}
+	// Serve only returns cleanly on shutdown, handleSignals exits once the
+	// queries being answered are
+	select {}
+}
+
+// handshakeMetrics returns the function counting the TLS handshakes with
+// upstream servers in registry, nil without registry.
+func handshakeMetrics(registry *metrics.Registry) upstream.HandshakeFunc {
+	if registry == nil {
+		return nil
+	}
+	handshakes := registry.Counter("dns_upstream_tls_handshakes", "TLS handshakes with upstream servers.")
+	resumed := registry.Counter("dns_upstream_tls_resumed_handshakes", "TLS handshakes with upstream servers resuming a session.")
+	duration := registry.Histogram("dns_upstream_tls_handshake_seconds", "Time taken by TLS handshakes with upstream servers.", metrics.LatencyBuckets)
+	return func(d time.Duration, didResume bool) {
+		handshakes.Inc()
+		if didResume {
+			resumed.Inc()
 		}
+		duration.Observe(d, 0)
+	}
+}
 
-		// forward request to Google DNS
-		googleDNS := "8.8.8.8:53"
-		forwardConn, err := net.Dial("udp", googleDNS)
+// newUpstream returns an upstream from its address as given to -upstream
+// or -panic-fallback. TLS upstreams resume sessions from sessions and
+// report their handshakes to onHandshake, when set.
+func newUpstream(addr string, timeout time.Duration, sessions *upstream.SessionCache, onHandshake upstream.HandshakeFunc) (upstream.Exchanger, error) {
+	switch {
+	case strings.HasPrefix(addr, "https://"):
+		return upstream.NewHTTPS(addr, timeout, &tls.Config{ClientSessionCache: sessions}, onHandshake), nil
+	case strings.HasPrefix(addr, "tls://"):
+		hostPort, serverName, _ := strings.Cut(strings.TrimPrefix(addr, "tls://"), "#")
+		host, _, err := net.SplitHostPort(hostPort)
 		if err != nil {
-			log.Printf("Fail to dial Google DNS : %v", err)
+			host, hostPort = hostPort, net.JoinHostPort(hostPort, "853")
+		}
+		if serverName == "" {
+			serverName = host
+		}
+		config := &tls.Config{ServerName: serverName, ClientSessionCache: sessions}
+		return &upstream.TLS{Addr: hostPort, Timeout: timeout, Config: config, OnHandshake: onHandshake}, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+	return &upstream.UDP{Addr: addr, Timeout: timeout}, nil
+}
+
+// startCluster joins the cluster, receiving events on conn, peers being
+// comma separated addresses.
+func startCluster(name string, conn *net.UDPConn, peers, keyFile string, apply func(cluster.Event) error) (*cluster.Node, error) {
+	if keyFile == "" {
+		return nil, errors.New("-cluster-key-file is required")
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		if name, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	var addrs []string
+	for _, peer := range strings.Split(peers, ",") {
+		if peer != "" {
+			addrs = append(addrs, peer)
+		}
+	}
+	node, err := cluster.New(name, conn, addrs, bytes.TrimSpace(key), apply)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Cluster mode: node %s on %s, %d peers", name, conn.LocalAddr(), len(addrs))
+	go func() {
+		log.Println("Cluster stopped:", node.Run())
+	}()
+	return node, nil
+}
+
+// localZones are the sources of the local zones, read again on reload.
+type localZones struct {
+	hostsFile    string
+	varsFile     string // values of the placeholders of hostsFile
+	view         string // section of varsFile
+	reverseZones string // comma separated classless reverse zones
+	ttl          uint32
+}
+
+func (l localZones) configured() bool {
+	return l.hostsFile != "" || l.reverseZones != ""
+}
+
+// load reads the hosts file, expanding its placeholders, and the classless
+// reverse zones.
+func (l localZones) load() (*zone.Zones, error) {
+	var vars zone.Vars
+	if l.varsFile != "" {
+		var err error
+		if vars, err = zone.LoadVars(l.varsFile, l.view); err != nil {
+			return nil, err
+		}
+	}
+	var hosts *zone.Hosts
+	if l.hostsFile != "" {
+		var err error
+		if hosts, err = zone.LoadHosts(l.hostsFile, vars); err != nil {
+			return nil, err
+		}
+	}
+
+	var classless []zone.Classless
+	for _, z := range strings.Split(l.reverseZones, ",") {
+		if z == "" {
 			continue
 		}
-		// Forward request to Google DNS
-		_, err = forwardConn.Write(buffer)
+		c, err := zone.ParseClassless(z)
 		if err != nil {
-			log.Printf("Failed to write to Google's DNS server: %v", err)
-			forwardConn.Close()
-			continue
+			return nil, err
 		}
+		classless = append(classless, c)
+	}
+	return zone.New(hosts, classless, l.ttl), nil
+}
 
-		// Get the answer
-		answerCount, err := forwardConn.Read(buffer)
-		if err != nil {
-			log.Printf("Failed to read from Google's DNS server: %v", err)
-			forwardConn.Close()
+// loadIPSet returns the exporter of the addresses of names matching rules
+// to sink.
+func loadIPSet(rules string, sink string) (*ipset.Exporter, error) {
+	parsed, err := ipset.ParseRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	if sink == "" {
+		return nil, errors.New("-ipset needs an -ipset-sink")
+	}
+	s, err := ipset.ParseSink(sink)
+	if err != nil {
+		return nil, err
+	}
+	return ipset.New(parsed, s), nil
+}
+
+// loadBlocklists reads the comma separated blocklist files.
+func loadBlocklists(files string) (*blocklist.List, error) {
+	builder := blocklist.NewBuilder()
+	for _, file := range strings.Split(files, ",") {
+		if file == "" {
 			continue
 		}
-		forwardConn.Close()
-
-		fmt.Println("Answer")
-		parser.Read(buffer, answerCount)
-		conn.WriteToUDP(buffer[:answerCount], clientAddr)
+		if err := builder.AddFile(file); err != nil {
+			return nil, err
+		}
 	}
+	return builder.Build(), nil
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// persisted is state written to a file, periodically and on exit, to be
+// loaded back on the next start.
+type persisted struct {
+	what  string
+	path  string
+	write func(path string) error
+}
+
+func (p persisted) save() {
+	if err := p.write(p.path); err != nil {
+		log.Printf("Failed to save %s: %v", p.what, err)
+	}
+}
+
+func (p persisted) saveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		p.save()
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/handoff"
+	"github.com/gertanoh/dns-resolver/internal/server"
+	"github.com/gertanoh/dns-resolver/internal/systemd"
+)
+
+// selfTest resolves name through srv, retrying until it succeeds or timeout
+// elapses.
+func selfTest(srv *server.Server, name string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for {
+		err := srv.Probe(ctx, name)
+		if err == nil {
+			log.Printf("Startup probe of %s succeeded", name)
+			return nil
+		}
+		log.Printf("Startup probe of %s failed: %v", name, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// markReady reports the resolver ready on the API, to the binary it
+// replaces on upgrade and to systemd.
+func markReady(ready *atomic.Bool) {
+	ready.Store(true)
+	if handoff.Ready() {
+		log.Println("Took over from the previous binary")
+	}
+	if err := systemd.Notify("READY=1"); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/handoff"
+	"github.com/gertanoh/dns-resolver/internal/server"
+	"github.com/gertanoh/dns-resolver/internal/systemd"
+)
+
+// envPanicMode hands the panic mode over to the new binary on upgrade, it
+// may have been switched since the start through the API or the cluster.
+const envPanicMode = "DNS_RESOLVER_PANIC_MODE"
+
+// sockets are the sockets the resolver listens on, handed over to the new
+// binary on upgrade.
+type sockets struct {
+	dns     *net.UDPConn
+	api     net.Listener // nil without -api
+	cluster *net.UDPConn // nil without -cluster-listen
+}
+
+// openSockets takes the inherited sockets, see handoff.Inherited, where the
+// API socket is named "api", the cluster one "cluster" and any other is the
+// DNS one, and opens those missing.
+func openSockets(inherited map[string]*os.File, port int, apiAddr, clusterAddr string) (*sockets, error) {
+	var socks sockets
+	for name, f := range inherited {
+		switch {
+		case name == "api":
+			if apiAddr == "" {
+				break
+			}
+			l, err := net.FileListener(f)
+			if err != nil {
+				return nil, fmt.Errorf("inherited API socket: %w", err)
+			}
+			socks.api = l
+		case name == "cluster":
+			if clusterAddr == "" {
+				break
+			}
+			conn, err := udpFileConn(f)
+			if err != nil {
+				return nil, fmt.Errorf("inherited cluster socket: %w", err)
+			}
+			socks.cluster = conn
+		case socks.dns == nil:
+			conn, err := udpFileConn(f)
+			if err != nil {
+				return nil, fmt.Errorf("inherited DNS socket %s: %w", name, err)
+			}
+			socks.dns = conn
+		}
+		// The listeners hold their own copy of the descriptor
+		f.Close()
+	}
+
+	if socks.dns == nil {
+		addr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(port))
+		if err != nil {
+			return nil, err
+		}
+		if socks.dns, err = net.ListenUDP("udp", addr); err != nil {
+			return nil, err
+		}
+	}
+	if socks.api == nil && apiAddr != "" {
+		l, err := net.Listen("tcp", apiAddr)
+		if err != nil {
+			return nil, err
+		}
+		socks.api = l
+	}
+	if socks.cluster == nil && clusterAddr != "" {
+		addr, err := net.ResolveUDPAddr("udp", clusterAddr)
+		if err != nil {
+			return nil, err
+		}
+		if socks.cluster, err = net.ListenUDP("udp", addr); err != nil {
+			return nil, err
+		}
+	}
+	return &socks, nil
+}
+
+// udpFileConn returns the UDP socket of f.
+func udpFileConn(f *os.File) (*net.UDPConn, error) {
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := c.(*net.UDPConn)
+	if !ok {
+		c.Close()
+		return nil, errors.New("not a UDP socket")
+	}
+	return conn, nil
+}
+
+// files returns copies of the sockets to hand over to a new binary.
+func (s *sockets) files() (map[string]*os.File, error) {
+	files := map[string]*os.File{}
+	f, err := s.dns.File()
+	if err != nil {
+		return nil, err
+	}
+	files["dns"] = f
+	if s.api != nil {
+		f, err := s.api.(*net.TCPListener).File()
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files["api"] = f
+	}
+	if s.cluster != nil {
+		f, err := s.cluster.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files["cluster"] = f
+	}
+	return files, nil
+}
+
+func closeFiles(files map[string]*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// handleSignals drains srv and exits on SIGTERM or SIGINT. On SIGUSR2 it
+// starts the binary again, which may have been replaced, hands it the
+// sockets and drains once the new process answers queries. A failed
+// upgrade leaves this process serving. persist is called first, to save
+// state the next process reads.
+func handleSignals(srv *server.Server, socks *sockets, drainTimeout, upgradeTimeout time.Duration, persist func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+
+	for sig := range signals {
+		persist()
+		if sig == syscall.SIGUSR2 {
+			if err := upgrade(srv, socks, upgradeTimeout); err != nil {
+				log.Printf("Upgrade failed, still serving: %v", err)
+				continue
+			}
+		} else {
+			log.Printf("Received %v, shutting down", sig)
+			systemd.Notify("STOPPING=1")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Queries still unanswered after %v, exiting anyway", drainTimeout)
+		}
+		cancel()
+		os.Exit(0)
+	}
+}
+
+// upgrade starts the new binary with the sockets and the panic mode of srv,
+// and waits until it is ready to take over.
+func upgrade(srv *server.Server, socks *sockets, timeout time.Duration) error {
+	files, err := socks.files()
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+
+	log.Println("Upgrading, starting new binary")
+	proc, err := handoff.Upgrade(files, []string{envPanicMode + "=" + srv.PanicMode()}, timeout)
+	if err != nil {
+		return err
+	}
+	log.Printf("New binary running as pid %d, draining", proc.Pid)
+	// The new process is the service now, systemd must not stop it when
+	// this one exits
+	if err := systemd.Notify(fmt.Sprintf("MAINPID=%d", proc.Pid)); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+	return nil
+}
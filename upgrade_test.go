@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSocketsHandedOver(t *testing.T) {
+	old, err := openSockets(nil, 0, "127.0.0.1:0", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.dns.Close()
+	defer old.api.Close()
+	defer old.cluster.Close()
+
+	files, err := old.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFiles(files)
+	for _, name := range []string{"dns", "api", "cluster"} {
+		if files[name] == nil {
+			t.Fatalf("no %s socket handed over", name)
+		}
+	}
+
+	// Listening anew on the addresses in use would fail: the new binary
+	// must take every socket over
+	dnsPort := old.dns.LocalAddr().(*net.UDPAddr).Port
+	apiAddr, clusterAddr := old.api.Addr().String(), old.cluster.LocalAddr().String()
+	socks, err := openSockets(files, dnsPort, apiAddr, clusterAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.dns.Close()
+	defer socks.api.Close()
+	defer socks.cluster.Close()
+	if got := socks.dns.LocalAddr().String(); got != old.dns.LocalAddr().String() {
+		t.Errorf("DNS socket on %s, want %s", got, old.dns.LocalAddr())
+	}
+	if got := socks.api.Addr().String(); got != apiAddr {
+		t.Errorf("API socket on %s, want %s", got, apiAddr)
+	}
+	if got := socks.cluster.LocalAddr().String(); got != clusterAddr {
+		t.Errorf("cluster socket on %s, want %s", got, clusterAddr)
+	}
+}
+
+func TestSocketsNotHandedOverWithoutFlags(t *testing.T) {
+	old, err := openSockets(nil, 0, "127.0.0.1:0", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.dns.Close()
+	defer old.api.Close()
+	defer old.cluster.Close()
+	files, err := old.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFiles(files)
+
+	// Inherited sockets the new flags no longer ask for are left alone
+	socks, err := openSockets(files, old.dns.LocalAddr().(*net.UDPAddr).Port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.dns.Close()
+	if socks.api != nil || socks.cluster != nil {
+		t.Errorf("API socket %v, cluster socket %v, want none", socks.api, socks.cluster)
+	}
+}
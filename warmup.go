@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gertanoh/dns-resolver/internal/parser"
+	"github.com/gertanoh/dns-resolver/internal/server"
+	"github.com/gertanoh/dns-resolver/internal/warmup"
+)
+
+// warmUpConcurrency is the number of warm-up queries in flight, enough to
+// fill the cache quickly without flooding the upstream right at boot.
+const warmUpConcurrency = 8
+
+// warmUp prefetches domains into the cache, a few at a time, each given
+// timeout to be answered.
+func warmUp(srv *server.Server, domains []warmup.Domain, timeout time.Duration) {
+	start := time.Now()
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	next := make(chan warmup.Domain)
+	for i := 0; i < warmUpConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range next {
+				qtype, _ := parser.ParseType(d.Type)
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				if err := srv.Prefetch(ctx, d.Name, qtype); err != nil {
+					log.Printf("Failed to prefetch %s %s: %v", d.Name, d.Type, err)
+					failed.Add(1)
+				}
+				cancel()
+			}
+		}()
+	}
+	for _, d := range domains {
+		next <- d
+	}
+	close(next)
+	wg.Wait()
+	log.Printf("Prefetched %d names in %v, %d failed", len(domains), time.Since(start).Round(time.Millisecond), failed.Load())
+}
+
+// warmUpList returns the names to prefetch: those of the list file, then
+// the top most queried ones of the stats, without duplicates.
+func warmUpList(listFile string, stats *warmup.Stats, top int) ([]warmup.Domain, error) {
+	var domains []warmup.Domain
+	if listFile != "" {
+		list, err := warmup.ReadList(listFile)
+		if err != nil {
+			return nil, err
+		}
+		domains = list
+	}
+	if stats != nil && top > 0 {
+		domains = append(domains, stats.Top(top)...)
+	}
+
+	seen := map[warmup.Domain]bool{}
+	unique := domains[:0]
+	for _, d := range domains {
+		if !seen[d] {
+			seen[d] = true
+			unique = append(unique, d)
+		}
+	}
+	return unique, nil
+}